@@ -0,0 +1,117 @@
+package instances
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a mutating operation: who performed it, from where, on
+// which target and with which result.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Host     string    `json:"host"`
+	Command  string    `json:"command"`
+	Args     []string  `json:"args,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// AuditLog is an append-only log of AuditEntry.
+type AuditLog interface {
+	Append(entry AuditEntry) error
+	// Entries returns all the entries of the log, oldest first.
+	Entries() ([]AuditEntry, error)
+}
+
+// FileAuditLog is an AuditLog stored in a file, one JSON entry per line.
+type FileAuditLog struct {
+	Path string
+}
+
+func (l FileAuditLog) Append(entry AuditEntry) error {
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open audit log: %v", err)
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		return fmt.Errorf("write audit log: %v", err)
+	}
+	return f.Close()
+}
+
+func (l FileAuditLog) Entries() ([]AuditEntry, error) {
+	f, err := os.Open(l.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("read audit log line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read audit log: %v", err)
+	}
+
+	return entries, nil
+}
+
+// MemoryAuditLog is an AuditLog kept in memory.
+type MemoryAuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (l *MemoryAuditLog) Append(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func (l *MemoryAuditLog) Entries() ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]AuditEntry(nil), l.entries...), nil
+}
+
+// currentUser returns the name of the OS user running the process.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
+
+// currentHost returns the host name of the machine running the process.
+func currentHost() string {
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,279 @@
+package instances_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	t.Parallel()
+	auditLog := instances.FileAuditLog{Path: filepath.Join(t.TempDir(), "audit.jsonl")}
+
+	entries, err := auditLog.Entries()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected entries in new log: %v, %v", entries, err)
+	}
+
+	now := time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)
+	want := []instances.AuditEntry{
+		{Time: now, User: "alice", Host: "laptop", Command: "start", Target: "a", Response: "instance pending"},
+		{Time: now.Add(time.Minute), User: "bob", Host: "ci", Command: "stop", Target: "a", Error: "instance \"a\" not running"},
+	}
+	for _, entry := range want {
+		if err := auditLog.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err = auditLog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i := range want {
+		if !entries[i].Time.Equal(want[i].Time) || entries[i].User != want[i].User || entries[i].Error != want[i].Error {
+			t.Fatalf("entry %d: got %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestCLIAudit(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+
+	cloud := newTestCloud()
+	cloud.AddInstance(existingInstanceIds[0], instances.InstanceStateStopped, instances.InstanceDetails{})
+
+	auditLog := &instances.MemoryAuditLog{}
+	var out bytes.Buffer
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": cloud},
+		instances.WithOutput(&out),
+		instances.WithAuditLog(auditLog),
+		instances.WithUser("alice", "laptop"),
+	)
+
+	commands := [][]string{
+		{"start", existingInstanceName},
+		{"stop", "anInstance"},
+		{"status", existingInstanceName},
+		{"add", "--name", "other", "--cloud", "mock", existingInstanceIds[1]},
+		{"rm", "other"},
+	}
+	for _, args := range commands {
+		_ = cli.Run(args)
+	}
+
+	entries, err := auditLog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		if entry.User != "alice" || entry.Host != "laptop" {
+			t.Fatalf("unexpected user in entry %+v", entry)
+		}
+		got = append(got, entry.Command+" "+entry.Target)
+	}
+	want := []string{"start " + existingInstanceName, "stop anInstance", "add other", "rm other"}
+	if len(got) != len(want) {
+		t.Fatalf("got entries %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got entries %v, want %v", got, want)
+		}
+	}
+	if entries[1].Error == "" {
+		t.Fatalf("failed command recorded without error: %+v", entries[1])
+	}
+	if entries[2].Response != "current state running" {
+		t.Fatalf("unexpected response of add: %+v", entries[2])
+	}
+
+	out.Reset()
+	if err := cli.Run([]string{"history", "--json", existingInstanceName}); err != nil {
+		t.Fatal(err)
+	}
+	var exported instances.AuditEntry
+	if err := json.NewDecoder(&out).Decode(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.Command != "start" || exported.Response != "instance running, was stopped" {
+		t.Fatalf("unexpected exported entry: %+v", exported)
+	}
+}
+
+func TestCLIAuditRedactsSecrets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		args     []string
+		wantArgs []string
+	}{
+		"separate value": {
+			args:     []string{"webhook", "add", "--url", "https://example.com", "--secret", "s3cr3t", "ops"},
+			wantArgs: []string{"add", "--url", "https://example.com", "--secret", "REDACTED", "ops"},
+		},
+		"inline value": {
+			args:     []string{"webhook", "add", "--url", "https://example.com", "--secret=s3cr3t", "ops"},
+			wantArgs: []string{"add", "--url", "https://example.com", "--secret=REDACTED", "ops"},
+		},
+		"single dash": {
+			args:     []string{"webhook", "add", "-secret", "s3cr3t", "--url", "https://example.com", "ops"},
+			wantArgs: []string{"add", "-secret", "REDACTED", "--url", "https://example.com", "ops"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+
+			auditLog := &instances.MemoryAuditLog{}
+			var out bytes.Buffer
+			cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": newTestCloud()},
+				instances.WithOutput(&out),
+				instances.WithAuditLog(auditLog),
+			)
+			if err := cli.Run(test.args); err != nil {
+				t.Fatal(err)
+			}
+			if db.Webhooks["ops"].Secret != "s3cr3t" {
+				t.Fatalf("got webhook %+v, want the secret set", db.Webhooks["ops"])
+			}
+
+			entries, err := auditLog.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || strings.Join(entries[0].Args, " ") != strings.Join(test.wantArgs, " ") {
+				t.Fatalf("got entries %+v, want args %v", entries, test.wantArgs)
+			}
+
+			out.Reset()
+			if err := cli.Run([]string{"history", "--json"}); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(out.String(), "s3cr3t") {
+				t.Errorf("history contains the secret: %s", out.String())
+			}
+		})
+	}
+}
+
+func TestHistoryFollowsRenames(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+
+	cloud := newTestCloud()
+	cloud.AddInstance(existingInstanceIds[1], instances.InstanceStateStopped, instances.InstanceDetails{})
+
+	var out bytes.Buffer
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": cloud},
+		instances.WithOutput(&out),
+		instances.WithAuditLog(&instances.MemoryAuditLog{}),
+	)
+
+	commands := [][]string{
+		{"stop", existingInstanceName},
+		{"rename", existingInstanceName, "renamed"},
+		{"add", "--name", existingInstanceName, "--cloud", "mock", existingInstanceIds[1]},
+		{"start", existingInstanceName},
+		// Renaming a protected instance records the confirmation flag too.
+		{"protect", "renamed"},
+		{"rename", "--yes-i-am-sure", "renamed", "final"},
+		{"start", "--yes-i-am-sure", "final"},
+	}
+	for _, args := range commands {
+		if err := cli.Run(args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+
+	out.Reset()
+	if err := cli.Run([]string{"history", "--json", "final"}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var entry instances.AuditEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry.Command+" "+entry.Target)
+	}
+	want := []string{"stop " + existingInstanceName, "rename renamed", "protect renamed", "rename final", "start final"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got entries %v, want %v", got, want)
+	}
+}
+
+// failingAuditLog is an AuditLog whose entries can't be written.
+type failingAuditLog struct{}
+
+func (failingAuditLog) Append(entry instances.AuditEntry) error {
+	return errors.New("disk full")
+}
+
+func (failingAuditLog) Entries() ([]instances.AuditEntry, error) {
+	return nil, nil
+}
+
+func TestDaemonAuditFailure(t *testing.T) {
+	t.Parallel()
+	support := bytes.NewBufferString("{\"instances\": {}}")
+	db, err := instances.NewDatabase(support)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud := fakecloud.New(fakecloud.WithName("fake"))
+	cloud.AddInstance("i-1234", instances.InstanceStateRunning, instances.InstanceDetails{})
+	if err := db.AddInstance("i-1234", existingInstanceName, cloud); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	expiry := now.Add(-time.Minute)
+	if err := db.SetLease(existingInstanceName, &expiry); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"fake": cloud},
+		instances.WithOutput(io.Discard),
+		instances.WithClock(func() time.Time { return now }),
+		instances.WithAuditLog(failingAuditLog{}),
+		instances.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err := cli.Run([]string{"daemon", "--once"}); err != nil {
+		t.Fatalf("daemon failed: %v", err)
+	}
+
+	// The stop is saved, so that the next run doesn't perform it again.
+	var saved instances.Database
+	if err := json.NewDecoder(support).Decode(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Actions) != 1 || saved.Actions[0].Action != instances.ActionStop {
+		t.Fatalf("got saved actions %+v, want the stop of the lease", saved.Actions)
+	}
+}
@@ -0,0 +1,222 @@
+package instances
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Role is a set of permissions granted to a principal.
+type Role string
+
+const (
+	// RoleViewer can list instances and get their status.
+	RoleViewer Role = "viewer"
+	// RoleOperator can also start and stop instances.
+	RoleOperator Role = "operator"
+	// RoleAdmin can also add and remove instances.
+	RoleAdmin Role = "admin"
+	// RoleSuperuser can also change protected instances.
+	RoleSuperuser Role = "superuser"
+)
+
+// Permission is the right to perform a kind of operation on instances.
+type Permission string
+
+const (
+	PermissionRead    Permission = "read"
+	PermissionOperate Permission = "operate"
+	PermissionManage  Permission = "manage"
+	// PermissionChangeProtected is the right to operate and manage the
+	// protected instances, given the other permissions.
+	PermissionChangeProtected Permission = "change protected"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:    {PermissionRead},
+	RoleOperator:  {PermissionRead, PermissionOperate},
+	RoleAdmin:     {PermissionRead, PermissionOperate, PermissionManage},
+	RoleSuperuser: {PermissionRead, PermissionOperate, PermissionManage, PermissionChangeProtected},
+}
+
+// Grants reports whether the role includes the permission.
+func (r Role) Grants(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Grant gives a role on the instances of some groups or with some tags. A
+// grant without groups nor tags applies to every instance.
+type Grant struct {
+	Role   Role              `json:"role"`
+	Groups []string          `json:"groups,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+// AppliesTo reports whether the grant covers an instance: when it belongs
+// to one of the groups, or has all the tags.
+func (g Grant) AppliesTo(instance Instance) bool {
+	if len(g.Groups) == 0 && len(g.Tags) == 0 {
+		return true
+	}
+	for _, group := range g.Groups {
+		if instance.Group == group {
+			return true
+		}
+	}
+	return len(g.Tags) > 0 && instance.HasTags(g.Tags)
+}
+
+// Principal is an authenticated caller of the API server.
+type Principal struct {
+	Name string `json:"name"`
+	// TokenSHA256 is the hex-encoded SHA-256 hash of the bearer token of the
+	// principal.
+	TokenSHA256 string `json:"token-sha256,omitempty"`
+	// CertificateSubject is the common name of the client certificate of
+	// the principal.
+	CertificateSubject string  `json:"certificate-subject,omitempty"`
+	Grants             []Grant `json:"grants"`
+}
+
+// Can reports whether the principal has the permission on an instance.
+func (p *Principal) Can(permission Permission, instance Instance) bool {
+	for _, grant := range p.Grants {
+		if grant.Role.Grants(permission) && grant.AppliesTo(instance) {
+			return true
+		}
+	}
+	return false
+}
+
+// anonymousAdmin is the principal of the requests to a server without
+// authentication.
+var anonymousAdmin = &Principal{Name: "anonymous", Grants: []Grant{{Role: RoleAdmin}}}
+
+// AuthConfig declares the principals allowed to use the API server.
+type AuthConfig struct {
+	Principals []Principal `json:"principals"`
+}
+
+// LoadAuthConfig reads and validates an AuthConfig serialized in JSON.
+func LoadAuthConfig(r io.Reader) (*AuthConfig, error) {
+	var config AuthConfig
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("load auth config: %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("load auth config: %v", err)
+	}
+
+	return &config, nil
+}
+
+// Validate checks that every principal has a unique name, a way to
+// authenticate and valid grants.
+func (c *AuthConfig) Validate() error {
+	names := map[string]bool{}
+	tokens := map[string]bool{}
+	subjects := map[string]bool{}
+	for i, principal := range c.Principals {
+		if principal.Name == "" {
+			return fmt.Errorf("principal %d has no name", i)
+		}
+		if names[principal.Name] {
+			return fmt.Errorf("principal %q declared twice", principal.Name)
+		}
+		names[principal.Name] = true
+
+		if principal.TokenSHA256 == "" && principal.CertificateSubject == "" {
+			return fmt.Errorf("principal %q has neither a token nor a certificate subject", principal.Name)
+		}
+		if principal.TokenSHA256 != "" {
+			if b, err := hex.DecodeString(principal.TokenSHA256); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("principal %q: token-sha256 must be a hex-encoded SHA-256 hash", principal.Name)
+			}
+			if tokens[strings.ToLower(principal.TokenSHA256)] {
+				return fmt.Errorf("principal %q: token shared with another principal", principal.Name)
+			}
+			tokens[strings.ToLower(principal.TokenSHA256)] = true
+		}
+		if principal.CertificateSubject != "" {
+			if subjects[principal.CertificateSubject] {
+				return fmt.Errorf("principal %q: certificate subject shared with another principal", principal.Name)
+			}
+			subjects[principal.CertificateSubject] = true
+		}
+
+		for _, grant := range principal.Grants {
+			if _, ok := rolePermissions[grant.Role]; !ok {
+				return fmt.Errorf("principal %q: unknown role %q", principal.Name, grant.Role)
+			}
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the principal making a request, identified by its
+// bearer token or by its verified client certificate.
+func (c *AuthConfig) Authenticate(r *http.Request) (*Principal, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found {
+			return nil, Errorf(ErrUnauthenticated, "unsupported authorization scheme")
+		}
+
+		hash := sha256.Sum256([]byte(token))
+		for i := range c.Principals {
+			principal := &c.Principals[i]
+			want, err := hex.DecodeString(principal.TokenSHA256)
+			if err == nil && subtle.ConstantTimeCompare(hash[:], want) == 1 {
+				return principal, nil
+			}
+		}
+		return nil, Errorf(ErrUnauthenticated, "invalid token")
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range c.Principals {
+			principal := &c.Principals[i]
+			if principal.CertificateSubject != "" && principal.CertificateSubject == subject {
+				return principal, nil
+			}
+		}
+		return nil, Errorf(ErrUnauthenticated, "unknown certificate subject %q", subject)
+	}
+
+	return nil, Errorf(ErrUnauthenticated, "missing credentials")
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFrom returns the principal of a request context.
+func principalFrom(ctx context.Context) *Principal {
+	if principal, ok := ctx.Value(principalKey{}).(*Principal); ok {
+		return principal
+	}
+	return nil
+}
+
+// permissionDenied returns the error of a principal lacking a permission on
+// a target.
+func permissionDenied(principal *Principal, permission Permission, target string) error {
+	return Errorf(ErrPermissionDenied, "%s is not allowed to %s %s", principal.Name, permission, target)
+}
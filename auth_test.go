@@ -0,0 +1,345 @@
+package instances_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestLoadAuthConfig(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config  string
+		wantErr string
+	}{
+		"valid config": {
+			config: `{"principals": [
+				{"name": "bot", "token-sha256": "` + tokenHash("t1") + `", "grants": [{"role": "operator", "groups": ["dev"]}]},
+				{"name": "alice", "certificate-subject": "alice", "grants": [{"role": "admin"}]}
+			]}`,
+		},
+		"unknown role": {
+			config:  `{"principals": [{"name": "bot", "token-sha256": "` + tokenHash("t1") + `", "grants": [{"role": "god"}]}]}`,
+			wantErr: "unknown role",
+		},
+		"no credentials": {
+			config:  `{"principals": [{"name": "bot", "grants": [{"role": "viewer"}]}]}`,
+			wantErr: "neither a token nor a certificate subject",
+		},
+		"invalid hash": {
+			config:  `{"principals": [{"name": "bot", "token-sha256": "secret", "grants": []}]}`,
+			wantErr: "hex-encoded SHA-256",
+		},
+		"duplicate name": {
+			config: `{"principals": [
+				{"name": "bot", "certificate-subject": "a", "grants": []},
+				{"name": "bot", "certificate-subject": "b", "grants": []}
+			]}`,
+			wantErr: "declared twice",
+		},
+		"shared token": {
+			config: `{"principals": [
+				{"name": "a", "token-sha256": "` + tokenHash("t1") + `", "grants": []},
+				{"name": "b", "token-sha256": "` + tokenHash("t1") + `", "grants": []}
+			]}`,
+			wantErr: "token shared",
+		},
+		"unknown field": {
+			config:  `{"principals": [{"name": "bot", "token": "t1", "grants": []}]}`,
+			wantErr: "unknown field",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := instances.LoadAuthConfig(strings.NewReader(test.config))
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func newAuthTestHandler(t *testing.T, auditLog instances.AuditLog) http.Handler {
+	t.Helper()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+
+	provider := fakecloud.New(fakecloud.WithName("mock"))
+	provider.AddInstance("id1", instances.InstanceStateStopped, instances.InstanceDetails{})
+	provider.AddInstance("id2", instances.InstanceStateStopped, instances.InstanceDetails{})
+	provider.AddInstance("id3", instances.InstanceStateStopped, instances.InstanceDetails{})
+	// The protected instance is running, for the superuser to stop it.
+	provider.AddInstance("id4", instances.InstanceStateRunning, instances.InstanceDetails{})
+	cloudProviders := map[string]instances.CloudProvider{"mock": provider}
+	manager := instances.NewManager(db, cloudProviders, time.Now)
+	for id, opts := range map[string]instances.InstanceOptions{
+		"id1": {Group: "dev"},
+		"id2": {Group: "prod"},
+		"id4": {Group: "vault", Protected: true},
+	} {
+		if _, err := manager.AddInstance(id, opts.Group+"Box", "mock", opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := instances.LoadAuthConfig(strings.NewReader(`{"principals": [
+		{"name": "viewer", "token-sha256": "` + tokenHash("viewer-token") + `", "grants": [{"role": "viewer"}]},
+		{"name": "dev-operator", "token-sha256": "` + tokenHash("operator-token") + `", "grants": [
+			{"role": "viewer", "groups": ["dev"]},
+			{"role": "operator", "tags": {"team": "web"}, "groups": ["dev"]}
+		]},
+		{"name": "admin", "token-sha256": "` + tokenHash("admin-token") + `", "certificate-subject": "alice", "grants": [{"role": "admin"}]},
+		{"name": "root", "token-sha256": "` + tokenHash("superuser-token") + `", "grants": [{"role": "superuser"}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return instances.NewServer(manager, instances.WithAuthConfig(config), instances.WithServerAuditLog(auditLog))
+}
+
+func TestServerAuthorization(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		token      string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		"no token": {
+			method:     http.MethodGet,
+			path:       "/v1/instances",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"invalid token": {
+			token:      "guess",
+			method:     http.MethodGet,
+			path:       "/v1/instances",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"public API description": {
+			method:     http.MethodGet,
+			path:       "/v1/openapi.json",
+			wantStatus: http.StatusOK,
+		},
+		"viewer lists every instance": {
+			token:      "viewer-token",
+			method:     http.MethodGet,
+			path:       "/v1/instances",
+			wantStatus: http.StatusOK,
+			wantBody:   "prodBox",
+		},
+		"viewer cannot stop": {
+			token:      "viewer-token",
+			method:     http.MethodPost,
+			path:       "/v1/instances/devBox/stop",
+			wantStatus: http.StatusForbidden,
+		},
+		"scoped operator only lists its group": {
+			token:      "operator-token",
+			method:     http.MethodGet,
+			path:       "/v1/instances",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"name":"devBox"`,
+		},
+		"scoped operator starts in its group": {
+			token:      "operator-token",
+			method:     http.MethodPost,
+			path:       "/v1/instances/devBox/start",
+			wantStatus: http.StatusAccepted,
+		},
+		"scoped operator cannot start outside its group": {
+			token:      "operator-token",
+			method:     http.MethodPost,
+			path:       "/v1/instances/prodBox/start",
+			wantStatus: http.StatusForbidden,
+		},
+		"scoped operator cannot read outside its group": {
+			token:      "operator-token",
+			method:     http.MethodGet,
+			path:       "/v1/instances/prodBox/status",
+			wantStatus: http.StatusForbidden,
+		},
+		"operator cannot add": {
+			token:      "operator-token",
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"id": "id3", "name": "new", "cloud": "mock", "group": "dev"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		"admin adds": {
+			token:      "admin-token",
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"id": "id3", "name": "new", "cloud": "mock", "group": "dev"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `"owner":"admin"`,
+		},
+		"admin removes": {
+			token:      "admin-token",
+			method:     http.MethodDelete,
+			path:       "/v1/instances/prodBox",
+			wantStatus: http.StatusNoContent,
+		},
+		"admin reads protected": {
+			token:      "admin-token",
+			method:     http.MethodGet,
+			path:       "/v1/instances/vaultBox/status",
+			wantStatus: http.StatusOK,
+		},
+		"admin cannot stop protected": {
+			token:      "admin-token",
+			method:     http.MethodPost,
+			path:       "/v1/instances/vaultBox/stop",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "not allowed to change protected vaultBox",
+		},
+		"admin cannot remove protected": {
+			token:      "admin-token",
+			method:     http.MethodDelete,
+			path:       "/v1/instances/vaultBox",
+			wantStatus: http.StatusForbidden,
+		},
+		"superuser stops protected": {
+			token:      "superuser-token",
+			method:     http.MethodPost,
+			path:       "/v1/instances/vaultBox/stop",
+			wantStatus: http.StatusAccepted,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			handler := newAuthTestHandler(t, &instances.MemoryAuditLog{})
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != test.wantStatus {
+				t.Fatalf("unexpected status %d, want %d: %s", rec.Code, test.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), test.wantBody) {
+				t.Fatalf("unexpected body %s, want it to contain %s", rec.Body, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestServerAuthorizationAudit(t *testing.T) {
+	t.Parallel()
+	auditLog := &instances.MemoryAuditLog{}
+	handler := newAuthTestHandler(t, auditLog)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/instances/prodBox/stop", nil)
+	req.Header.Set("Authorization", "Bearer operator-token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries, err := auditLog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].User != "dev-operator" || !strings.Contains(entries[0].Error, "not allowed") {
+		t.Fatalf("denied request not audited: %+v", entries)
+	}
+}
+
+func TestServerClientCertificate(t *testing.T) {
+	t.Parallel()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auditLog := &instances.MemoryAuditLog{}
+	server := httptest.NewUnstartedServer(newAuthTestHandler(t, auditLog))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	server.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{clientDER},
+		PrivateKey:  clientKey,
+	}}
+
+	resp, err := client.Post(server.URL+"/v1/instances/prodBox/start", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	entries, err := auditLog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].User != "admin" {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+}
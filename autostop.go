@@ -0,0 +1,193 @@
+package instances
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AutoStopPolicy stops a running instance whose CPU utilization stayed below
+// a threshold for a given duration, after warning about it for a grace
+// period.
+type AutoStopPolicy struct {
+	CPUThreshold float64  `json:"cpu-threshold"`
+	After        Duration `json:"after"`
+	Grace        Duration `json:"grace"`
+	// AllowProtected makes the policy stop the instance even if it is
+	// protected.
+	AllowProtected bool `json:"allow-protected,omitempty"`
+}
+
+// Validate checks that the policy thresholds make sense.
+func (p AutoStopPolicy) Validate() error {
+	if p.CPUThreshold <= 0 || p.CPUThreshold > 100 {
+		return fmt.Errorf("CPU threshold must be between 0 and 100%%, got %g", p.CPUThreshold)
+	}
+	if p.After <= 0 {
+		return errors.New("idle duration must be positive")
+	}
+	if p.Grace < 0 {
+		return errors.New("grace period cannot be negative")
+	}
+	return nil
+}
+
+func (p AutoStopPolicy) String() string {
+	s := fmt.Sprintf("stop after %s with CPU < %g%% (grace period %s)", p.After, p.CPUThreshold, p.Grace)
+	if p.AllowProtected {
+		s += ", even if protected"
+	}
+	return s
+}
+
+// metricsCoverageSlack is how far after the start of the idle window the
+// first metric sample may be, so that instances started recently are not
+// considered idle before they ran for the whole window.
+const metricsCoverageSlack = 10 * time.Minute
+
+// idle reports whether the samples show an instance idle over the window
+// (start, end] according to the policy.
+func (p AutoStopPolicy) idle(samples []MetricSample, start time.Time) bool {
+	if len(samples) == 0 {
+		return false
+	}
+
+	earliest := samples[0].Time
+	for _, sample := range samples {
+		if sample.Value >= p.CPUThreshold {
+			return false
+		}
+		if sample.Time.Before(earliest) {
+			earliest = sample.Time
+		}
+	}
+
+	return !earliest.After(start.Add(metricsCoverageSlack))
+}
+
+// IdleMonitor stops running instances that have been idle according to their
+// auto-stop policy, or the database default one.
+type IdleMonitor struct {
+	db             *Database
+	cloudProviders map[string]CloudProvider
+	// warnings holds when each instance was first found idle.
+	warnings map[string]time.Time
+	// failures holds the last error checking each instance, recorded once
+	// rather than on every run.
+	failures map[string]string
+}
+
+func NewIdleMonitor(db *Database, cloudProviders map[string]CloudProvider) *IdleMonitor {
+	return &IdleMonitor{db: db, cloudProviders: cloudProviders, warnings: map[string]time.Time{}, failures: map[string]string{}}
+}
+
+// Run checks every instance with an auto-stop policy, warns about the ones
+// found idle and stops the ones still idle at the end of their grace period.
+// Actions are recorded in the database and returned.
+func (m *IdleMonitor) Run(now time.Time) []Action {
+	var actions []Action
+	for _, name := range sortedKeys(m.db.Instances) {
+		action, ok := m.check(name, now)
+		if !ok {
+			continue
+		}
+		m.db.RecordAction(action)
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+func (m *IdleMonitor) check(name string, now time.Time) (Action, bool) {
+	instance := m.db.Instances[name]
+	policy := m.db.AutoStopPolicy(name)
+	if policy == nil || instance.Override.Active(now) {
+		delete(m.warnings, name)
+		delete(m.failures, name)
+		return Action{}, false
+	}
+
+	record := Action{Time: now, Instance: name, Source: "auto-stop"}
+
+	cloudProvider, err := instance.GetCloudProvider(m.cloudProviders)
+	if err != nil {
+		return m.failure(record, err)
+	}
+
+	metricsProvider, ok := capability[MetricsProvider](cloudProvider)
+	if !ok {
+		return Action{}, false
+	}
+
+	state, err := cloudProvider.GetInstanceStatus(instance.Id)
+	if err != nil {
+		delete(m.warnings, name)
+		return m.failure(record, err)
+	}
+	if state != InstanceStateRunning {
+		delete(m.warnings, name)
+		delete(m.failures, name)
+		return Action{}, false
+	}
+
+	start := now.Add(-time.Duration(policy.After))
+	samples, err := metricsProvider.GetCPUUtilization(instance.Id, start, now)
+	if err != nil {
+		delete(m.warnings, name)
+		return m.failure(record, fmt.Errorf("get CPU utilization: %v", err))
+	}
+	delete(m.failures, name)
+	if !policy.idle(samples, start) {
+		delete(m.warnings, name)
+		return Action{}, false
+	}
+
+	warnedAt, warned := m.warnings[name]
+	if !policy.AllowProtected && m.db.IsProtected(name) {
+		// The skipped stop is recorded once while the instance stays idle.
+		if warned {
+			return Action{}, false
+		}
+		m.warnings[name] = now
+		record.Action = ActionStop
+		record.Message = fmt.Sprintf("idle for %s", policy.After)
+		record.Skipped = "instance protected"
+		return record, true
+	}
+	if !warned {
+		m.warnings[name] = now
+		record.Action = ActionWarn
+		record.Message = fmt.Sprintf("idle for %s, stopping in %s", policy.After, policy.Grace)
+		if policy.Grace > 0 {
+			return record, true
+		}
+		// Without a grace period, the instance is stopped right away.
+		warnedAt = now
+	}
+
+	if now.Sub(warnedAt) < time.Duration(policy.Grace) {
+		return Action{}, false
+	}
+
+	delete(m.warnings, name)
+	record.Action = ActionStop
+	record.Message = fmt.Sprintf("idle for %s", policy.After)
+	if err := cloudProvider.StopInstance(instance.Id); err != nil {
+		record.Error = err.Error()
+	}
+	return record, true
+}
+
+// failure returns the action of a failed check of an instance, unless the
+// same error was recorded by the previous run, so that a lasting problem,
+// like a missing permission, is reported without flooding the history.
+func (m *IdleMonitor) failure(record Action, err error) (Action, bool) {
+	if m.failures[record.Instance] == err.Error() {
+		return Action{}, false
+	}
+	m.failures[record.Instance] = err.Error()
+
+	record.Action = ActionCheck
+	record.Message = "idle check failed"
+	record.Error = err.Error()
+	return record, true
+}
@@ -0,0 +1,201 @@
+package instances_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func TestIdleMonitor(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)
+	policy := &instances.AutoStopPolicy{
+		CPUThreshold: 5,
+		After:        instances.Duration(time.Hour),
+		Grace:        instances.Duration(10 * time.Minute),
+	}
+
+	tests := map[string]struct {
+		cpu       float64
+		startedAt time.Time
+		err       error
+		optOut    bool
+		override  *instances.Override
+		// protected protects the instance, which the policy stops if
+		// allowProtected is set.
+		protected      bool
+		allowProtected bool
+		// wantActions are the actions expected at now, then after the
+		// grace period.
+		wantActions [2]string
+		wantCalls   []string
+	}{
+		"idle instance": {
+			cpu:         1,
+			startedAt:   now.Add(-3 * time.Hour),
+			wantActions: [2]string{"warn", "stop"},
+			wantCalls:   []string{"stop id1"},
+		},
+		"metrics unavailable": {
+			err: errors.New("AccessDenied"),
+			// The error is only recorded once.
+			wantActions: [2]string{"check: idle check failed: get CPU utilization: AccessDenied", ""},
+		},
+		"busy instance": {
+			cpu:       50,
+			startedAt: now.Add(-3 * time.Hour),
+		},
+		"recently started instance": {
+			cpu:       1,
+			startedAt: now.Add(-20 * time.Minute),
+		},
+		"opted out instance": {
+			cpu:       1,
+			startedAt: now.Add(-3 * time.Hour),
+			optOut:    true,
+		},
+		"manual override": {
+			cpu:       1,
+			startedAt: now.Add(-3 * time.Hour),
+			override:  &instances.Override{},
+		},
+		"protected instance": {
+			cpu:       1,
+			startedAt: now.Add(-3 * time.Hour),
+			protected: true,
+			// The skipped stop is only recorded once.
+			wantActions: [2]string{"stop skipped: instance protected", ""},
+		},
+		"protected instance allowed": {
+			cpu:            1,
+			startedAt:      now.Add(-3 * time.Hour),
+			protected:      true,
+			allowProtected: true,
+			wantActions:    [2]string{"warn", "stop"},
+			wantCalls:      []string{"stop id1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+
+			// The instance reports a constant CPU utilization since it
+			// started.
+			provider := fakecloud.New(fakecloud.WithName("mock"))
+			provider.AddInstance("id1", instances.InstanceStateRunning, instances.InstanceDetails{})
+			var samples []instances.MetricSample
+			if !test.startedAt.IsZero() {
+				for at := test.startedAt; !at.After(now.Add(10 * time.Minute)); at = at.Add(5 * time.Minute) {
+					samples = append(samples, instances.MetricSample{Time: at, Value: test.cpu})
+				}
+			}
+			if err := provider.SetCPUUtilization("id1", samples); err != nil {
+				t.Fatal(err)
+			}
+			if test.err != nil {
+				provider.InjectFailure(fakecloud.Failure{Method: "GetCPUUtilization", Err: test.err})
+			}
+			if err := db.AddInstance("id1", "a", provider); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetAutoStopPolicy("", policy); err != nil {
+				t.Fatal(err)
+			}
+			if test.allowProtected {
+				allowed := *policy
+				allowed.AllowProtected = true
+				if err := db.SetAutoStopPolicy("a", &allowed); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SetProtected("a", test.protected); err != nil {
+				t.Fatal(err)
+			}
+			err = db.UpdateInstance("a", func(i *instances.Instance) {
+				i.AutoStopOptOut = test.optOut
+				i.Override = test.override
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			monitor := instances.NewIdleMonitor(db, map[string]instances.CloudProvider{"mock": provider})
+			for i, at := range []time.Time{now, now.Add(10 * time.Minute)} {
+				actions := monitor.Run(at)
+				var got string
+				for _, action := range actions {
+					if action.Instance == "a" {
+						got = string(action.Action)
+						if action.Error != "" {
+							got += ": " + action.Message + ": " + action.Error
+						}
+						if action.Skipped != "" {
+							got += " skipped: " + action.Skipped
+						}
+					}
+				}
+				if got != test.wantActions[i] {
+					t.Fatalf("unexpected actions at run %d: %v", i, actions)
+				}
+			}
+
+			if calls := stateCalls(provider); fmt.Sprint(calls) != fmt.Sprint(test.wantCalls) {
+				t.Fatalf("unexpected calls: got %v, want %v", calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSetAutoStopPolicy(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		instanceName string
+		policy       instances.AutoStopPolicy
+		wantErr      string
+	}{
+		"valid instance policy": {
+			instanceName: existingInstanceName,
+			policy:       instances.AutoStopPolicy{CPUThreshold: 5, After: instances.Duration(time.Hour)},
+		},
+		"valid default policy": {
+			policy: instances.AutoStopPolicy{CPUThreshold: 5, After: instances.Duration(time.Hour)},
+		},
+		"invalid threshold": {
+			instanceName: existingInstanceName,
+			policy:       instances.AutoStopPolicy{CPUThreshold: 120, After: instances.Duration(time.Hour)},
+			wantErr:      "CPU threshold",
+		},
+		"invalid duration": {
+			instanceName: existingInstanceName,
+			policy:       instances.AutoStopPolicy{CPUThreshold: 5},
+			wantErr:      "idle duration",
+		},
+		"nonexisting instance": {
+			instanceName: "iDontExist",
+			policy:       instances.AutoStopPolicy{CPUThreshold: 5, After: instances.Duration(time.Hour)},
+			wantErr:      "no instance named",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+
+			err = db.SetAutoStopPolicy(test.instanceName, &test.policy)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CachedStatus is the state of an instance at some time.
+type CachedStatus struct {
+	State InstanceState `json:"state"`
+	Time  time.Time     `json:"time"`
+}
+
+// StatusCache stores the last known states of instances, by key.
+type StatusCache interface {
+	Get(key string) (CachedStatus, bool, error)
+	Set(key string, status CachedStatus) error
+	Delete(key string) error
+}
+
+// MemoryStatusCache is a StatusCache kept in memory, for the long-running
+// commands.
+type MemoryStatusCache struct {
+	mu       sync.Mutex
+	statuses map[string]CachedStatus
+}
+
+func NewMemoryStatusCache() *MemoryStatusCache {
+	return &MemoryStatusCache{statuses: map[string]CachedStatus{}}
+}
+
+func (c *MemoryStatusCache) Get(key string) (CachedStatus, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, ok := c.statuses[key]
+	return status, ok, nil
+}
+
+func (c *MemoryStatusCache) Set(key string, status CachedStatus) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statuses[key] = status
+	return nil
+}
+
+func (c *MemoryStatusCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.statuses, key)
+	return nil
+}
+
+// maxFileStatusAge is the age past which the statuses are dropped from a
+// FileStatusCache, whatever the TTL they are read with.
+const maxFileStatusAge = 24 * time.Hour
+
+// FileStatusCache is a StatusCache stored in a JSON file, to be shared by
+// successive commands.
+type FileStatusCache struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (c *FileStatusCache) Get(key string) (CachedStatus, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses, err := c.read()
+	if err != nil {
+		return CachedStatus{}, false, err
+	}
+	status, ok := statuses[key]
+	return status, ok, nil
+}
+
+func (c *FileStatusCache) Set(key string, status CachedStatus) error {
+	return c.update(func(statuses map[string]CachedStatus) {
+		// Drop the statuses of the instances not seen in a while, like
+		// removed ones.
+		for other, cached := range statuses {
+			if status.Time.Sub(cached.Time) > maxFileStatusAge {
+				delete(statuses, other)
+			}
+		}
+		statuses[key] = status
+	})
+}
+
+func (c *FileStatusCache) Delete(key string) error {
+	return c.update(func(statuses map[string]CachedStatus) {
+		delete(statuses, key)
+	})
+}
+
+func (c *FileStatusCache) read() (map[string]CachedStatus, error) {
+	statuses := map[string]CachedStatus{}
+	b, err := os.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return statuses, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read status cache: %v", err)
+	}
+	if err := json.Unmarshal(b, &statuses); err != nil {
+		// A corrupted cache is as good as an empty one.
+		return map[string]CachedStatus{}, nil
+	}
+	return statuses, nil
+}
+
+// update applies f to the cached statuses and saves them, replacing the file
+// at once so that concurrent commands never read it half-written.
+func (c *FileStatusCache) update(f func(map[string]CachedStatus)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses, err := c.read()
+	if err != nil {
+		return err
+	}
+	f(statuses)
+
+	b, err := json.Marshal(statuses)
+	if err != nil {
+		return fmt.Errorf("serialize status cache: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return fmt.Errorf("write status cache: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.Path), filepath.Base(c.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("write status cache: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write status cache: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write status cache: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), c.Path); err != nil {
+		return fmt.Errorf("write status cache: %v", err)
+	}
+	return nil
+}
+
+// StatusRefresher is implemented by cloud providers caching the states of
+// the instances, to get them afresh.
+type StatusRefresher interface {
+	RefreshInstanceStatus(id string) (InstanceState, error)
+}
+
+// freshInstanceStatus returns the current state of an instance, bypassing
+// the cache of the cloud provider if it has one.
+func freshInstanceStatus(cloudProvider CloudProvider, id string) (InstanceState, error) {
+	if refresher, ok := cloudProvider.(StatusRefresher); ok {
+		return refresher.RefreshInstanceStatus(id)
+	}
+	return cloudProvider.GetInstanceStatus(id)
+}
+
+// CachingCloudProvider is a cloud provider caching the states of the
+// instances of another one for some time, until they are changed through it.
+// The cache is best-effort: failing to use it only makes the calls go to the
+// cloud provider.
+type CachingCloudProvider struct {
+	provider CloudProvider
+	cache    StatusCache
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+// NewCachingCloudProvider returns provider with the states it returns cached
+// in cache for ttl.
+func NewCachingCloudProvider(provider CloudProvider, cache StatusCache, ttl time.Duration, now func() time.Time) *CachingCloudProvider {
+	return &CachingCloudProvider{provider: provider, cache: cache, ttl: ttl, now: now}
+}
+
+// cacheStatuses returns the given cloud providers with the states they
+// return cached in cache for ttl.
+func cacheStatuses(cloudProviders map[string]CloudProvider, cache StatusCache, ttl time.Duration, now func() time.Time) map[string]CloudProvider {
+	cached := make(map[string]CloudProvider, len(cloudProviders))
+	for name, cloudProvider := range cloudProviders {
+		cached[name] = NewCachingCloudProvider(cloudProvider, cache, ttl, now)
+	}
+	return cached
+}
+
+// Unwrap returns the cloud provider whose states are cached.
+func (c *CachingCloudProvider) Unwrap() CloudProvider {
+	return c.provider
+}
+
+func (c *CachingCloudProvider) key(id string) string {
+	return c.provider.GetName() + "/" + id
+}
+
+func (c *CachingCloudProvider) GetInstanceStatus(id string) (InstanceState, error) {
+	status, ok, err := c.cache.Get(c.key(id))
+	if err == nil && ok && c.now().Sub(status.Time) < c.ttl {
+		return status.State, nil
+	}
+	return c.RefreshInstanceStatus(id)
+}
+
+// RefreshInstanceStatus returns the state of an instance from the cloud
+// provider, and caches it.
+func (c *CachingCloudProvider) RefreshInstanceStatus(id string) (InstanceState, error) {
+	state, err := c.provider.GetInstanceStatus(id)
+	if err != nil {
+		return "", err
+	}
+	_ = c.cache.Set(c.key(id), CachedStatus{State: state, Time: c.now()})
+	return state, nil
+}
+
+// invalidate drops the cached state of an instance, after a call which may
+// have changed it, whether it failed or not.
+func (c *CachingCloudProvider) invalidate(id string, err error) error {
+	_ = c.cache.Delete(c.key(id))
+	return err
+}
+
+func (c *CachingCloudProvider) StartInstance(id string) error {
+	return c.invalidate(id, c.provider.StartInstance(id))
+}
+
+func (c *CachingCloudProvider) StopInstance(id string) error {
+	return c.invalidate(id, c.provider.StopInstance(id))
+}
+
+func (c *CachingCloudProvider) StartInstanceChange(id string) (StateChange, error) {
+	changer, ok := c.provider.(StateChanger)
+	if !ok {
+		return StateChange{}, Errorf(ErrUnsupported, "cloud provider %q doesn't return state changes", c.provider.GetName())
+	}
+	change, err := changer.StartInstanceChange(id)
+	return change, c.invalidate(id, err)
+}
+
+func (c *CachingCloudProvider) StopInstanceChange(id string) (StateChange, error) {
+	changer, ok := c.provider.(StateChanger)
+	if !ok {
+		return StateChange{}, Errorf(ErrUnsupported, "cloud provider %q doesn't return state changes", c.provider.GetName())
+	}
+	change, err := changer.StopInstanceChange(id)
+	return change, c.invalidate(id, err)
+}
+
+func (c *CachingCloudProvider) GetName() string {
+	return c.provider.GetName()
+}
+
+func (c *CachingCloudProvider) RebootInstance(id string) error {
+	rebooter, ok := c.provider.(Rebooter)
+	if !ok {
+		return Errorf(ErrUnsupported, "cloud provider %q can't reboot instances", c.provider.GetName())
+	}
+	return c.invalidate(id, rebooter.RebootInstance(id))
+}
+
+func (c *CachingCloudProvider) GetCPUUtilization(id string, start, end time.Time) ([]MetricSample, error) {
+	metricsProvider, ok := c.provider.(MetricsProvider)
+	if !ok {
+		return nil, Errorf(ErrUnsupported, "cloud provider %q doesn't report utilization", c.provider.GetName())
+	}
+	return metricsProvider.GetCPUUtilization(id, start, end)
+}
+
+func (c *CachingCloudProvider) DescribeInstance(id string) (InstanceDetails, error) {
+	describer, ok := c.provider.(InstanceDescriber)
+	if !ok {
+		return InstanceDetails{}, Errorf(ErrUnsupported, "cloud provider %q can't describe instances", c.provider.GetName())
+	}
+	return describer.DescribeInstance(id)
+}
+
+// WithContext returns a copy of the provider making its calls in ctx.
+func (c *CachingCloudProvider) WithContext(ctx context.Context) CloudProvider {
+	bound := *c
+	if binder, ok := c.provider.(ContextBinder); ok {
+		bound.provider = binder.WithContext(ctx)
+	}
+	return &bound
+}
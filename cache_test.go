@@ -0,0 +1,187 @@
+package instances_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func TestCachingCloudProvider(t *testing.T) {
+	caches := map[string]func(t *testing.T) instances.StatusCache{
+		"memory": func(t *testing.T) instances.StatusCache {
+			return instances.NewMemoryStatusCache()
+		},
+		"file": func(t *testing.T) instances.StatusCache {
+			return &instances.FileStatusCache{Path: filepath.Join(t.TempDir(), "cache", "status.json")}
+		},
+	}
+
+	tests := map[string]struct {
+		// do is run after the state of the instance is got once.
+		do        func(cloud *instances.CachingCloudProvider, now *time.Time) error
+		err       error
+		wantCalls int
+	}{
+		"cached": {
+			do: func(cloud *instances.CachingCloudProvider, now *time.Time) error {
+				*now = now.Add(59 * time.Second)
+				_, err := cloud.GetInstanceStatus("i-1234")
+				return err
+			},
+			wantCalls: 1,
+		},
+		"expired": {
+			do: func(cloud *instances.CachingCloudProvider, now *time.Time) error {
+				*now = now.Add(time.Minute)
+				_, err := cloud.GetInstanceStatus("i-1234")
+				return err
+			},
+			wantCalls: 2,
+		},
+		"other instance": {
+			do: func(cloud *instances.CachingCloudProvider, now *time.Time) error {
+				_, err := cloud.GetInstanceStatus("i-5678")
+				return err
+			},
+			wantCalls: 2,
+		},
+		"invalidated by start": {
+			do: func(cloud *instances.CachingCloudProvider, now *time.Time) error {
+				if err := cloud.StopInstance("i-1234"); err != nil {
+					return err
+				}
+				if _, err := cloud.GetInstanceStatus("i-1234"); err != nil {
+					return err
+				}
+				if err := cloud.StartInstance("i-1234"); err != nil {
+					return err
+				}
+				_, err := cloud.GetInstanceStatus("i-1234")
+				return err
+			},
+			wantCalls: 3,
+		},
+		"invalidated by stop": {
+			do: func(cloud *instances.CachingCloudProvider, now *time.Time) error {
+				if err := cloud.StopInstance("i-1234"); err != nil {
+					return err
+				}
+				_, err := cloud.GetInstanceStatus("i-1234")
+				return err
+			},
+			wantCalls: 2,
+		},
+		"refreshed": {
+			do: func(cloud *instances.CachingCloudProvider, now *time.Time) error {
+				if _, err := cloud.RefreshInstanceStatus("i-1234"); err != nil {
+					return err
+				}
+				_, err := cloud.GetInstanceStatus("i-1234")
+				return err
+			},
+			wantCalls: 2,
+		},
+		"error not cached": {
+			err: errors.New("throttled"),
+			do: func(cloud *instances.CachingCloudProvider, now *time.Time) error {
+				_, err := cloud.GetInstanceStatus("i-1234")
+				return err
+			},
+			wantCalls: 2,
+		},
+	}
+
+	for cacheName, newCache := range caches {
+		for name, tc := range tests {
+			t.Run(cacheName+"/"+name, func(t *testing.T) {
+				t.Parallel()
+
+				now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+				provider := fakecloud.New()
+				provider.AddInstance("i-1234", instances.InstanceStateRunning, instances.InstanceDetails{})
+				provider.AddInstance("i-5678", instances.InstanceStateRunning, instances.InstanceDetails{})
+				if tc.err != nil {
+					provider.InjectFailure(fakecloud.Failure{Method: "GetInstanceStatus", Err: tc.err})
+				}
+				cloud := instances.NewCachingCloudProvider(provider, newCache(t), time.Minute, func() time.Time { return now })
+
+				state, err := cloud.GetInstanceStatus("i-1234")
+				if err == nil && state != instances.InstanceStateRunning {
+					t.Fatalf("got state %q, want %q", state, instances.InstanceStateRunning)
+				}
+				if err := tc.do(cloud, &now); !errors.Is(err, tc.err) {
+					t.Fatalf("got error %v, want %v", err, tc.err)
+				}
+				if calls := provider.CallCount("GetInstanceStatus"); calls != tc.wantCalls {
+					t.Errorf("got %d calls to the provider, want %d", calls, tc.wantCalls)
+				}
+			})
+		}
+	}
+}
+
+func TestFileStatusCacheShared(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "status.json")
+	status := instances.CachedStatus{State: instances.InstanceStateStopped, Time: time.Now().UTC().Truncate(time.Second)}
+	if err := (&instances.FileStatusCache{Path: path}).Set("aws/i-1234", status); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := (&instances.FileStatusCache{Path: path}).Get("aws/i-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || got != status {
+		t.Errorf("got %+v (found: %v), want %+v", got, ok, status)
+	}
+}
+
+func TestCLIStatusCache(t *testing.T) {
+	t.Parallel()
+
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	provider := newTestCloud()
+	var out bytes.Buffer
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": provider},
+		instances.WithOutput(&out),
+		instances.WithStatusCache(instances.NewMemoryStatusCache(), time.Minute),
+	)
+
+	for _, args := range [][]string{
+		{"status", existingInstanceName},
+		{"status", existingInstanceName},
+		{"list", "--status"},
+	} {
+		if err := cli.Run(args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	if calls := provider.CallCount("GetInstanceStatus"); calls != 1 {
+		t.Errorf("got %d calls to the provider, want 1", calls)
+	}
+	if want := "state: running"; !strings.Contains(out.String(), want) {
+		t.Errorf("got output %q, want it to contain %q", out.String(), want)
+	}
+
+	if err := cli.Run([]string{"stop", existingInstanceName}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Run([]string{"status", existingInstanceName}); err != nil {
+		t.Fatal(err)
+	}
+	// The state is got again after the stop, which invalidates it.
+	if calls := provider.CallCount("GetInstanceStatus"); calls != 2 {
+		t.Errorf("got %d calls to the provider after stopping the instance, want 2", calls)
+	}
+}
@@ -1,47 +1,346 @@
 package instances
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type CLI struct {
 	db             *Database
 	cloudProviders map[string]CloudProvider
+	manager        *Manager
+	out            io.Writer
+	now            func() time.Time
+	prices         PriceTable
+	auditLog       AuditLog
+	metrics        *Metrics
+	notifier       *Notifier
+	logger         *slog.Logger
+	statusCache    StatusCache
+	statusTTL      time.Duration
+	outputFormat   string
+	defaultCloud   string
+	user           string
+	host           string
+	// confirmations reads the confirmations of the changes to protected
+	// instances, prompted on prompt, when the CLI is interactive.
+	confirmations *bufio.Reader
+	prompt        io.Writer
+	// invocation holds the arguments of the command being run.
+	invocation []string
+}
+
+// CLIOption configures optional behavior of a CLI.
+type CLIOption func(*CLI)
+
+// WithOutput sets the writer command results are printed to (os.Stdout by
+// default).
+func WithOutput(w io.Writer) CLIOption {
+	return func(c *CLI) {
+		c.out = w
+	}
+}
+
+// WithClock sets the function used to get the current time (time.Now by
+// default).
+func WithClock(now func() time.Time) CLIOption {
+	return func(c *CLI) {
+		c.now = now
+	}
+}
+
+// WithAuditLog sets the log in which mutating commands are recorded. By
+// default, they aren't recorded.
+func WithAuditLog(auditLog AuditLog) CLIOption {
+	return func(c *CLI) {
+		c.auditLog = auditLog
+	}
+}
+
+// WithUser sets the user and host recorded in the audit log (by default,
+// the OS user and host running the process).
+func WithUser(user, host string) CLIOption {
+	return func(c *CLI) {
+		c.user = user
+		c.host = host
+	}
+}
+
+// WithMetrics sets the metrics exported by the daemon and the server, which
+// the cloud providers may also record their API calls in. By default, the
+// CLI uses its own.
+func WithMetrics(metrics *Metrics) CLIOption {
+	return func(c *CLI) {
+		c.metrics = metrics
+	}
+}
+
+// WithLogger sets the logger of the CLI (by default, one logging warnings
+// and errors to the standard error).
+func WithLogger(logger *slog.Logger) CLIOption {
+	return func(c *CLI) {
+		c.logger = logger
+	}
+}
+
+// WithStatusCache sets the cache in which the states of the instances are
+// kept for ttl by the commands, to save calls to the cloud providers. The
+// long-running commands cache them in memory instead. By default, they
+// aren't cached.
+func WithStatusCache(cache StatusCache, ttl time.Duration) CLIOption {
+	return func(c *CLI) {
+		c.statusCache = cache
+		c.statusTTL = ttl
+	}
 }
 
-func NewCLI(db *Database, cloudProviders map[string]CloudProvider) *CLI {
-	return &CLI{db, cloudProviders}
+// WithNotifier sets the notifier delivering events to the webhooks. By
+// default, the CLI uses one logging delivery errors as warnings.
+func WithNotifier(notifier *Notifier) CLIOption {
+	return func(c *CLI) {
+		c.notifier = notifier
+	}
 }
 
+// WithOutputFormat sets the default output format of the commands printing
+// JSON lines on request, "text" or "json" (by default, "text").
+func WithOutputFormat(format string) CLIOption {
+	return func(c *CLI) {
+		c.outputFormat = format
+	}
+}
+
+// WithDefaultCloud sets the cloud provider of the instances added without
+// --cloud (by default, --cloud is required).
+func WithDefaultCloud(name string) CLIOption {
+	return func(c *CLI) {
+		c.defaultCloud = name
+	}
+}
+
+// WithConfirmations makes the CLI interactive: the commands changing a
+// protected instance without --yes-i-am-sure prompt on prompt for its name,
+// read from in. By default, they are refused.
+func WithConfirmations(in io.Reader, prompt io.Writer) CLIOption {
+	return func(c *CLI) {
+		c.confirmations = bufio.NewReader(in)
+		c.prompt = prompt
+	}
+}
+
+func NewCLI(db *Database, cloudProviders map[string]CloudProvider, opts ...CLIOption) *CLI {
+	c := &CLI{
+		db:             db,
+		cloudProviders: cloudProviders,
+		out:            os.Stdout,
+		now:            time.Now,
+		logger:         slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+		user:           currentUser(),
+		host:           currentHost(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.metrics == nil {
+		c.metrics = NewMetrics(c.now)
+	}
+	if c.notifier == nil {
+		c.notifier = NewNotifier(WithDeliveryErrorHandler(func(name string, event Event, err error) {
+			c.logger.Warn("webhook delivery failed", "webhook", name, "event", event.Type, "instance", event.Instance, "error", err)
+		}))
+	}
+	c.manager = NewManager(db, cloudProviders, c.now, WithManagerNotifier(c.notifier))
+	return c
+}
+
+// GlobalOptions are the options given before the command.
+type GlobalOptions struct {
+	// Logger logs to the writer given to ParseGlobalFlags.
+	Logger *slog.Logger
+	// Trace is where to export traces to (see NewTracerProvider), if
+	// anywhere.
+	Trace string
+	// NoCache disables the cache of the states of the instances.
+	NoCache bool
+	// Config is the path of the configuration file, if set.
+	Config string
+	// Context is the context of the configuration to use instead of the
+	// current one, if set.
+	Context string
+}
+
+// ParseGlobalFlags parses the global flags at the start of args, and returns
+// the options they set, with a logger writing to w, and the remaining
+// arguments. By default, only warnings and errors are logged.
+func ParseGlobalFlags(args []string, w io.Writer) (GlobalOptions, []string, error) {
+	var verbose, quiet bool
+	var format string
+	var options GlobalOptions
+	globalCmd := flag.NewFlagSet("instances", flag.ContinueOnError)
+	globalCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances [OPTIONS] COMMAND [ARGS...]\n\n",
+			"Track cloud instances and manage their lifecycle\n\n",
+		)
+		globalCmd.PrintDefaults()
+	}
+	globalCmd.BoolVar(&verbose, "verbose", false, "log debug messages, like the calls made to the cloud providers")
+	globalCmd.BoolVar(&quiet, "quiet", false, "only log errors")
+	globalCmd.StringVar(&format, "log-format", "text", "the format of the logs, text or json")
+	globalCmd.StringVar(&options.Trace, "trace", "", "export traces with OTLP (\"otlp\") or to a file")
+	globalCmd.BoolVar(&options.NoCache, "no-cache", false, "always get the state of the instances from the cloud providers")
+	globalCmd.StringVar(&options.Context, "context", "", "the context to use instead of the current one")
+	globalCmd.StringVar(&options.Config, "config", "", "the configuration file (by default, instances/config.json in the user configuration directory)")
+
+	if err := globalCmd.Parse(args); err != nil {
+		return GlobalOptions{}, nil, err
+	}
+
+	if verbose && quiet {
+		return GlobalOptions{}, nil, errors.New("--verbose and --quiet are mutually exclusive")
+	}
+
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelDebug
+	}
+	if quiet {
+		level = slog.LevelError
+	}
+
+	logger, err := NewLogger(w, level, format)
+	if err != nil {
+		return GlobalOptions{}, nil, err
+	}
+	options.Logger = logger
+	return options, globalCmd.Args(), nil
+}
+
+// longRunningCommands are the commands running until interrupted, whose
+// calls to the cloud providers are traced on their own rather than as part
+// of the command, and which don't keep the database locked while they run:
+// the daemon and the server save their changes themselves.
+var longRunningCommands = map[string]bool{"daemon": true, "serve": true, "watch": true}
+
 func (c *CLI) Run(args []string) error {
+	return c.RunContext(context.Background(), args)
+}
+
+// RunContext runs the command given by args, traced as part of the operation
+// of ctx.
+func (c *CLI) RunContext(ctx context.Context, args []string) (err error) {
 	if len(args) == 0 {
 		return errors.New("use subcommand")
 	}
 
+	c.invocation = args
+	// Let the notifications of the command be delivered before exiting.
+	defer c.notifier.Wait()
+
+	cloudProviders := c.cloudProviders
+	defer func() {
+		c.cloudProviders = cloudProviders
+		c.manager.cloudProviders = cloudProviders
+	}()
+
+	if c.statusCache != nil {
+		cache := c.statusCache
+		if longRunningCommands[args[0]] {
+			cache = NewMemoryStatusCache()
+		}
+		c.cloudProviders = cacheStatuses(c.cloudProviders, cache, c.statusTTL, c.now)
+	}
+
+	if !longRunningCommands[args[0]] {
+		var span trace.Span
+		// The arguments aren't recorded, as they may hold secrets.
+		ctx, span = tracer().Start(ctx, "instances "+args[0], trace.WithAttributes(attribute.String("command", args[0])))
+		defer func() { endSpan(span, err) }()
+
+		c.cloudProviders = bindContext(ctx, c.cloudProviders)
+	}
+	c.manager.cloudProviders = c.cloudProviders
+
+	if longRunningCommands[args[0]] {
+		return c.run(args)
+	}
+	// The other commands run on the database as saved by the other
+	// invocations, which wait for them to be done.
+	return c.db.Update(ctx, func() error {
+		return c.run(args)
+	})
+}
+
+// run runs the command given by args.
+func (c *CLI) run(args []string) error {
 	switch args[0] {
 	case "add":
 		return c.addInstance(args[1:])
 	case "rm":
 		return c.removeInstance(args[1:])
+	case "rename":
+		return c.renameInstance(args[1:])
+	case "edit":
+		return c.editInstance(args[1:])
+	case "annotate":
+		return c.annotateInstance(args[1:])
+	case "describe":
+		return c.describeInstance(args[1:])
+	case "protect":
+		return c.protect(args[1:])
 	case "status":
 		return c.getInstanceStatus(args[1:])
 	case "start":
 		return c.startInstance(args[1:])
 	case "stop":
 		return c.stopInstance(args[1:])
+	case "reboot":
+		return c.rebootInstance(args[1:])
 	case "list":
 		return c.listInstances(args[1:])
+	case "schedule":
+		return c.schedule(args[1:])
+	case "override":
+		return c.overrideInstance(args[1:])
+	case "extend":
+		return c.extendLease(args[1:])
+	case "reap":
+		return c.reap(args[1:])
+	case "report":
+		return c.report(args[1:])
+	case "autostop":
+		return c.autoStop(args[1:])
+	case "daemon":
+		return c.daemon(args[1:])
+	case "history":
+		return c.history(args[1:])
+	case "serve":
+		return c.serve(args[1:])
+	case "webhook":
+		return c.webhook(args[1:])
+	case "watch":
+		return c.watch(args[1:])
 	default:
 		return errors.New("unknown subcommand")
 	}
-
 }
 
 func (c *CLI) addInstance(args []string) error {
-	var cloudName, instanceName string
+	var cloudName, instanceName, expiry string
+	var opts InstanceOptions
+	tags := tagsFlag{}
 	addCmd := flag.NewFlagSet("add", flag.ContinueOnError)
 	addCmd.Usage = func() {
 		fmt.Print(
@@ -50,8 +349,15 @@ func (c *CLI) addInstance(args []string) error {
 		)
 		addCmd.PrintDefaults()
 	}
-	addCmd.StringVar(&cloudName, "cloud", "", "the cloud provider (one of AWS, Azure, GCP)")
+	addCmd.StringVar(&cloudName, "cloud", c.defaultCloud, "the cloud provider (one of AWS, Azure, GCP)")
 	addCmd.StringVar(&instanceName, "name", "", "the name under which to store the instance (by default, the instance name in the cloud provider)")
+	addCmd.StringVar(&opts.Group, "group", "", "the group the instance belongs to")
+	addCmd.Var(tags, "tag", "a tag of the instance, as KEY=VALUE (can be repeated)")
+	addCmd.StringVar(&opts.Owner, "owner", c.user, "the owner of the instance")
+	addCmd.StringVar(&opts.Description, "description", "", "what the instance is for")
+	addCmd.StringVar(&opts.Notes, "notes", "", "free-form notes about the instance")
+	addCmd.StringVar(&expiry, "expires", "", "when the instance can be deleted, as a date (2024-12-31), an RFC 3339 time or a duration (30d)")
+	addCmd.BoolVar(&opts.Protected, "protected", false, "require the commands changing the instance to be confirmed")
 
 	err := addCmd.Parse(args)
 	if err != nil {
@@ -70,17 +376,20 @@ func (c *CLI) addInstance(args []string) error {
 
 	instanceId := addCmd.Arg(0)
 
-	cloudProvider, exists := c.cloudProviders[strings.ToLower(cloudName)]
-	if !exists {
-		return fmt.Errorf("unsupported cloud provider %q", cloudName)
-	}
-
-	err = c.db.AddInstance(instanceId, instanceName, cloudProvider)
-	if err != nil {
-		return err
+	if expiry != "" {
+		expiresAt, err := ParseExpiry(expiry, c.now())
+		if err != nil {
+			return err
+		}
+		opts.Expiry = &expiresAt
 	}
 
-	return nil
+	return c.audited(instanceName, func() (string, error) {
+		if len(tags) > 0 {
+			opts.Tags = tags
+		}
+		return c.manager.AddInstance(instanceId, instanceName, cloudName, opts)
+	})
 }
 
 func (c *CLI) removeInstance(args []string) error {
@@ -88,22 +397,93 @@ func (c *CLI) removeInstance(args []string) error {
 	removeCmd.Usage = func() {
 		fmt.Print(
 			"Usage: instances rm INSTANCE_NAME\n\n",
-			"Remove the instance INSTANCE_NAME from the list of tracked instances\n\n",
+			"Remove the instance INSTANCE_NAME from the list of tracked instances, with its schedules\n\n",
 		)
 		removeCmd.PrintDefaults()
 	}
+	sure := sureFlag(removeCmd)
 
 	name, err := parseInstanceName(removeCmd, args)
 	if err != nil {
 		return err
 	}
 
-	err = c.db.RemoveInstance(name)
+	return c.audited(name, func() (string, error) {
+		if err := c.confirmProtected(name, *sure); err != nil {
+			return "", err
+		}
+		return "", c.manager.RemoveInstance(name)
+	})
+}
+
+// renameFlagSet returns the flag set of rename, which the history also
+// parses the recorded renames with, and its --yes-i-am-sure flag.
+func renameFlagSet() (*flag.FlagSet, *bool) {
+	renameCmd := flag.NewFlagSet("rename", flag.ContinueOnError)
+	renameCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances rename INSTANCE_NAME NEW_NAME\n\n",
+			"Rename the instance INSTANCE_NAME to NEW_NAME, keeping its tags, schedules and history\n\n",
+		)
+		renameCmd.PrintDefaults()
+	}
+	return renameCmd, sureFlag(renameCmd)
+}
+
+func (c *CLI) renameInstance(args []string) error {
+	renameCmd, sure := renameFlagSet()
+
+	err := renameCmd.Parse(args)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if renameCmd.NArg() != 2 {
+		renameCmd.Usage()
+		return errors.New("rename takes the instance name and the new name")
+	}
+
+	name, newName := renameCmd.Arg(0), renameCmd.Arg(1)
+
+	return c.audited(newName, func() (string, error) {
+		if err := c.confirmProtected(name, *sure); err != nil {
+			return "", err
+		}
+		return "", c.manager.RenameInstance(name, newName)
+	})
+}
+
+func (c *CLI) editInstance(args []string) error {
+	var id, cloudName string
+	editCmd := flag.NewFlagSet("edit", flag.ContinueOnError)
+	editCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances edit [OPTIONS] INSTANCE_NAME\n\n",
+			"Make the instance INSTANCE_NAME track another instance, like when it was replaced by a new one, keeping its tags, schedules and history\n\n",
+			"Example: instances edit --id i-0fedcba9876543210 devBox\n\n",
+		)
+		editCmd.PrintDefaults()
+	}
+	editCmd.StringVar(&id, "id", "", "the ID of the new instance")
+	editCmd.StringVar(&cloudName, "cloud", "", "the cloud provider of the new instance (by default, the current one)")
+	sure := sureFlag(editCmd)
+
+	name, err := parseInstanceName(editCmd, args)
+	if err != nil {
+		return err
+	}
+
+	if id == "" && cloudName == "" {
+		editCmd.Usage()
+		return errors.New("missing --id or --cloud")
+	}
+
+	return c.audited(name, func() (string, error) {
+		if err := c.confirmProtected(name, *sure); err != nil {
+			return "", err
+		}
+		return c.manager.EditInstance(name, id, cloudName)
+	})
 }
 
 func (c *CLI) getInstanceStatus(args []string) error {
@@ -121,56 +501,39 @@ func (c *CLI) getInstanceStatus(args []string) error {
 		return err
 	}
 
-	instance, err := c.db.GetInstance(name)
-	if err != nil {
-		return err
-	}
-
-	cloudProvider, err := instance.GetCloudProvider(c.cloudProviders)
-	if err != nil {
-		return fmt.Errorf("could not get instance status: %v", err)
-	}
-
-	status, err := cloudProvider.GetInstanceStatus(instance.Id)
+	status, err := c.manager.InstanceStatus(name)
 	if err != nil {
 		return err
 	}
-	fmt.Println(status)
+	fmt.Fprintln(c.out, status)
 
 	return nil
 }
 
 func (c *CLI) startInstance(args []string) error {
+	var leaseDuration durationFlag
 	startCmd := flag.NewFlagSet("start", flag.ContinueOnError)
 	startCmd.Usage = func() {
 		fmt.Print(
-			"Usage: instances start INSTANCE_NAME\n\n",
+			"Usage: instances start [OPTIONS] INSTANCE_NAME\n\n",
 			"Start the instance INSTANCE_NAME\n\n",
 		)
 		startCmd.PrintDefaults()
 	}
+	startCmd.Var(&leaseDuration, "for", "stop the instance automatically after this duration (e.g. 2h, 1d)")
+	sure := sureFlag(startCmd)
 
 	name, err := parseInstanceName(startCmd, args)
 	if err != nil {
 		return err
 	}
 
-	instance, err := c.db.GetInstance(name)
-	if err != nil {
-		return err
-	}
-
-	cloudProvider, err := instance.GetCloudProvider(c.cloudProviders)
-	if err != nil {
-		return err
-	}
-
-	err = cloudProvider.StartInstance(instance.Id)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return c.audited(name, func() (string, error) {
+		if err := c.confirmProtected(name, *sure); err != nil {
+			return "", err
+		}
+		return c.manager.StartInstance(name, time.Duration(leaseDuration), "cli")
+	})
 }
 
 func (c *CLI) stopInstance(args []string) error {
@@ -182,39 +545,63 @@ func (c *CLI) stopInstance(args []string) error {
 		)
 		stopCmd.PrintDefaults()
 	}
+	sure := sureFlag(stopCmd)
 
 	name, err := parseInstanceName(stopCmd, args)
 	if err != nil {
 		return err
 	}
 
-	instance, err := c.db.GetInstance(name)
-	if err != nil {
-		return err
-	}
+	return c.audited(name, func() (string, error) {
+		if err := c.confirmProtected(name, *sure); err != nil {
+			return "", err
+		}
+		return c.manager.StopInstance(name, "cli")
+	})
+}
 
-	cloudProvider, err := instance.GetCloudProvider(c.cloudProviders)
-	if err != nil {
-		return err
+func (c *CLI) rebootInstance(args []string) error {
+	rebootCmd := flag.NewFlagSet("reboot", flag.ContinueOnError)
+	rebootCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances reboot INSTANCE_NAME\n\n",
+			"Reboot the instance INSTANCE_NAME\n\n",
+		)
+		rebootCmd.PrintDefaults()
 	}
+	sure := sureFlag(rebootCmd)
 
-	err = cloudProvider.StopInstance(instance.Id)
+	name, err := parseInstanceName(rebootCmd, args)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.audited(name, func() (string, error) {
+		if err := c.confirmProtected(name, *sure); err != nil {
+			return "", err
+		}
+		return c.manager.RebootInstance(name, "cli")
+	})
 }
 
+// listStatusWorkers is the number of instances whose state is retrieved at
+// the same time by list --status.
+const listStatusWorkers = 8
+
 func (c *CLI) listInstances(args []string) error {
-	var cloudName string
+	var cloudName, owner string
+	var withStatus, expired bool
 	listCmd := flag.NewFlagSet("list", flag.ContinueOnError)
 	listCmd.StringVar(&cloudName, "cloud", "", "the cloud provider to list instances from")
+	listCmd.BoolVar(&withStatus, "status", false, "also print the state of the instances")
+	listCmd.StringVar(&owner, "owner", "", "only list the instances of this owner (\"me\" for the current user)")
+	listCmd.BoolVar(&expired, "expired", false, "only list the instances past their expiry date")
 	listCmd.Usage = func() {
 		fmt.Print(
 			"Usage: instances list [OPTIONS]\n\n",
 			"List the instances\n\n",
 		)
+		listCmd.PrintDefaults()
 	}
 
 	err := listCmd.Parse(args)
@@ -226,18 +613,198 @@ func (c *CLI) listInstances(args []string) error {
 		return errors.New("list doesn't take positional arguments")
 	}
 
-	for name, instance := range c.db.Instances {
+	if owner == "me" {
+		owner = c.user
+	}
+
+	now := c.now()
+	var names []string
+	for _, name := range sortedKeys(c.db.Instances) {
+		instance := c.db.Instances[name]
 		if cloudName != "" && !strings.EqualFold(instance.CloudProviderName, cloudName) {
 			continue
 		}
+		if owner != "" && instance.Owner != owner {
+			continue
+		}
+		if expired && !instance.Expired(now) {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	var states []string
+	if withStatus {
+		states = c.instanceStates(names)
+	}
+
+	for i, name := range names {
+		instance := c.db.Instances[name]
+		fmt.Fprintf(c.out, "name: %s\tid: %s\tcloud provider: %s", name, instance.Id, instance.CloudProviderName)
+		if withStatus {
+			fmt.Fprintf(c.out, "\tstate: %s", states[i])
+		}
+		if instance.Group != "" {
+			fmt.Fprintf(c.out, "\tgroup: %s", instance.Group)
+		}
+		if len(instance.Tags) > 0 {
+			fmt.Fprintf(c.out, "\ttags: %s", tagsFlag(instance.Tags))
+		}
+		if instance.LeaseExpiry != nil {
+			fmt.Fprintf(c.out, "\tlease expiry: %s", instance.LeaseExpiry.Format(time.RFC3339))
+		}
+		if instance.Owner != "" {
+			fmt.Fprintf(c.out, "\towner: %s", instance.Owner)
+		}
+		if instance.Description != "" {
+			fmt.Fprintf(c.out, "\tdescription: %s", instance.Description)
+		}
+		if instance.Expiry != nil {
+			fmt.Fprintf(c.out, "\texpires: %s", instance.Expiry.Format(time.RFC3339))
+			if instance.Expired(now) {
+				fmt.Fprint(c.out, " (expired)")
+			}
+		}
+		if c.db.IsProtected(name) {
+			fmt.Fprint(c.out, "\tprotected")
+		}
+		fmt.Fprintln(c.out)
+	}
+
+	return nil
+}
+
+// instanceStates returns the states of the given instances, retrieved
+// concurrently, or why they are unknown.
+func (c *CLI) instanceStates(names []string) []string {
+	states := make([]string, len(names))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(listStatusWorkers, len(names)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				state, err := c.manager.InstanceStatus(names[i])
+				if err != nil {
+					states[i] = fmt.Sprintf("unknown (%v)", err)
+					continue
+				}
+				states[i] = string(state)
+			}
+		}()
+	}
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return states
+}
+
+// audited runs a mutating operation on target and records it, with the
+// response it returns, in the audit log. Failing to record the operation is
+// an error.
+func (c *CLI) audited(target string, operation func() (response string, err error)) error {
+	response, err := operation()
+	if auditErr := c.recordAudit(target, response, err); auditErr != nil && err == nil {
+		return auditErr
+	}
+	return err
+}
+
+// recordAudit records the outcome of the command being run on target in the
+// audit log.
+func (c *CLI) recordAudit(target, response string, err error) error {
+	if c.auditLog == nil {
+		return nil
+	}
 
-		fmt.Printf("name: %s\tid: %s\tcloud provider: %s\n", name, instance.Id, instance.CloudProviderName)
+	var command string
+	var args []string
+	if len(c.invocation) > 0 {
+		command, args = c.invocation[0], redactSecrets(c.invocation[1:])
+	}
+	entry := AuditEntry{
+		Time:     c.now(),
+		User:     c.user,
+		Host:     c.host,
+		Command:  command,
+		Args:     args,
+		Target:   target,
+		Response: response,
+	}
+	if err != nil {
+		entry.Error = err.Error()
 	}
 
+	if err := c.auditLog.Append(entry); err != nil {
+		return fmt.Errorf("record audit entry: %v", err)
+	}
+	return nil
+}
+
+// secretFlags are the flags whose values are kept out of the audit log.
+var secretFlags = map[string]bool{"secret": true}
+
+// redactedValue replaces the values of the secretFlags in the audit log.
+const redactedValue = "REDACTED"
+
+// redactSecrets returns the arguments of a command with the values of the
+// secretFlags, given as "--flag value" or "--flag=value", redacted.
+func redactSecrets(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted); i++ {
+		arg := redacted[i]
+		if arg == "--" {
+			// The arguments left aren't flags.
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !secretFlags[name] {
+			continue
+		}
+		if hasValue {
+			redacted[i] = arg[:strings.Index(arg, "=")+1] + redactedValue
+		} else if i+1 < len(redacted) {
+			i++
+			redacted[i] = redactedValue
+		}
+	}
+	return redacted
+}
+
+// tagsFlag is a flag.Value accumulating KEY=VALUE tags.
+type tagsFlag map[string]string
+
+func (t tagsFlag) String() string {
+	pairs := make([]string, 0, len(t))
+	for _, key := range sortedKeys(t) {
+		pairs = append(pairs, key+"="+t[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t tagsFlag) Set(s string) error {
+	key, value, found := strings.Cut(s, "=")
+	if !found || key == "" {
+		return fmt.Errorf("invalid tag %q, expected KEY=VALUE", s)
+	}
+	t[key] = value
 	return nil
 }
 
 func parseInstanceName(cmd *flag.FlagSet, args []string) (string, error) {
+	return parseName(cmd, args, "instance")
+}
+
+// parseName parses the flags of cmd and returns its single positional
+// argument, the name of a kind of object.
+func parseName(cmd *flag.FlagSet, args []string, kind string) (string, error) {
 	err := cmd.Parse(args)
 	if err != nil {
 		return "", err
@@ -245,12 +812,12 @@ func parseInstanceName(cmd *flag.FlagSet, args []string) (string, error) {
 
 	if len(cmd.Args()) == 0 {
 		cmd.Usage()
-		return "", errors.New("missing instance name")
+		return "", fmt.Errorf("missing %s name", kind)
 	}
 
 	if len(cmd.Args()) > 1 {
 		cmd.Usage()
-		return "", errors.New("only one instance name can be provided")
+		return "", fmt.Errorf("only one %s name can be provided", kind)
 	}
 
 	return cmd.Arg(0), nil
@@ -0,0 +1,201 @@
+package instances
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+func (c *CLI) autoStop(args []string) error {
+	usage := func() {
+		fmt.Print(
+			"Usage: instances autostop COMMAND\n\n",
+			"Manage the policies stopping idle instances\n\n",
+			"Commands:\n",
+			"  set       set the auto-stop policy of an instance, or the default one\n",
+			"  rm        remove the auto-stop policy of an instance, or the default one\n",
+			"  opt-out   exempt an instance from auto-stop policies\n",
+			"  opt-in    make an instance subject to auto-stop policies again\n",
+			"  list      list the auto-stop policies\n",
+		)
+	}
+
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing autostop command")
+	}
+
+	switch args[0] {
+	case "set":
+		return c.setAutoStopPolicy(args[1:])
+	case "rm":
+		return c.removeAutoStopPolicy(args[1:])
+	case "opt-out":
+		return c.setAutoStopOptOut(args[1:], true)
+	case "opt-in":
+		return c.setAutoStopOptOut(args[1:], false)
+	case "list":
+		return c.listAutoStopPolicies(args[1:])
+	default:
+		usage()
+		return fmt.Errorf("unknown autostop command %q", args[0])
+	}
+}
+
+func (c *CLI) setAutoStopPolicy(args []string) error {
+	var cpuThreshold float64
+	var after, grace time.Duration
+	var setDefault, allowProtected bool
+	setCmd := flag.NewFlagSet("autostop set", flag.ContinueOnError)
+	setCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances autostop set [OPTIONS] (INSTANCE_NAME | --default)\n\n",
+			"Stop the instance INSTANCE_NAME, or by default any instance, when it is idle\n\n",
+		)
+		setCmd.PrintDefaults()
+	}
+	setCmd.Float64Var(&cpuThreshold, "cpu", 5, "the CPU utilization percentage under which the instance is idle")
+	setCmd.DurationVar(&after, "after", time.Hour, "how long the instance must be idle before being stopped")
+	setCmd.DurationVar(&grace, "grace", 10*time.Minute, "how long to warn before stopping the instance")
+	setCmd.BoolVar(&setDefault, "default", false, "set the default policy of the instances without their own")
+	setCmd.BoolVar(&allowProtected, "allow-protected", false, "stop the instance even if it is protected")
+	sure := sureFlag(setCmd)
+
+	name, err := parseInstanceNameOrDefault(setCmd, args, &setDefault)
+	if err != nil {
+		return err
+	}
+	if setDefault && allowProtected {
+		return errors.New("the default policy can't stop protected instances")
+	}
+
+	return c.audited(name, func() (string, error) {
+		if allowProtected {
+			if err := c.confirmProtected(name, *sure); err != nil {
+				return "", err
+			}
+		}
+		return "", c.db.SetAutoStopPolicy(name, &AutoStopPolicy{
+			CPUThreshold:   cpuThreshold,
+			After:          Duration(after),
+			Grace:          Duration(grace),
+			AllowProtected: allowProtected,
+		})
+	})
+}
+
+func (c *CLI) removeAutoStopPolicy(args []string) error {
+	var removeDefault bool
+	removeCmd := flag.NewFlagSet("autostop rm", flag.ContinueOnError)
+	removeCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances autostop rm (INSTANCE_NAME | --default)\n\n",
+			"Remove the auto-stop policy of the instance INSTANCE_NAME, or the default one\n\n",
+		)
+		removeCmd.PrintDefaults()
+	}
+	removeCmd.BoolVar(&removeDefault, "default", false, "remove the default policy")
+
+	name, err := parseInstanceNameOrDefault(removeCmd, args, &removeDefault)
+	if err != nil {
+		return err
+	}
+
+	return c.audited(name, func() (string, error) {
+		return "", c.db.SetAutoStopPolicy(name, nil)
+	})
+}
+
+func (c *CLI) setAutoStopOptOut(args []string, optOut bool) error {
+	cmdName := "opt-in"
+	if optOut {
+		cmdName = "opt-out"
+	}
+	optCmd := flag.NewFlagSet("autostop "+cmdName, flag.ContinueOnError)
+	optCmd.Usage = func() {
+		fmt.Printf("Usage: instances autostop %s INSTANCE_NAME\n\n", cmdName)
+		if optOut {
+			fmt.Print("Exempt the instance INSTANCE_NAME from auto-stop policies\n\n")
+		} else {
+			fmt.Print("Make the instance INSTANCE_NAME subject to auto-stop policies again\n\n")
+		}
+		optCmd.PrintDefaults()
+	}
+
+	name, err := parseInstanceName(optCmd, args)
+	if err != nil {
+		return err
+	}
+
+	return c.audited(name, func() (string, error) {
+		return "", c.db.UpdateInstance(name, func(instance *Instance) {
+			instance.AutoStopOptOut = optOut
+		})
+	})
+}
+
+func (c *CLI) listAutoStopPolicies(args []string) error {
+	listCmd := flag.NewFlagSet("autostop list", flag.ContinueOnError)
+	listCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances autostop list\n\n",
+			"List the auto-stop policies\n\n",
+		)
+	}
+
+	err := listCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(listCmd.Args()) > 0 {
+		return errors.New("autostop list doesn't take positional arguments")
+	}
+
+	if c.db.DefaultAutoStop != nil {
+		fmt.Fprintf(c.out, "default: %s\n", c.db.DefaultAutoStop)
+	}
+
+	for _, name := range sortedKeys(c.db.Instances) {
+		instance := c.db.Instances[name]
+		switch {
+		case instance.AutoStopOptOut:
+			fmt.Fprintf(c.out, "%s: opted out\n", name)
+		case instance.AutoStop != nil:
+			fmt.Fprintf(c.out, "%s: %s\n", name, instance.AutoStop)
+		}
+	}
+
+	return nil
+}
+
+// parseInstanceNameOrDefault parses the flags of cmd and returns either the
+// instance name given as positional argument, or an empty name when
+// isDefault is set.
+func parseInstanceNameOrDefault(cmd *flag.FlagSet, args []string, isDefault *bool) (string, error) {
+	err := cmd.Parse(args)
+	if err != nil {
+		return "", err
+	}
+
+	if *isDefault {
+		if len(cmd.Args()) > 0 {
+			cmd.Usage()
+			return "", errors.New("no instance name can be provided with --default")
+		}
+		return "", nil
+	}
+
+	if len(cmd.Args()) == 0 {
+		cmd.Usage()
+		return "", errors.New("missing instance name")
+	}
+
+	if len(cmd.Args()) > 1 {
+		cmd.Usage()
+		return "", errors.New("only one instance name can be provided")
+	}
+
+	return cmd.Arg(0), nil
+}
@@ -0,0 +1,193 @@
+package instances
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RunContextCommand runs the context command given by args, managing the
+// contexts of the configuration file at path, which is created if it
+// doesn't exist. It runs apart from the CLI, which works on the database of
+// a single context.
+func RunContextCommand(path string, args []string, out io.Writer) error {
+	usage := func() {
+		fmt.Print(
+			"Usage: instances context COMMAND\n\n",
+			"Manage the contexts, each with its own database and cloud providers\n\n",
+			"Commands:\n",
+			"  create  create a context\n",
+			"  use     make a context the current one\n",
+			"  list    list the contexts\n",
+		)
+	}
+
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing context command")
+	}
+
+	config, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		err = createContext(config, args[1:])
+	case "use":
+		err = useContext(config, args[1:])
+	case "list":
+		return listContexts(config, args[1:], out)
+	default:
+		usage()
+		return fmt.Errorf("unknown context command %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	return writeConfigFile(path, config)
+}
+
+func createContext(config *Config, args []string) error {
+	var context ContextConfig
+	var provider ProviderConfig
+	var use bool
+	createCmd := flag.NewFlagSet("context create", flag.ContinueOnError)
+	createCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances context create [OPTIONS] CONTEXT_NAME\n\n",
+			"Create the context CONTEXT_NAME, with its own database and, if any of --region, --profile or --endpoint is set, its own AWS provider \"aws\" (by default, it uses the providers of the default context)\n\n",
+			"Example: instances context create --profile client-a --region eu-west-3 --use client-a\n\n",
+		)
+		createCmd.PrintDefaults()
+	}
+	createCmd.StringVar(&context.Database.Path, "database", "", "the database file (by default, ~/.instances.CONTEXT_NAME.db.json)")
+	createCmd.StringVar(&provider.Region, "region", "", "the AWS region of the provider")
+	createCmd.StringVar(&provider.Profile, "profile", "", "the AWS profile of the provider")
+	createCmd.StringVar(&provider.Endpoint, "endpoint", "", "the URL of the EC2 endpoint of the provider")
+	createCmd.BoolVar(&use, "use", false, "make the context the current one")
+
+	name, err := parseName(createCmd, args, "context")
+	if err != nil {
+		return err
+	}
+
+	if provider != (ProviderConfig{}) {
+		provider.Type = "aws"
+		context.Providers = map[string]ProviderConfig{"aws": provider}
+	}
+	if err := config.AddContext(name, context); err != nil {
+		return err
+	}
+	if use {
+		return config.UseContext(name)
+	}
+	return nil
+}
+
+func useContext(config *Config, args []string) error {
+	useCmd := flag.NewFlagSet("context use", flag.ContinueOnError)
+	useCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances context use CONTEXT_NAME\n\n",
+			"Make the context CONTEXT_NAME the current one, used by the commands without --context\n\n",
+		)
+		useCmd.PrintDefaults()
+	}
+
+	name, err := parseName(useCmd, args, "context")
+	if err != nil {
+		return err
+	}
+	return config.UseContext(name)
+}
+
+func listContexts(config *Config, args []string, out io.Writer) error {
+	listCmd := flag.NewFlagSet("context list", flag.ContinueOnError)
+	listCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances context list\n\n",
+			"List the contexts, marking the current one\n\n",
+		)
+	}
+
+	err := listCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(listCmd.Args()) > 0 {
+		return errors.New("context list doesn't take positional arguments")
+	}
+
+	current := config.CurrentContext
+	if current == "" {
+		current = DefaultContext
+	}
+	for _, name := range config.ContextNames() {
+		resolved, err := config.Resolve(name, func(string) string { return "" })
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "name: %s\tdatabase: %s\tproviders: %s", name, resolved.Database.Path, strings.Join(sortedKeys(resolved.Providers), ","))
+		if name == current {
+			fmt.Fprint(out, "\t(current)")
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+// readConfigFile reads the configuration file at path, an empty one if it
+// doesn't exist.
+func readConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open config file: %v", err)
+	}
+	defer f.Close()
+
+	config, err := ReadConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// writeConfigFile replaces the configuration file at path at once, so that
+// concurrent commands never read it half-written. It is only readable by
+// its owner, as it may hold credentials.
+func writeConfigFile(path string, config *Config) error {
+	var b bytes.Buffer
+	if err := config.Write(&b); err != nil {
+		return fmt.Errorf("serialize config: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("write config file: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("write config file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write config file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write config file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write config file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package instances
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func (c *CLI) history(args []string) error {
+	var since durationFlag
+	var asJSON bool
+	var limit int
+	var command string
+	historyCmd := flag.NewFlagSet("history", flag.ContinueOnError)
+	historyCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances history [OPTIONS] [INSTANCE_NAME]\n\n",
+			"Print the audit log of the mutating commands, optionally only the ones targeting INSTANCE_NAME, under its current or previous names\n\n",
+		)
+		historyCmd.PrintDefaults()
+	}
+	historyCmd.Var(&since, "since", "only print the entries of this period (e.g. 7d, 12h)")
+	historyCmd.StringVar(&command, "command", "", "only print the entries of this command")
+	historyCmd.IntVar(&limit, "limit", 0, "only print the last entries")
+	historyCmd.BoolVar(&asJSON, "json", c.outputFormat == "json", "print the entries as JSON lines")
+
+	err := historyCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(historyCmd.Args()) > 1 {
+		historyCmd.Usage()
+		return errors.New("only one instance name can be provided")
+	}
+	target := historyCmd.Arg(0)
+
+	if c.auditLog == nil {
+		return errors.New("no audit log configured")
+	}
+
+	entries, err := c.auditLog.Entries()
+	if err != nil {
+		return err
+	}
+
+	// The entries are walked from the latest, to follow the renames of the
+	// instance back to its previous names.
+	var selected []AuditEntry
+	from := c.now().Add(-time.Duration(since))
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if target != "" && entry.Target != target {
+			continue
+		}
+		if previous, renamed := renamedFrom(entry); renamed && target != "" {
+			target = previous
+		}
+		if command != "" && entry.Command != command {
+			continue
+		}
+		if since > 0 && entry.Time.Before(from) {
+			continue
+		}
+		selected = append(selected, entry)
+	}
+	slices.Reverse(selected)
+	if limit > 0 && len(selected) > limit {
+		selected = selected[len(selected)-limit:]
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(c.out)
+		for _, entry := range selected {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUSER\tCOMMAND\tTARGET\tRESULT")
+	for _, entry := range selected {
+		result := entry.Response
+		if entry.Error != "" {
+			result = "error: " + entry.Error
+		}
+		fmt.Fprintf(w, "%s\t%s@%s\t%s\t%s\t%s\n",
+			entry.Time.Format(time.RFC3339), entry.User, entry.Host,
+			strings.TrimSpace(entry.Command+" "+strings.Join(entry.Args, " ")), entry.Target, result)
+	}
+	return w.Flush()
+}
+
+// renamedFrom returns the previous name of the instance renamed by the
+// command of an audit entry, if it renamed one.
+func renamedFrom(entry AuditEntry) (string, bool) {
+	if entry.Command != "rename" || entry.Error != "" {
+		return "", false
+	}
+	renameCmd, _ := renameFlagSet()
+	renameCmd.SetOutput(io.Discard)
+	renameCmd.Usage = func() {}
+	if err := renameCmd.Parse(entry.Args); err != nil || renameCmd.NArg() != 2 {
+		return "", false
+	}
+	return renameCmd.Arg(0), true
+}
+
+// auditAction records an action performed by an automated source in the
+// audit log.
+func (c *CLI) auditAction(action Action) error {
+	response := fmt.Sprintf("%s (%s)", action.Action, action.Source)
+	if action.Message != "" {
+		response += ": " + action.Message
+	}
+	if action.Skipped != "" {
+		response += ": skipped, " + action.Skipped
+	}
+
+	var err error
+	if action.Error != "" {
+		err = errors.New(action.Error)
+	}
+	return c.recordAudit(action.Instance, response, err)
+}
@@ -0,0 +1,73 @@
+package instances
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+func (c *CLI) extendLease(args []string) error {
+	extendCmd := flag.NewFlagSet("extend", flag.ContinueOnError)
+	extendCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances extend INSTANCE_NAME DURATION\n\n",
+			"Extend the lease of the instance INSTANCE_NAME by DURATION (e.g. 1h, 1d)\n\n",
+		)
+		extendCmd.PrintDefaults()
+	}
+
+	err := extendCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(extendCmd.Args()) != 2 {
+		extendCmd.Usage()
+		return errors.New("an instance name and a duration must be provided")
+	}
+
+	name := extendCmd.Arg(0)
+	duration, err := ParseDuration(extendCmd.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	return c.audited(name, func() (string, error) {
+		expiry, err := c.db.ExtendLease(name, duration, c.now())
+		if err != nil {
+			return "", err
+		}
+
+		response := fmt.Sprintf("lease expires at %s", expiry.Format(time.RFC3339))
+		fmt.Fprintln(c.out, response)
+		return response, nil
+	})
+}
+
+func (c *CLI) reap(args []string) error {
+	reapCmd := flag.NewFlagSet("reap", flag.ContinueOnError)
+	reapCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances reap\n\n",
+			"Stop the instances whose lease expired\n\n",
+		)
+	}
+
+	err := reapCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(reapCmd.Args()) > 0 {
+		return errors.New("reap doesn't take positional arguments")
+	}
+
+	// Every action is reported, the ones performed already included.
+	var errs []error
+	for _, action := range NewReaper(c.db, c.cloudProviders).Run(c.now()) {
+		errs = append(errs, c.reportAction(action))
+	}
+
+	return errors.Join(errs...)
+}
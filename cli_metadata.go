@@ -0,0 +1,134 @@
+package instances
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (c *CLI) annotateInstance(args []string) error {
+	var owner, description, notes, expiry string
+	annotateCmd := flag.NewFlagSet("annotate", flag.ContinueOnError)
+	annotateCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances annotate [OPTIONS] INSTANCE_NAME\n\n",
+			"Set the owner, description, notes or expiry date of the instance INSTANCE_NAME, or clear them when set to \"\"\n\n",
+			"Example: instances annotate --owner alice --expires 30d devBox\n\n",
+		)
+		annotateCmd.PrintDefaults()
+	}
+	annotateCmd.StringVar(&owner, "owner", "", "the owner of the instance")
+	annotateCmd.StringVar(&description, "description", "", "what the instance is for")
+	annotateCmd.StringVar(&notes, "notes", "", "free-form notes about the instance")
+	annotateCmd.StringVar(&expiry, "expires", "", "when the instance can be deleted, as a date (2024-12-31), an RFC 3339 time or a duration (30d)")
+	sure := sureFlag(annotateCmd)
+
+	name, err := parseInstanceName(annotateCmd, args)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	annotateCmd.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	delete(set, "yes-i-am-sure")
+	if len(set) == 0 {
+		annotateCmd.Usage()
+		return errors.New("missing --owner, --description, --notes or --expires")
+	}
+
+	var expiresAt *time.Time
+	if expiry != "" {
+		t, err := ParseExpiry(expiry, c.now())
+		if err != nil {
+			return err
+		}
+		expiresAt = &t
+	}
+
+	return c.audited(name, func() (string, error) {
+		if err := c.confirmProtected(name, *sure); err != nil {
+			return "", err
+		}
+		return "", c.db.UpdateInstance(name, func(instance *Instance) {
+			if set["owner"] {
+				instance.Owner = owner
+			}
+			if set["description"] {
+				instance.Description = description
+			}
+			if set["notes"] {
+				instance.Notes = notes
+			}
+			if set["expires"] {
+				instance.Expiry = expiresAt
+			}
+		})
+	})
+}
+
+func (c *CLI) describeInstance(args []string) error {
+	describeCmd := flag.NewFlagSet("describe", flag.ContinueOnError)
+	describeCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances describe INSTANCE_NAME\n\n",
+			"Print the attributes of the instance INSTANCE_NAME\n\n",
+		)
+		describeCmd.PrintDefaults()
+	}
+
+	name, err := parseInstanceName(describeCmd, args)
+	if err != nil {
+		return err
+	}
+
+	instance, err := c.db.GetInstance(name)
+	if err != nil {
+		return err
+	}
+
+	fields := [][2]string{
+		{"name", name},
+		{"id", instance.Id},
+		{"cloud provider", instance.CloudProviderName},
+		{"group", instance.Group},
+		{"tags", tagsFlag(instance.Tags).String()},
+		{"type", instance.Type},
+		{"region", instance.Region},
+		{"owner", instance.Owner},
+		{"description", instance.Description},
+	}
+	if instance.CreatedAt != nil {
+		fields = append(fields, [2]string{"created at", instance.CreatedAt.Format(time.RFC3339)})
+	}
+	if instance.Expiry != nil {
+		expiry := instance.Expiry.Format(time.RFC3339)
+		if instance.Expired(c.now()) {
+			expiry += " (expired)"
+		}
+		fields = append(fields, [2]string{"expires", expiry})
+	}
+	if instance.LeaseExpiry != nil {
+		fields = append(fields, [2]string{"lease expiry", instance.LeaseExpiry.Format(time.RFC3339)})
+	}
+	if instance.Protected {
+		fields = append(fields, [2]string{"protected", "yes"})
+	} else if c.db.IsProtected(name) {
+		fields = append(fields, [2]string{"protected", "yes, by its group"})
+	}
+	for _, field := range fields {
+		if field[1] != "" {
+			fmt.Fprintf(c.out, "%s: %s\n", field[0], field[1])
+		}
+	}
+
+	// The notes may span several lines, they are printed last.
+	if instance.Notes != "" {
+		fmt.Fprintf(c.out, "notes:\n  %s\n", strings.ReplaceAll(instance.Notes, "\n", "\n  "))
+	}
+
+	return nil
+}
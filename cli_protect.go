@@ -0,0 +1,103 @@
+package instances
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func (c *CLI) protect(args []string) error {
+	var group, off bool
+	protectCmd := flag.NewFlagSet("protect", flag.ContinueOnError)
+	protectCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances protect [OPTIONS] INSTANCE_NAME\n\n",
+			"Protect the instance INSTANCE_NAME, or all the instances of a group with --group: the commands changing it must be confirmed, by typing its name or with --yes-i-am-sure\n\n",
+			"Example: instances protect --group production\n\n",
+		)
+		protectCmd.PrintDefaults()
+	}
+	protectCmd.BoolVar(&group, "group", false, "protect the instances of the group INSTANCE_NAME instead")
+	protectCmd.BoolVar(&off, "off", false, "remove the protection")
+	sure := sureFlag(protectCmd)
+
+	name, err := parseInstanceName(protectCmd, args)
+	if err != nil {
+		return err
+	}
+
+	if group {
+		return c.audited(name, func() (string, error) {
+			if off {
+				if err := c.confirm("group "+name, name, *sure); err != nil {
+					return "", err
+				}
+			}
+			return "", c.db.SetGroupProtected(name, !off)
+		})
+	}
+
+	return c.audited(name, func() (string, error) {
+		if off {
+			if err := c.confirmProtected(name, *sure); err != nil {
+				return "", err
+			}
+		}
+		if err := c.db.SetProtected(name, !off); err != nil {
+			return "", err
+		}
+		if off && c.db.IsProtected(name) {
+			return fmt.Sprintf("instance %s is still protected by its group", name), nil
+		}
+		return "", nil
+	})
+}
+
+// sureFlag defines the --yes-i-am-sure flag of the commands changing
+// protected instances.
+func sureFlag(cmd *flag.FlagSet) *bool {
+	return cmd.Bool("yes-i-am-sure", false, "change the instance without confirmation, even if it is protected")
+}
+
+// confirmProtected checks that changing the instance name is confirmed, if
+// it is protected.
+func (c *CLI) confirmProtected(name string, sure bool) error {
+	if !c.db.IsProtected(name) {
+		return nil
+	}
+	return c.confirm("instance "+name, name, sure)
+}
+
+// confirmProtectedGroup checks that changing the instances of the group is
+// confirmed, if any of them is protected.
+func (c *CLI) confirmProtectedGroup(group string, sure bool) error {
+	for name, instance := range c.db.Instances {
+		if instance.Group == group && c.db.IsProtected(name) {
+			return c.confirm("group "+group, group, sure)
+		}
+	}
+	return nil
+}
+
+// confirm checks that changing the protected target is confirmed, by sure
+// (--yes-i-am-sure) or, when the CLI is interactive, by typing its name.
+func (c *CLI) confirm(target, name string, sure bool) error {
+	if sure {
+		return nil
+	}
+	if c.confirmations == nil {
+		return Errorf(ErrPermissionDenied, "%s is protected, confirm with --yes-i-am-sure", target)
+	}
+
+	fmt.Fprintf(c.prompt, "%s is protected. Type %q to confirm: ", target, name)
+	answer, err := c.confirmations.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read confirmation: %v", err)
+	}
+	if strings.TrimSpace(answer) != name {
+		return Errorf(ErrPermissionDenied, "%s is protected, confirmation doesn't match", target)
+	}
+	return nil
+}
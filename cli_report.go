@@ -0,0 +1,116 @@
+package instances
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// WithPriceTable sets the price table used to estimate costs in reports.
+func WithPriceTable(prices PriceTable) CLIOption {
+	return func(c *CLI) {
+		c.prices = prices
+	}
+}
+
+func (c *CLI) report(args []string) error {
+	since := durationFlag(30 * 24 * time.Hour)
+	var group, pricingPath string
+	reportCmd := flag.NewFlagSet("report", flag.ContinueOnError)
+	reportCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances report [OPTIONS]\n\n",
+			"Report the running hours and estimated cost of the instances\n\n",
+		)
+		reportCmd.PrintDefaults()
+	}
+	reportCmd.Var(&since, "since", "the period covered by the report (e.g. 30d, 12h)")
+	reportCmd.StringVar(&group, "group", "", "only report the instances of this group")
+	reportCmd.StringVar(&pricingPath, "pricing", "", "a JSON price table, by region then instance type")
+
+	err := reportCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(reportCmd.Args()) > 0 {
+		return errors.New("report doesn't take positional arguments")
+	}
+
+	prices := c.prices
+	if pricingPath != "" {
+		f, err := os.Open(pricingPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		prices, err = LoadPriceTable(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.describeInstances()
+
+	to := c.now()
+	report := NewReport(c.db, to.Add(-time.Duration(since)), to, prices, group)
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	for _, section := range []struct {
+		title string
+		lines []ReportLine
+	}{
+		{"INSTANCE", report.Instances},
+		{"GROUP", report.Groups},
+		{"CLOUD PROVIDER", report.CloudProviders},
+	} {
+		fmt.Fprintf(w, "%s\tHOURS\tCOST\n", section.title)
+		for _, line := range section.lines {
+			cost := fmt.Sprintf("%.2f", line.Cost)
+			if !line.CostKnown {
+				cost = "unknown"
+				if line.Cost > 0 {
+					cost = fmt.Sprintf(">= %.2f", line.Cost)
+				}
+			}
+			fmt.Fprintf(w, "%s\t%.1f\t%s\n", line.Name, line.Running.Hours(), cost)
+		}
+		fmt.Fprintln(w, "\t\t")
+	}
+
+	return w.Flush()
+}
+
+// describeInstances fills the type and region of the instances missing them,
+// when their cloud provider can describe them.
+func (c *CLI) describeInstances() {
+	for name, instance := range c.db.Instances {
+		if instance.Type != "" {
+			continue
+		}
+
+		cloudProvider, err := instance.GetCloudProvider(c.cloudProviders)
+		if err != nil {
+			continue
+		}
+
+		describer, ok := capability[InstanceDescriber](cloudProvider)
+		if !ok {
+			continue
+		}
+
+		details, err := describer.DescribeInstance(instance.Id)
+		if err != nil {
+			continue
+		}
+
+		_ = c.db.UpdateInstance(name, func(instance *Instance) {
+			instance.Type = details.Type
+			instance.Region = details.Region
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package instances
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func (c *CLI) schedule(args []string) error {
+	usage := func() {
+		fmt.Print(
+			"Usage: instances schedule COMMAND\n\n",
+			"Manage start/stop schedules\n\n",
+			"Commands:\n",
+			"  add     add or replace a schedule\n",
+			"  rm      remove a schedule\n",
+			"  list    list the schedules\n",
+		)
+	}
+
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing schedule command")
+	}
+
+	switch args[0] {
+	case "add":
+		return c.addSchedule(args[1:])
+	case "rm":
+		return c.removeSchedule(args[1:])
+	case "list":
+		return c.listSchedules(args[1:])
+	default:
+		usage()
+		return fmt.Errorf("unknown schedule command %q", args[0])
+	}
+}
+
+func (c *CLI) addSchedule(args []string) error {
+	var schedule Schedule
+	addCmd := flag.NewFlagSet("schedule add", flag.ContinueOnError)
+	addCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances schedule add [OPTIONS] SCHEDULE_NAME\n\n",
+			"Add the schedule SCHEDULE_NAME, replacing any schedule with the same name\n\n",
+			"Example: instances schedule add --group dev --start '0 8 * * 1-5' --stop '0 19 * * 1-5' --tz Europe/Paris office-hours\n\n",
+		)
+		addCmd.PrintDefaults()
+	}
+	addCmd.StringVar(&schedule.Instance, "instance", "", "the instance targeted by the schedule")
+	addCmd.StringVar(&schedule.Group, "group", "", "the group of instances targeted by the schedule")
+	addCmd.StringVar(&schedule.Start, "start", "", "the cron expression at which to start the instances")
+	addCmd.StringVar(&schedule.Stop, "stop", "", "the cron expression at which to stop the instances")
+	addCmd.StringVar(&schedule.TimeZone, "tz", "UTC", "the time zone in which the cron expressions are evaluated")
+	addCmd.BoolVar(&schedule.AllowProtected, "allow-protected", false, "also start and stop the protected instances, which are skipped otherwise")
+	sure := sureFlag(addCmd)
+
+	name, err := parseName(addCmd, args, "schedule")
+	if err != nil {
+		return err
+	}
+
+	return c.audited(name, func() (string, error) {
+		if schedule.AllowProtected {
+			var err error
+			if schedule.Group != "" {
+				err = c.confirmProtectedGroup(schedule.Group, *sure)
+			} else {
+				err = c.confirmProtected(schedule.Instance, *sure)
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		return "", c.db.AddSchedule(name, schedule)
+	})
+}
+
+func (c *CLI) removeSchedule(args []string) error {
+	removeCmd := flag.NewFlagSet("schedule rm", flag.ContinueOnError)
+	removeCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances schedule rm SCHEDULE_NAME\n\n",
+			"Remove the schedule SCHEDULE_NAME\n\n",
+		)
+		removeCmd.PrintDefaults()
+	}
+
+	name, err := parseName(removeCmd, args, "schedule")
+	if err != nil {
+		return err
+	}
+
+	return c.audited(name, func() (string, error) {
+		return "", c.db.RemoveSchedule(name)
+	})
+}
+
+func (c *CLI) listSchedules(args []string) error {
+	listCmd := flag.NewFlagSet("schedule list", flag.ContinueOnError)
+	listCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances schedule list\n\n",
+			"List the schedules\n\n",
+		)
+	}
+
+	err := listCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(listCmd.Args()) > 0 {
+		return errors.New("schedule list doesn't take positional arguments")
+	}
+
+	for _, name := range sortedKeys(c.db.Schedules) {
+		schedule := c.db.Schedules[name]
+		target := "instance " + schedule.Instance
+		if schedule.Group != "" {
+			target = "group " + schedule.Group
+		}
+		fmt.Fprintf(c.out, "name: %s\ttarget: %s\tstart: %q\tstop: %q\ttime zone: %s",
+			name, target, schedule.Start, schedule.Stop, schedule.TimeZone)
+		if schedule.AllowProtected {
+			fmt.Fprint(c.out, "\tallow protected")
+		}
+		fmt.Fprintln(c.out)
+	}
+
+	return nil
+}
+
+func (c *CLI) overrideInstance(args []string) error {
+	var duration time.Duration
+	var clear bool
+	overrideCmd := flag.NewFlagSet("override", flag.ContinueOnError)
+	overrideCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances override [OPTIONS] INSTANCE_NAME\n\n",
+			"Prevent automated actions on the instance INSTANCE_NAME\n\n",
+		)
+		overrideCmd.PrintDefaults()
+	}
+	overrideCmd.DurationVar(&duration, "for", 0, "how long the override lasts (by default, until cleared)")
+	overrideCmd.BoolVar(&clear, "clear", false, "clear the override")
+
+	name, err := parseInstanceName(overrideCmd, args)
+	if err != nil {
+		return err
+	}
+
+	// Overrides only hold back the automated actions, which skip the protected
+	// instances anyway, so they don't need to be confirmed.
+	return c.audited(name, func() (string, error) {
+		if clear {
+			return "", c.db.SetOverride(name, nil)
+		}
+
+		override := &Override{}
+		if duration > 0 {
+			override.Until = c.now().Add(duration)
+		}
+		return "", c.db.SetOverride(name, override)
+	})
+}
+
+func (c *CLI) daemon(args []string) error {
+	var interval time.Duration
+	var once bool
+	var metricsAddr string
+	daemonCmd := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	daemonCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances daemon [OPTIONS]\n\n",
+			"Run the scheduler, starting and stopping instances as their schedules require,\n",
+			"and stop the instances idle according to their auto-stop policy or whose lease expired\n\n",
+		)
+		daemonCmd.PrintDefaults()
+	}
+	daemonCmd.DurationVar(&interval, "interval", time.Minute, "how often schedules and auto-stop policies are evaluated")
+	daemonCmd.BoolVar(&once, "once", false, "evaluate the schedules and auto-stop policies once and exit")
+	daemonCmd.StringVar(&metricsAddr, "metrics-addr", "", "the address on which to serve Prometheus metrics at /metrics (by default, they aren't served)")
+
+	err := daemonCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(daemonCmd.Args()) > 0 {
+		return errors.New("daemon doesn't take positional arguments")
+	}
+
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", c.metrics)
+		metricsServer := &http.Server{Addr: metricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		listener, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := metricsServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				c.logger.Error("metrics server failed", "error", err)
+			}
+		}()
+		defer metricsServer.Close()
+	}
+
+	// Each run works on a copy of the database, and only its own changes
+	// are saved, so that the changes made by other invocations during the
+	// run are kept.
+	run := &Database{}
+	scheduler := NewScheduler(run, c.cloudProviders)
+	idleMonitor := NewIdleMonitor(run, c.cloudProviders)
+	reaper := NewReaper(run, c.cloudProviders)
+	poller := NewPoller(run, c.cloudProviders)
+	poller.Metrics = c.metrics
+	poller.Notifier = c.notifier
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Pick up changes made by other invocations since the last run.
+		if err := c.db.Reload(); err != nil {
+			return err
+		}
+		clone, err := c.db.clone()
+		if err != nil {
+			return err
+		}
+		*run = *clone
+
+		now := c.now()
+		transitions := poller.Run(now)
+		var actions []Action
+		actions = append(actions, scheduler.Run(now)...)
+		actions = append(actions, idleMonitor.Run(now)...)
+		actions = append(actions, reaper.Run(now)...)
+		leases := endedLeases(c.db, run)
+
+		// The actions are saved first, so that they are not performed again
+		// by the next run if reporting them fails.
+		err = c.db.Update(ctx, func() error {
+			for _, transition := range transitions {
+				c.db.ObserveState(transition)
+			}
+			for _, action := range actions {
+				c.db.RecordAction(action)
+			}
+			for name, expiry := range leases {
+				// Unless it was extended during the run.
+				if instance, exists := c.db.Instances[name]; exists && instance.LeaseExpiry != nil && instance.LeaseExpiry.Equal(expiry) {
+					_ = c.db.SetLease(name, nil)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, action := range actions {
+			if err := c.reportAction(action); err != nil {
+				c.logger.Error("report action failed", "instance", action.Instance, "action", action.Action, "error", err)
+			}
+		}
+		c.logger.Debug("daemon run complete", "actions", len(actions))
+
+		if once {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// endedLeases returns the expiries of the leases of db ended by the reaper
+// in run, a copy of db.
+func endedLeases(db, run *Database) map[string]time.Time {
+	leases := map[string]time.Time{}
+	for name, instance := range db.Instances {
+		if instance.LeaseExpiry != nil && run.Instances[name].LeaseExpiry == nil {
+			leases[name] = *instance.LeaseExpiry
+		}
+	}
+	return leases
+}
+
+// reportAction prints an action performed by an automated source, records it
+// in the audit log and notifies the webhooks.
+func (c *CLI) reportAction(action Action) error {
+	fmt.Fprintln(c.out, action)
+	c.notifier.Notify(ActionEvent(action, c.db.Instances[action.Instance]), c.db.Webhooks)
+	return c.auditAction(action)
+}
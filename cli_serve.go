@@ -0,0 +1,146 @@
+package instances
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func (c *CLI) serve(args []string) error {
+	var addr, authConfigPath, certFile, keyFile, clientCAFile string
+	var refresh, pollInterval time.Duration
+	serveCmd := flag.NewFlagSet("serve", flag.ContinueOnError)
+	serveCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances serve [OPTIONS]\n\n",
+			"Serve the REST API exposing the tracked instances and their lifecycle operations,\n",
+			"and a web dashboard to operate them\n\n",
+		)
+		serveCmd.PrintDefaults()
+	}
+	serveCmd.StringVar(&addr, "addr", "localhost:8080", "the address to listen on")
+	serveCmd.StringVar(&authConfigPath, "auth-config", "", "a JSON file declaring the principals allowed to use the API (by default, requests are not authenticated)")
+	serveCmd.StringVar(&certFile, "tls-cert", "", "the TLS certificate of the server")
+	serveCmd.StringVar(&keyFile, "tls-key", "", "the TLS private key of the server")
+	serveCmd.StringVar(&clientCAFile, "client-ca", "", "the CA certificates verifying client certificates (requires --tls-cert)")
+	serveCmd.DurationVar(&refresh, "refresh", 5*time.Second, "how often the dashboard picks up the changes of the instances")
+	serveCmd.DurationVar(&pollInterval, "poll-interval", time.Minute, "how often the state of the instances shown by the dashboard and exported at /metrics is polled")
+
+	err := serveCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(serveCmd.Args()) > 0 {
+		return errors.New("serve doesn't take positional arguments")
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("--tls-cert and --tls-key must be provided together")
+	}
+	if clientCAFile != "" && certFile == "" {
+		return errors.New("--client-ca requires --tls-cert")
+	}
+
+	if refresh <= 0 {
+		return errors.New("refresh interval must be positive")
+	}
+	if pollInterval <= 0 {
+		return errors.New("poll interval must be positive")
+	}
+
+	opts := []ServerOption{WithRefreshInterval(refresh), WithServerMetrics(c.metrics), WithServerLogger(c.logger)}
+	if c.auditLog != nil {
+		opts = append(opts, WithServerAuditLog(c.auditLog))
+	}
+	if authConfigPath != "" {
+		f, err := os.Open(authConfigPath)
+		if err != nil {
+			return err
+		}
+		authConfig, err := LoadAuthConfig(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithAuthConfig(authConfig))
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           NewServer(c.manager, opts...),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", clientCAFile)
+		}
+		// Clients without certificates can still authenticate with a token.
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	poller := c.manager.NewPoller()
+	poller.Metrics = c.metrics
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			// The transitions are saved with the changes made by the other
+			// processes since the last poll, which are picked up.
+			transitions := poller.Run(c.now())
+			err := c.manager.Update(ctx, func() error {
+				c.manager.ObserveStates(transitions)
+				return nil
+			})
+			if err != nil {
+				c.logger.Error("save polled states failed", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			errs <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+	fmt.Fprintf(c.out, "serving on %s\n", addr)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
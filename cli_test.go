@@ -1,15 +1,24 @@
 package instances_test
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
 )
 
 func TestCLI(t *testing.T) {
 	t.Parallel()
 	tests := map[string]struct {
-		args    []string
+		args []string
+		// state is the state of the instance existingInstanceName, running if
+		// empty.
+		state   instances.InstanceState
 		wantErr string
 	}{
 		"no subcommand": {
@@ -68,6 +77,90 @@ func TestCLI(t *testing.T) {
 			args:    []string{"rm", "--option", "value"},
 			wantErr: "flag provided but not defined",
 		},
+		"rename - existing instance": {
+			args:    []string{"rename", existingInstanceName, "renamed"},
+			wantErr: "",
+		},
+		"rename - existing new name": {
+			args:    []string{"rename", existingInstanceName, existingInstanceName},
+			wantErr: "exists already",
+		},
+		"rename - nonexisting instance": {
+			args:    []string{"rename", "anInstance", "renamed"},
+			wantErr: "no instance named",
+		},
+		"rename - missing new name": {
+			args:    []string{"rename", existingInstanceName},
+			wantErr: "rename takes the instance name and the new name",
+		},
+		"edit - new instance id": {
+			args:    []string{"edit", "--id", existingInstanceIds[1], existingInstanceName},
+			wantErr: "",
+		},
+		"edit - nonexisting instance id": {
+			args:    []string{"edit", "--id", "anInstanceId", existingInstanceName},
+			wantErr: "not found in mock",
+		},
+		"edit - nonexisting cloud provider": {
+			args:    []string{"edit", "--cloud", "myGreatCloud", existingInstanceName},
+			wantErr: "unsupported cloud provider",
+		},
+		"edit - nonexisting instance": {
+			args:    []string{"edit", "--id", existingInstanceIds[1], "anInstance"},
+			wantErr: "no instance named",
+		},
+		"edit - no changes": {
+			args:    []string{"edit", existingInstanceName},
+			wantErr: "missing --id or --cloud",
+		},
+		"add - invalid expiry": {
+			args:    []string{"add", "--name", "testInstance", "--cloud", "mock", "--expires", "someday", existingInstanceIds[1]},
+			wantErr: "invalid expiry",
+		},
+		"annotate - existing instance": {
+			args:    []string{"annotate", "--owner", "alice", "--expires", "2024-12-31", existingInstanceName},
+			wantErr: "",
+		},
+		"annotate - nonexisting instance": {
+			args:    []string{"annotate", "--owner", "alice", "anInstance"},
+			wantErr: "no instance named",
+		},
+		"annotate - no annotations": {
+			args:    []string{"annotate", existingInstanceName},
+			wantErr: "missing --owner, --description, --notes or --expires",
+		},
+		"annotate - invalid expiry": {
+			args:    []string{"annotate", "--expires", "someday", existingInstanceName},
+			wantErr: "invalid expiry",
+		},
+		"describe - existing instance": {
+			args:    []string{"describe", existingInstanceName},
+			wantErr: "",
+		},
+		"describe - nonexisting instance": {
+			args:    []string{"describe", "anInstance"},
+			wantErr: "no instance named",
+		},
+		"describe - no arguments": {
+			args:    []string{"describe"},
+			wantErr: "missing instance name",
+		},
+		"protect - existing instance": {
+			args:    []string{"protect", existingInstanceName},
+			wantErr: "",
+		},
+		"protect - nonexisting instance": {
+			args:    []string{"protect", "anInstance"},
+			wantErr: "no instance named",
+		},
+		"protect - group": {
+			args:    []string{"protect", "--group", "prod"},
+			wantErr: "",
+		},
+		"protect - no arguments": {
+			args:    []string{"protect"},
+			wantErr: "missing instance name",
+		},
 		"status - existing instance": {
 			args:    []string{"status", existingInstanceName},
 			wantErr: "",
@@ -86,8 +179,13 @@ func TestCLI(t *testing.T) {
 		},
 		"start - existing instance": {
 			args:    []string{"start", existingInstanceName},
+			state:   instances.InstanceStateStopped,
 			wantErr: "",
 		},
+		"start - running instance": {
+			args:    []string{"start", existingInstanceName},
+			wantErr: "running already",
+		},
 		"start - nonexisting instance": {
 			args:    []string{"start", "anInstance"},
 			wantErr: "no instance named",
@@ -100,10 +198,37 @@ func TestCLI(t *testing.T) {
 			args:    []string{"start", "--option", "value"},
 			wantErr: "flag provided but not defined",
 		},
+		"start - with lease": {
+			args:    []string{"start", "--for", "2h", existingInstanceName},
+			state:   instances.InstanceStateStopped,
+			wantErr: "",
+		},
+		"start - with lease in days": {
+			args:    []string{"start", "--for", "1d", existingInstanceName},
+			state:   instances.InstanceStateStopped,
+			wantErr: "",
+		},
+		"start - zero lease": {
+			args:    []string{"start", "--for", "0d", existingInstanceName},
+			wantErr: "must be positive",
+		},
+		"history - negative since": {
+			args:    []string{"history", "--since", "-3d"},
+			wantErr: "must be positive",
+		},
+		"start - invalid lease": {
+			args:    []string{"start", "--for", "soon", existingInstanceName},
+			wantErr: "invalid duration",
+		},
 		"stop - existing instance": {
 			args:    []string{"stop", existingInstanceName},
 			wantErr: "",
 		},
+		"stop - stopped instance": {
+			args:    []string{"stop", existingInstanceName},
+			state:   instances.InstanceStateStopped,
+			wantErr: "not running",
+		},
 		"stop - nonexisting instance": {
 			args:    []string{"stop", "anInstance"},
 			wantErr: "no instance named",
@@ -116,6 +241,23 @@ func TestCLI(t *testing.T) {
 			args:    []string{"stop", "--option", "value"},
 			wantErr: "flag provided but not defined",
 		},
+		"reboot - existing instance": {
+			args:    []string{"reboot", existingInstanceName},
+			wantErr: "",
+		},
+		"reboot - stopped instance": {
+			args:    []string{"reboot", existingInstanceName},
+			state:   instances.InstanceStateStopped,
+			wantErr: "not running",
+		},
+		"reboot - nonexisting instance": {
+			args:    []string{"reboot", "anInstance"},
+			wantErr: "no instance named",
+		},
+		"reboot - no arguments": {
+			args:    []string{"reboot"},
+			wantErr: "missing instance name",
+		},
 		"list - no arguments": {
 			args:    []string{"list"},
 			wantErr: "",
@@ -128,10 +270,246 @@ func TestCLI(t *testing.T) {
 			args:    []string{"list", "--option", "value"},
 			wantErr: "flag provided but not defined",
 		},
+		"list - status": {
+			args:    []string{"list", "--status"},
+			wantErr: "",
+		},
 		"list - valid options": {
 			args:    []string{"list", "--cloud", "mock"},
 			wantErr: "",
 		},
+		"add - with group": {
+			args:    []string{"add", "--name", "testInstance", "--cloud", "mock", "--group", "dev", existingInstanceIds[1]},
+			wantErr: "",
+		},
+		"schedule - no command": {
+			args:    []string{"schedule"},
+			wantErr: "missing schedule command",
+		},
+		"schedule - unknown command": {
+			args:    []string{"schedule", "johndoe"},
+			wantErr: "unknown schedule command",
+		},
+		"schedule add - valid schedule": {
+			args:    []string{"schedule", "add", "--instance", existingInstanceName, "--start", "0 8 * * 1-5", "--stop", "0 19 * * 1-5", "--tz", "UTC", "office-hours"},
+			wantErr: "",
+		},
+		"schedule add - no name": {
+			args:    []string{"schedule", "add", "--instance", existingInstanceName, "--start", "0 8 * * 1-5"},
+			wantErr: "missing schedule name",
+		},
+		"schedule add - invalid expression": {
+			args:    []string{"schedule", "add", "--group", "dev", "--start", "8am", "office-hours"},
+			wantErr: "expected 5 fields",
+		},
+		"schedule rm - nonexisting schedule": {
+			args:    []string{"schedule", "rm", "aSchedule"},
+			wantErr: "no schedule named",
+		},
+		"schedule list - no arguments": {
+			args:    []string{"schedule", "list"},
+			wantErr: "",
+		},
+		"override - existing instance": {
+			args:    []string{"override", "--for", "4h", existingInstanceName},
+			wantErr: "",
+		},
+		"override - clear": {
+			args:    []string{"override", "--clear", existingInstanceName},
+			wantErr: "",
+		},
+		"override - nonexisting instance": {
+			args:    []string{"override", "anInstance"},
+			wantErr: "no instance named",
+		},
+		"extend - no lease": {
+			args:    []string{"extend", existingInstanceName, "1h"},
+			wantErr: "has no lease",
+		},
+		"extend - missing duration": {
+			args:    []string{"extend", existingInstanceName},
+			wantErr: "an instance name and a duration",
+		},
+		"extend - invalid duration": {
+			args:    []string{"extend", existingInstanceName, "1 hour"},
+			wantErr: "invalid duration",
+		},
+		"reap - no arguments": {
+			args:    []string{"reap"},
+			wantErr: "",
+		},
+		"reap - arguments": {
+			args:    []string{"reap", existingInstanceName},
+			wantErr: "doesn't take positional arguments",
+		},
+		"report - no arguments": {
+			args:    []string{"report"},
+			wantErr: "",
+		},
+		"report - valid options": {
+			args:    []string{"report", "--since", "7d", "--group", "dev"},
+			wantErr: "",
+		},
+		"report - invalid period": {
+			args:    []string{"report", "--since", "last month"},
+			wantErr: "invalid duration",
+		},
+		"report - nonexisting price table": {
+			args:    []string{"report", "--pricing", "/nonexisting/prices.json"},
+			wantErr: "no such file",
+		},
+		"history - no arguments": {
+			args:    []string{"history"},
+			wantErr: "",
+		},
+		"history - valid options": {
+			args:    []string{"history", "--since", "7d", "--command", "stop", "--limit", "10", "--json", existingInstanceName},
+			wantErr: "",
+		},
+		"history - multiple instances": {
+			args:    []string{"history", "anInstance", "anotherInstance"},
+			wantErr: "only one instance",
+		},
+		"serve - arguments": {
+			args:    []string{"serve", "now"},
+			wantErr: "doesn't take positional arguments",
+		},
+		"serve - TLS key without certificate": {
+			args:    []string{"serve", "--tls-key", "server.key"},
+			wantErr: "must be provided together",
+		},
+		"serve - invalid refresh interval": {
+			args:    []string{"serve", "--refresh", "0s"},
+			wantErr: "refresh interval must be positive",
+		},
+		"serve - invalid poll interval": {
+			args:    []string{"serve", "--poll-interval", "-1m"},
+			wantErr: "poll interval must be positive",
+		},
+		"serve - client CA without TLS": {
+			args:    []string{"serve", "--client-ca", "ca.pem"},
+			wantErr: "requires --tls-cert",
+		},
+		"add - with tags": {
+			args:    []string{"add", "--name", "testInstance", "--cloud", "mock", "--tag", "team=web", "--tag", "env=dev", existingInstanceIds[1]},
+			wantErr: "",
+		},
+		"add - invalid tag": {
+			args:    []string{"add", "--name", "testInstance", "--cloud", "mock", "--tag", "web", existingInstanceIds[1]},
+			wantErr: "expected KEY=VALUE",
+		},
+		"webhook - no command": {
+			args:    []string{"webhook"},
+			wantErr: "missing webhook command",
+		},
+		"webhook add - valid webhook": {
+			args:    []string{"webhook", "add", "--url", "https://chat.example.com/hook", "--event", "state-change", "--group", "prod", "--unexpected-only", "ops"},
+			wantErr: "",
+		},
+		"webhook add - invalid URL": {
+			args:    []string{"webhook", "add", "--url", "chat", "ops"},
+			wantErr: "invalid webhook URL",
+		},
+		"webhook add - unknown event": {
+			args:    []string{"webhook", "add", "--url", "https://chat.example.com/hook", "--event", "explosion", "ops"},
+			wantErr: "unknown event type",
+		},
+		"webhook add - missing template file": {
+			args:    []string{"webhook", "add", "--url", "https://chat.example.com/hook", "--template-file", "iDontExist.tmpl", "ops"},
+			wantErr: "no such file",
+		},
+		"webhook rm - nonexisting webhook": {
+			args:    []string{"webhook", "rm", "ops"},
+			wantErr: "no webhook named",
+		},
+		"webhook test - nonexisting webhook": {
+			args:    []string{"webhook", "test", "ops"},
+			wantErr: "no webhook named",
+		},
+		"webhook list": {
+			args:    []string{"webhook", "list"},
+			wantErr: "",
+		},
+		"watch - until running": {
+			args:    []string{"watch", "--until", "running", existingInstanceName},
+			wantErr: "",
+		},
+		"watch - unknown until state": {
+			args:    []string{"watch", "--until", "runing", existingInstanceName},
+			wantErr: `invalid state "runing" for --until`,
+		},
+		"watch - nonexisting instance": {
+			args:    []string{"watch", "anInstance"},
+			wantErr: "no instance named",
+		},
+		"watch - timeout without until": {
+			args:    []string{"watch", "--timeout", "1m"},
+			wantErr: "--timeout requires --until",
+		},
+		"watch - invalid interval": {
+			args:    []string{"watch", "--interval", "0s"},
+			wantErr: "interval must be positive",
+		},
+		"watch - empty group": {
+			args:    []string{"watch", "--group", "iDontExist"},
+			wantErr: "no instance to watch",
+		},
+		"autostop - no command": {
+			args:    []string{"autostop"},
+			wantErr: "missing autostop command",
+		},
+		"autostop set - existing instance": {
+			args:    []string{"autostop", "set", "--cpu", "10", "--after", "30m", existingInstanceName},
+			wantErr: "",
+		},
+		"autostop set - default": {
+			args:    []string{"autostop", "set", "--default"},
+			wantErr: "",
+		},
+		"autostop set - default allowing protected instances": {
+			args:    []string{"autostop", "set", "--default", "--allow-protected"},
+			wantErr: "the default policy can't stop protected instances",
+		},
+		"autostop set - default and instance": {
+			args:    []string{"autostop", "set", "--default", existingInstanceName},
+			wantErr: "no instance name can be provided",
+		},
+		"autostop set - no arguments": {
+			args:    []string{"autostop", "set"},
+			wantErr: "missing instance name",
+		},
+		"autostop set - invalid threshold": {
+			args:    []string{"autostop", "set", "--cpu", "0", existingInstanceName},
+			wantErr: "CPU threshold",
+		},
+		"autostop rm - default": {
+			args:    []string{"autostop", "rm", "--default"},
+			wantErr: "",
+		},
+		"autostop opt-out - existing instance": {
+			args:    []string{"autostop", "opt-out", existingInstanceName},
+			wantErr: "",
+		},
+		"autostop opt-in - nonexisting instance": {
+			args:    []string{"autostop", "opt-in", "anInstance"},
+			wantErr: "no instance named",
+		},
+		"autostop list - no arguments": {
+			args:    []string{"autostop", "list"},
+			wantErr: "",
+		},
+		"daemon - once": {
+			args:    []string{"daemon", "--once"},
+			wantErr: "",
+		},
+		"daemon - invalid interval": {
+			args:    []string{"daemon", "--interval", "0s"},
+			wantErr: "interval must be positive",
+		},
+		"daemon - arguments": {
+			args:    []string{"daemon", "now"},
+			wantErr: "doesn't take positional arguments",
+		},
 	}
 
 	for name, test := range tests {
@@ -141,11 +519,15 @@ func TestCLI(t *testing.T) {
 				t.Fatalf("test setup failed: %v", err)
 			}
 
-			cloudProviders := map[string]instances.CloudProvider{
-				"mock": MockCloudProvider{},
+			cloud := newTestCloud()
+			if test.state != "" {
+				cloud.AddInstance(existingInstanceIds[0], test.state, instances.InstanceDetails{})
 			}
 
-			cli := instances.NewCLI(db, cloudProviders)
+			cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": cloud},
+				instances.WithOutput(io.Discard),
+				instances.WithAuditLog(&instances.MemoryAuditLog{}),
+			)
 
 			err = cli.Run(test.args)
 			if !errorContains(err, test.wantErr) {
@@ -154,3 +536,237 @@ func TestCLI(t *testing.T) {
 		})
 	}
 }
+
+func TestCLIInstanceMetadata(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": newTestCloud()},
+		instances.WithOutput(&out),
+		instances.WithClock(func() time.Time { return now }),
+		instances.WithUser("alice", "laptop"),
+	)
+
+	commands := [][]string{
+		{"add", "--name", "devBox", "--cloud", "mock", "--description", "CI runner", "--expires", "30d", existingInstanceIds[1]},
+		{"annotate", "--owner", "bob", "--notes", "Keep until the migration.\nAsk bob first.", "--expires", "2024-05-31", existingInstanceName},
+	}
+	for _, args := range commands {
+		if err := cli.Run(args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+
+	tests := map[string]struct {
+		args []string
+		want string
+	}{
+		"list my instances": {
+			args: []string{"list", "--owner", "me"},
+			want: "name: devBox\tid: existingInstance2\tcloud provider: mock\towner: alice\tdescription: CI runner\texpires: 2024-07-01T12:00:00Z\n",
+		},
+		"list expired instances": {
+			args: []string{"list", "--expired"},
+			want: "name: myInstance\tid: existingInstance1\tcloud provider: mock\towner: bob\texpires: 2024-05-31T00:00:00Z (expired)\n",
+		},
+		"list expired instances of an owner": {
+			args: []string{"list", "--owner", "alice", "--expired"},
+			want: "",
+		},
+		"describe": {
+			args: []string{"describe", "devBox"},
+			want: "name: devBox\nid: existingInstance2\ncloud provider: mock\nowner: alice\ndescription: CI runner\n" +
+				"created at: 2024-06-01T12:00:00Z\nexpires: 2024-07-01T12:00:00Z\n",
+		},
+		"describe notes": {
+			args: []string{"describe", existingInstanceName},
+			want: "name: myInstance\nid: existingInstance1\ncloud provider: mock\nowner: bob\nexpires: 2024-05-31T00:00:00Z (expired)\n" +
+				"notes:\n  Keep until the migration.\n  Ask bob first.\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			out.Reset()
+			if err := cli.Run(test.args); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != test.want {
+				t.Errorf("got output\n%q\nwant\n%q", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestCLIProtection(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		args []string
+		// confirmation is typed by the user, if the CLI is interactive.
+		confirmation *string
+		wantErr      error
+		wantCalls    []string
+	}{
+		"stop protected": {
+			args:    []string{"stop", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"stop protected, sure": {
+			args:      []string{"stop", "--yes-i-am-sure", "vault"},
+			wantCalls: []string{"stop id1"},
+		},
+		"stop protected, confirmed": {
+			args:         []string{"stop", "vault"},
+			confirmation: ptr("vault\n"),
+			wantCalls:    []string{"stop id1"},
+		},
+		"stop protected, wrong confirmation": {
+			args:         []string{"stop", "vault"},
+			confirmation: ptr("vualt\n"),
+			wantErr:      instances.ErrPermissionDenied,
+		},
+		"stop protected, no confirmation": {
+			args:         []string{"stop", "vault"},
+			confirmation: ptr(""),
+			wantErr:      instances.ErrPermissionDenied,
+		},
+		"stop in protected group": {
+			args:    []string{"stop", "prodBox"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"stop unprotected": {
+			args:      []string{"stop", "devBox"},
+			wantCalls: []string{"stop id3"},
+		},
+		"start protected": {
+			args:    []string{"start", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"reboot protected": {
+			args:    []string{"reboot", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"remove protected": {
+			args:    []string{"rm", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"rename protected": {
+			args:    []string{"rename", "vault", "safe"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"edit protected": {
+			args:    []string{"edit", "--id", "id3", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"unprotect": {
+			args:    []string{"protect", "--off", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"unprotect, sure": {
+			args: []string{"protect", "--off", "--yes-i-am-sure", "vault"},
+		},
+		"unprotect group": {
+			args:    []string{"protect", "--group", "--off", "prod"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"unprotect group, confirmed": {
+			args:         []string{"protect", "--group", "--off", "prod"},
+			confirmation: ptr("prod\n"),
+		},
+		"annotate protected": {
+			args:    []string{"annotate", "--owner", "alice", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"annotate protected, sure": {
+			args: []string{"annotate", "--owner", "alice", "--yes-i-am-sure", "vault"},
+		},
+		"schedule protected": {
+			args: []string{"schedule", "add", "--instance", "vault", "--stop", "0 19 * * *", "nightly"},
+		},
+		"schedule protected, allowed": {
+			args:    []string{"schedule", "add", "--instance", "vault", "--stop", "0 19 * * *", "--allow-protected", "nightly"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"schedule protected, allowed and sure": {
+			args: []string{"schedule", "add", "--instance", "vault", "--stop", "0 19 * * *", "--allow-protected", "--yes-i-am-sure", "nightly"},
+		},
+		"schedule protected group, allowed": {
+			args:    []string{"schedule", "add", "--group", "prod", "--stop", "0 19 * * *", "--allow-protected", "nightly"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"schedule unprotected group, allowed": {
+			args: []string{"schedule", "add", "--group", "dev", "--stop", "0 19 * * *", "--allow-protected", "nightly"},
+		},
+		"autostop protected, allowed": {
+			args:    []string{"autostop", "set", "--allow-protected", "vault"},
+			wantErr: instances.ErrPermissionDenied,
+		},
+		"autostop protected, allowed and confirmed": {
+			args:         []string{"autostop", "set", "--allow-protected", "vault"},
+			confirmation: ptr("vault\n"),
+		},
+		"start protected with a lease": {
+			args:    []string{"start", "--for", "2h", "--yes-i-am-sure", "vault"},
+			wantErr: instances.ErrInvalidState,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := instances.NewDatabase(bytes.NewBufferString(`{"instances": {}}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider := fakecloud.New(fakecloud.WithName("mock"))
+			provider.AddInstance("id1", instances.InstanceStateRunning, instances.InstanceDetails{})
+			provider.AddInstance("id2", instances.InstanceStateRunning, instances.InstanceDetails{})
+			provider.AddInstance("id3", instances.InstanceStateRunning, instances.InstanceDetails{})
+			manager := instances.NewManager(db, map[string]instances.CloudProvider{"mock": provider}, time.Now)
+			for id, instance := range map[string]struct {
+				name string
+				opts instances.InstanceOptions
+			}{
+				"id1": {name: "vault", opts: instances.InstanceOptions{Protected: true}},
+				"id2": {name: "prodBox", opts: instances.InstanceOptions{Group: "prod"}},
+				"id3": {name: "devBox", opts: instances.InstanceOptions{Group: "dev"}},
+			} {
+				if _, err := manager.AddInstance(id, instance.name, "mock", instance.opts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SetGroupProtected("prod", true); err != nil {
+				t.Fatal(err)
+			}
+
+			var prompt bytes.Buffer
+			opts := []instances.CLIOption{instances.WithOutput(io.Discard)}
+			if test.confirmation != nil {
+				opts = append(opts, instances.WithConfirmations(strings.NewReader(*test.confirmation), &prompt))
+			}
+			cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": provider}, opts...)
+
+			err = cli.Run(test.args)
+			if test.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if test.confirmation != nil && !strings.Contains(prompt.String(), "is protected. Type") {
+				t.Errorf("unexpected prompt %q", prompt.String())
+			}
+			if calls := stateCalls(provider); strings.Join(calls, ", ") != strings.Join(test.wantCalls, ", ") {
+				t.Errorf("got calls %v, want %v", calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,192 @@
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// watchEvent is a state transition of a watched instance, or a change of the
+// error getting its state.
+type watchEvent struct {
+	Time     time.Time     `json:"time"`
+	Instance string        `json:"instance"`
+	State    InstanceState `json:"state,omitempty"`
+	Previous InstanceState `json:"previous,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (c *CLI) watch(args []string) error {
+	var interval, timeout time.Duration
+	var asJSON bool
+	var until, group string
+	watchCmd := flag.NewFlagSet("watch", flag.ContinueOnError)
+	watchCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances watch [OPTIONS] [INSTANCE_NAME...]\n\n",
+			"Poll the instances INSTANCE_NAME (by default, all of them) and print their state transitions\n\n",
+			"Example: instances watch --until running --timeout 10m web-1 web-2\n\n",
+		)
+		watchCmd.PrintDefaults()
+	}
+	watchCmd.DurationVar(&interval, "interval", 5*time.Second, "how often the instances are polled")
+	watchCmd.BoolVar(&asJSON, "json", c.outputFormat == "json", "print the transitions as JSON lines instead of a table")
+	watchCmd.StringVar(&until, "until", "", "exit once all the instances are in this state")
+	watchCmd.StringVar(&group, "group", "", "watch the instances of this group")
+	watchCmd.DurationVar(&timeout, "timeout", 0, "exit with an error if the instances aren't in the --until state after this duration")
+
+	err := watchCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if timeout != 0 && until == "" {
+		return errors.New("--timeout requires --until")
+	}
+	if until != "" && !slices.Contains(instanceStates, InstanceState(until)) {
+		return fmt.Errorf("invalid state %q for --until, expected one of %s", until, joinStates(instanceStates))
+	}
+
+	names := watchCmd.Args()
+	if len(names) > 0 && group != "" {
+		return errors.New("--group and instance names are mutually exclusive")
+	}
+	for _, name := range names {
+		if _, err := c.manager.Instance(name); err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		for _, instance := range c.manager.Instances() {
+			if group == "" || instance.Group == group {
+				names = append(names, instance.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("no instance to watch")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	latest := map[string]watchEvent{}
+	encoder := json.NewEncoder(c.out)
+	for {
+		var events []watchEvent
+		for _, name := range names {
+			event := watchEvent{Time: c.now(), Instance: name}
+			event.State, err = c.manager.InstanceStatus(name)
+			if err != nil {
+				event.Error = err.Error()
+			}
+
+			previous, known := latest[name]
+			if known && previous.State == event.State && previous.Error == event.Error {
+				continue
+			}
+			event.Previous = previous.State
+			latest[name] = event
+			events = append(events, event)
+		}
+
+		if asJSON {
+			for _, event := range events {
+				if err := encoder.Encode(event); err != nil {
+					return err
+				}
+			}
+		} else if len(events) > 0 {
+			if err := c.printWatchTable(names, latest); err != nil {
+				return err
+			}
+		}
+
+		if until != "" && allInState(names, latest, InstanceState(until)) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("timed out waiting for the instances to be %s", until)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// printWatchTable prints the latest states of the watched instances, after
+// clearing the screen when printing to a terminal.
+func (c *CLI) printWatchTable(names []string, latest map[string]watchEvent) error {
+	if isTerminal(c.out) {
+		fmt.Fprint(c.out, "\033[H\033[2J")
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tSTATE\tSINCE")
+	for _, name := range names {
+		event := latest[name]
+		state := string(event.State)
+		if event.Error != "" {
+			state = "error: " + event.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, state, event.Time.Format(time.RFC3339))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if !isTerminal(c.out) {
+		fmt.Fprintln(c.out)
+	}
+	return nil
+}
+
+// joinStates returns the states separated by commas.
+func joinStates(states []InstanceState) string {
+	names := make([]string, len(states))
+	for i, state := range states {
+		names[i] = string(state)
+	}
+	return strings.Join(names, ", ")
+}
+
+func allInState(names []string, latest map[string]watchEvent, state InstanceState) bool {
+	for _, name := range names {
+		if latest[name].State != state {
+			return false
+		}
+	}
+	return true
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w any) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,199 @@
+package instances
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func (c *CLI) webhook(args []string) error {
+	usage := func() {
+		fmt.Print(
+			"Usage: instances webhook COMMAND\n\n",
+			"Manage the webhooks notified of actions and state changes\n\n",
+			"Commands:\n",
+			"  add     add or replace a webhook\n",
+			"  rm      remove a webhook\n",
+			"  list    list the webhooks\n",
+			"  test    send a test event to a webhook\n",
+		)
+	}
+
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing webhook command")
+	}
+
+	switch args[0] {
+	case "add":
+		return c.addWebhook(args[1:])
+	case "rm":
+		return c.removeWebhook(args[1:])
+	case "list":
+		return c.listWebhooks(args[1:])
+	case "test":
+		return c.testWebhook(args[1:])
+	default:
+		usage()
+		return fmt.Errorf("unknown webhook command %q", args[0])
+	}
+}
+
+func (c *CLI) addWebhook(args []string) error {
+	var webhook Webhook
+	var templateFile string
+	var events, instances, groups, states stringsFlag
+	addCmd := flag.NewFlagSet("webhook add", flag.ContinueOnError)
+	addCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances webhook add [OPTIONS] WEBHOOK_NAME\n\n",
+			"Add the webhook WEBHOOK_NAME, replacing any webhook with the same name\n\n",
+			"Example: instances webhook add --url https://chat.example.com/hooks/ops --group prod --event state-change --unexpected-only ops\n\n",
+		)
+		addCmd.PrintDefaults()
+	}
+	addCmd.StringVar(&webhook.URL, "url", "", "the URL the events are posted to")
+	addCmd.StringVar(&webhook.Secret, "secret", "", "the key signing the payloads with HMAC-SHA256")
+	addCmd.StringVar(&templateFile, "template-file", "", "a file with the text/template rendering the JSON payload from the event (by default, the event itself)")
+	addCmd.Var(&events, "event", "only notify events of this type, action or state-change (can be repeated)")
+	addCmd.Var(&instances, "instance", "only notify events of this instance (can be repeated)")
+	addCmd.Var(&groups, "group", "only notify events of the instances of this group (can be repeated)")
+	addCmd.Var(&states, "state", "only notify state changes to this state (can be repeated)")
+	addCmd.BoolVar(&webhook.UnexpectedOnly, "unexpected-only", false, "only notify the state changes no recent action explains")
+
+	name, err := parseName(addCmd, args, "webhook")
+	if err != nil {
+		return err
+	}
+
+	if templateFile != "" {
+		template, err := os.ReadFile(templateFile)
+		if err != nil {
+			return err
+		}
+		webhook.Template = string(template)
+	}
+	for _, event := range events {
+		webhook.Events = append(webhook.Events, EventType(event))
+	}
+	webhook.Instances = instances
+	webhook.Groups = groups
+	for _, state := range states {
+		webhook.States = append(webhook.States, InstanceState(state))
+	}
+
+	return c.audited(name, func() (string, error) {
+		return "", c.db.AddWebhook(name, webhook)
+	})
+}
+
+func (c *CLI) removeWebhook(args []string) error {
+	removeCmd := flag.NewFlagSet("webhook rm", flag.ContinueOnError)
+	removeCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances webhook rm WEBHOOK_NAME\n\n",
+			"Remove the webhook WEBHOOK_NAME\n\n",
+		)
+		removeCmd.PrintDefaults()
+	}
+
+	name, err := parseName(removeCmd, args, "webhook")
+	if err != nil {
+		return err
+	}
+
+	return c.audited(name, func() (string, error) {
+		return "", c.db.RemoveWebhook(name)
+	})
+}
+
+func (c *CLI) listWebhooks(args []string) error {
+	listCmd := flag.NewFlagSet("webhook list", flag.ContinueOnError)
+	listCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances webhook list\n\n",
+			"List the webhooks\n\n",
+		)
+	}
+
+	err := listCmd.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if len(listCmd.Args()) > 0 {
+		return errors.New("webhook list doesn't take positional arguments")
+	}
+
+	for _, name := range sortedKeys(c.db.Webhooks) {
+		webhook := c.db.Webhooks[name]
+		fmt.Fprintf(c.out, "name: %s\turl: %s", name, webhook.URL)
+		var filters []string
+		for _, event := range webhook.Events {
+			filters = append(filters, "event="+string(event))
+		}
+		for _, instance := range webhook.Instances {
+			filters = append(filters, "instance="+instance)
+		}
+		for _, group := range webhook.Groups {
+			filters = append(filters, "group="+group)
+		}
+		for _, state := range webhook.States {
+			filters = append(filters, "state="+string(state))
+		}
+		if webhook.UnexpectedOnly {
+			filters = append(filters, "unexpected-only")
+		}
+		if len(filters) > 0 {
+			fmt.Fprintf(c.out, "\tfilters: %s", strings.Join(filters, ","))
+		}
+		if webhook.Secret != "" {
+			fmt.Fprint(c.out, "\tsigned")
+		}
+		fmt.Fprintln(c.out)
+	}
+
+	return nil
+}
+
+func (c *CLI) testWebhook(args []string) error {
+	testCmd := flag.NewFlagSet("webhook test", flag.ContinueOnError)
+	testCmd.Usage = func() {
+		fmt.Print(
+			"Usage: instances webhook test WEBHOOK_NAME\n\n",
+			"Send a test event to the webhook WEBHOOK_NAME\n\n",
+		)
+		testCmd.PrintDefaults()
+	}
+
+	name, err := parseName(testCmd, args, "webhook")
+	if err != nil {
+		return err
+	}
+
+	webhook, exists := c.db.Webhooks[name]
+	if !exists {
+		return Errorf(ErrNotFound, "no webhook named %s", name)
+	}
+
+	event := Event{Type: EventTest, Time: c.now(), Message: "test event"}
+	if err := c.notifier.Deliver(webhook, event); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "test event delivered to %s\n", webhook.URL)
+	return nil
+}
+
+// stringsFlag is a flag.Value accumulating the values of a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -1,6 +1,10 @@
 package instances
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 type CloudProvider interface {
 	StartInstance(id string) error
@@ -9,34 +13,93 @@ type CloudProvider interface {
 	GetName() string
 }
 
-type MockAWSCloud struct {
+// MetricsProvider is implemented by cloud providers able to report the
+// utilization of their instances.
+type MetricsProvider interface {
+	// GetCPUUtilization returns the CPU utilization samples, in percent, of
+	// an instance between start and end.
+	GetCPUUtilization(id string, start, end time.Time) ([]MetricSample, error)
 }
 
-func (m MockAWSCloud) StartInstance(id string) error {
-	fmt.Println("starting AWS instance ", id)
-	return nil
+// InstanceDescriber is implemented by cloud providers able to give details
+// about their instances.
+type InstanceDescriber interface {
+	DescribeInstance(id string) (InstanceDetails, error)
 }
 
-func (m MockAWSCloud) StopInstance(id string) error {
-	fmt.Println("stopping AWS instance ", id)
-	return nil
+// Rebooter is implemented by cloud providers able to reboot their instances.
+type Rebooter interface {
+	RebootInstance(id string) error
 }
 
-func (m MockAWSCloud) GetInstanceStatus(id string) (InstanceState, error) {
-	switch id {
-	case "NotExist":
-		return "", fmt.Errorf("instance %q not found in the cloud provider", id)
-	case "Running":
-		return InstanceStateRunning, nil
-	case "Stopped":
-		return InstanceStateStopped, nil
+// StateChange is the change of state of an instance caused by a call, as
+// returned by its cloud provider.
+type StateChange struct {
+	Previous InstanceState
+	Current  InstanceState
+}
+
+func (c StateChange) String() string {
+	return fmt.Sprintf("instance %s, was %s", c.Current, c.Previous)
+}
+
+// StateChanger is implemented by cloud providers returning the change of
+// state of the instances they start and stop.
+type StateChanger interface {
+	StartInstanceChange(id string) (StateChange, error)
+	StopInstanceChange(id string) (StateChange, error)
+}
+
+// capability returns the cloud provider as a T, if it supports it. Wrappers
+// of cloud providers (which have an Unwrap method) implement all the optional
+// interfaces, so it is only supported if the innermost provider implements
+// it.
+func capability[T any](cloudProvider CloudProvider) (T, bool) {
+	t, ok := cloudProvider.(T)
+	if !ok {
+		return t, false
+	}
 
-	default:
-		return InstanceStateRunning, nil
+	inner := cloudProvider
+	for {
+		wrapper, ok := inner.(interface{ Unwrap() CloudProvider })
+		if !ok {
+			break
+		}
+		inner = wrapper.Unwrap()
+	}
+	if _, ok := inner.(T); !ok {
+		var zero T
+		return zero, false
+	}
+	return t, true
+}
 
+// ContextBinder is implemented by cloud providers able to make their calls
+// in a context, which is used to trace them as part of an operation.
+type ContextBinder interface {
+	WithContext(ctx context.Context) CloudProvider
+}
+
+// bindContext returns the given cloud providers, bound to ctx when they
+// support it.
+func bindContext(ctx context.Context, cloudProviders map[string]CloudProvider) map[string]CloudProvider {
+	bound := make(map[string]CloudProvider, len(cloudProviders))
+	for name, cloudProvider := range cloudProviders {
+		if binder, ok := cloudProvider.(ContextBinder); ok {
+			cloudProvider = binder.WithContext(ctx)
+		}
+		bound[name] = cloudProvider
 	}
+	return bound
+}
+
+type InstanceDetails struct {
+	Type   string
+	Region string
 }
 
-func (m MockAWSCloud) GetName() string {
-	return "mock-aws"
+type MetricSample struct {
+	Time  time.Time
+	Value float64
 }
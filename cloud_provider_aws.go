@@ -2,94 +2,410 @@ package instances
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type EC2InstanceManager interface {
 	DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error)
 	StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error)
 	StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	RebootInstances(ctx context.Context, params *ec2.RebootInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RebootInstancesOutput, error)
+}
+
+type CloudWatchMetricsGetter interface {
+	GetMetricStatistics(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricStatisticsOutput, error)
 }
 
 type AWSCloud struct {
+	// Name is the name of the provider, "aws" by default.
+	Name      string
 	Ec2Client EC2InstanceManager
+	// CloudWatchClient is optional, it is only needed to get the utilization
+	// metrics of the instances.
+	CloudWatchClient CloudWatchMetricsGetter
+	// Region is the region the clients are configured for.
+	Region string
+	// Metrics, if set, records the calls made to the AWS APIs.
+	Metrics *Metrics
+	// Logger, if set, logs the calls made to the AWS APIs and the state
+	// changes they cause.
+	Logger *slog.Logger
+	// ctx is the context the calls are made in.
+	ctx context.Context
 }
 
-func (a AWSCloud) StartInstance(id string) error {
-	ctx := context.TODO()
-	state, err := a.GetInstanceStatus(id)
-	if err != nil {
-		return err
+// AWSCloudOption configures how NewAWSCloud creates the clients of the AWS
+// APIs.
+type AWSCloudOption func(*awsClientOptions)
+
+type awsClientOptions struct {
+	endpointURL string
+	httpClient  aws.HTTPClient
+}
+
+// WithAWSEndpoint sets the URL of the endpoint called for EC2 and
+// CloudWatch, like the one of an EC2-compatible emulator.
+func WithAWSEndpoint(url string) AWSCloudOption {
+	return func(o *awsClientOptions) {
+		o.endpointURL = url
+	}
+}
+
+// WithAWSHTTPClient sets the HTTP client the calls are sent with, like one
+// replaying recorded interactions in tests.
+func WithAWSHTTPClient(client aws.HTTPClient) AWSCloudOption {
+	return func(o *awsClientOptions) {
+		o.httpClient = client
+	}
+}
+
+// NewAWSCloud returns an AWSCloud calling the EC2 and CloudWatch APIs of the
+// region of cfg.
+func NewAWSCloud(cfg aws.Config, opts ...AWSCloudOption) AWSCloud {
+	var options awsClientOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.httpClient != nil {
+		cfg.HTTPClient = options.httpClient
 	}
 
-	if state == InstanceStateRunning {
-		return fmt.Errorf("instance %q running already", id)
+	return AWSCloud{
+		Ec2Client: ec2.NewFromConfig(cfg, func(o *ec2.Options) {
+			if options.endpointURL != "" {
+				o.EndpointResolver = ec2.EndpointResolverFromURL(options.endpointURL)
+			}
+		}),
+		CloudWatchClient: cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) {
+			if options.endpointURL != "" {
+				o.EndpointResolver = cloudwatch.EndpointResolverFromURL(options.endpointURL)
+			}
+		}),
+		Region: cfg.Region,
 	}
+}
+
+// WithContext returns a copy of the provider making its calls in ctx, so that
+// they are traced as part of the operation of ctx.
+func (a AWSCloud) WithContext(ctx context.Context) CloudProvider {
+	a.ctx = ctx
+	return a
+}
+
+// cloudWatchPeriod is the granularity of the EC2 metrics retrieved from
+// CloudWatch, which is the one of basic monitoring.
+const cloudWatchPeriod = 5 * time.Minute
+
+func (a AWSCloud) StartInstance(id string) error {
+	_, err := a.StartInstanceChange(id)
+	return err
+}
 
+func (a AWSCloud) StartInstanceChange(id string) (StateChange, error) {
+	// Starting a running instance is a no-op for EC2, which tells whether it
+	// was running by the previous state it returns, saving checking it first.
 	runInstance := &ec2.StartInstancesInput{
 		InstanceIds: []string{id},
 	}
-	log.Printf("Start %s", id)
-	if outputStart, errInstance := a.Ec2Client.StartInstances(ctx, runInstance); errInstance != nil {
-		return err
-	} else {
-		log.Println(outputStart.StartingInstances)
+	ctx, done := a.call("EC2", "StartInstances", id)
+	output, err := a.Ec2Client.StartInstances(ctx, runInstance)
+	done(err)
+	if err != nil {
+		return StateChange{}, a.callError("start", id, err)
 	}
 
-	return nil
+	for _, change := range output.StartingInstances {
+		if change.PreviousState != nil && change.PreviousState.Name == ec2types.InstanceStateNameRunning {
+			return StateChange{}, Errorf(ErrInvalidState, "instance %q running already", id)
+		}
+		a.logStateChange("starting instance", change)
+	}
+
+	return stateChange(output.StartingInstances, id), nil
+}
+
+// callError returns the error of a call about an instance, as an
+// ErrNotFound if the instance doesn't exist, or an ErrInvalidState if it was
+// in a state the call isn't possible in.
+func (a AWSCloud) callError(action, id string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed":
+			return Errorf(ErrNotFound, "%s instance %q: %s", action, id, apiErr.ErrorMessage())
+		case "IncorrectInstanceState":
+			return Errorf(ErrInvalidState, "%s instance %q: %s", action, id, apiErr.ErrorMessage())
+		}
+	}
+	return fmt.Errorf("%s instance %q: %w", action, id, err)
 }
 
 func (a AWSCloud) StopInstance(id string) error {
-	ctx := context.TODO()
+	_, err := a.StopInstanceChange(id)
+	return err
+}
+
+func (a AWSCloud) StopInstanceChange(id string) (StateChange, error) {
 	state, err := a.GetInstanceStatus(id)
 	if err != nil {
-		return err
+		return StateChange{}, err
 	}
 
 	if state != InstanceStateRunning {
-		return fmt.Errorf("instance %q not running", id)
+		return StateChange{}, Errorf(ErrInvalidState, "instance %q not running", id)
 	}
 
 	runInstance := &ec2.StopInstancesInput{
 		InstanceIds: []string{id},
 	}
-	log.Printf("Start %s", id)
-	if outputStart, errInstance := a.Ec2Client.StopInstances(ctx, runInstance); errInstance != nil {
+	ctx, done := a.call("EC2", "StopInstances", id)
+	output, err := a.Ec2Client.StopInstances(ctx, runInstance)
+	done(err)
+	if err != nil {
+		return StateChange{}, a.callError("stop", id, err)
+	}
+
+	for _, change := range output.StoppingInstances {
+		a.logStateChange("stopping instance", change)
+	}
+
+	return stateChange(output.StoppingInstances, id), nil
+}
+
+func (a AWSCloud) RebootInstance(id string) error {
+	state, err := a.GetInstanceStatus(id)
+	if err != nil {
 		return err
-	} else {
-		log.Println(outputStart.StoppingInstances)
 	}
 
+	if state != InstanceStateRunning {
+		return Errorf(ErrInvalidState, "instance %q not running", id)
+	}
+
+	ctx, done := a.call("EC2", "RebootInstances", id)
+	_, err = a.Ec2Client.RebootInstances(ctx, &ec2.RebootInstancesInput{
+		InstanceIds: []string{id},
+	})
+	done(err)
+	if err != nil {
+		return a.callError("reboot", id, err)
+	}
+
+	a.log().Info("rebooting instance", "id", id)
 	return nil
 }
 
 func (a AWSCloud) GetName() string {
-	return "aws"
+	if a.Name == "" {
+		return "aws"
+	}
+	return a.Name
 }
 
 func (a AWSCloud) GetInstanceStatus(id string) (InstanceState, error) {
-	ctx := context.TODO()
-
 	var includeAllInstances = true
 	input := &ec2.DescribeInstanceStatusInput{
 		IncludeAllInstances: &includeAllInstances,
 		InstanceIds:         []string{id},
 	}
+	ctx, done := a.call("EC2", "DescribeInstanceStatus", id)
 	output, err := a.Ec2Client.DescribeInstanceStatus(ctx, input)
+	done(err)
 	if err != nil {
-		log.Println(err)
-		return "", err
+		return "", a.callError("get status of", id, err)
 	}
 
 	for _, instanceStatus := range output.InstanceStatuses {
-		log.Printf("%s: %s\n", *instanceStatus.InstanceId, instanceStatus.InstanceState.Name)
+		a.log().Debug("instance status", "id", aws.ToString(instanceStatus.InstanceId), "state", instanceStatus.InstanceState.Name)
 		if *instanceStatus.InstanceId == id {
 			return InstanceState(instanceStatus.InstanceState.Name), nil
 		}
 	}
 
-	return "", fmt.Errorf("instance status: not found")
+	return "", Errorf(ErrNotFound, "instance status: not found")
+}
+
+func (a AWSCloud) DescribeInstance(id string) (InstanceDetails, error) {
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{id},
+	}
+	ctx, done := a.call("EC2", "DescribeInstances", id)
+	output, err := a.Ec2Client.DescribeInstances(ctx, input)
+	done(err)
+	if err != nil {
+		return InstanceDetails{}, a.callError("describe", id, err)
+	}
+
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.InstanceId != nil && *instance.InstanceId == id {
+				return InstanceDetails{Type: string(instance.InstanceType), Region: a.Region}, nil
+			}
+		}
+	}
+
+	return InstanceDetails{}, Errorf(ErrNotFound, "instance %q not found", id)
+}
+
+// call starts a call to an AWS API operation about the instance id, and
+// returns the context to make it in and the function to call with its
+// error, which traces, logs and records it.
+func (a AWSCloud) call(service, operation, id string) (context.Context, func(error)) {
+	ctx := a.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracer().Start(ctx, service+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("aws-api"),
+			semconv.RPCService(service),
+			semconv.RPCMethod(operation),
+			attributeProvider.String(a.GetName()),
+			attributeRegion.String(a.Region),
+			attributeInstanceID.String(id),
+		),
+	)
+	start := time.Now()
+	return ctx, func(err error) {
+		a.observe(operation, start, err)
+		endSpan(span, err)
+	}
+}
+
+// observe logs and records a call to an AWS API operation which started at
+// start.
+func (a AWSCloud) observe(operation string, start time.Time, err error) {
+	duration := time.Since(start)
+	if err != nil {
+		a.log().Debug("AWS API call failed", "operation", operation, "duration", duration, "error", err)
+	} else {
+		a.log().Debug("AWS API call", "operation", operation, "duration", duration)
+	}
+
+	if a.Metrics != nil {
+		a.Metrics.ObserveAPICall(a.GetName(), operation, duration, err)
+	}
+}
+
+// logStateChange logs the state change of an instance caused by a call to
+// the EC2 API.
+func (a AWSCloud) logStateChange(msg string, change ec2types.InstanceStateChange) {
+	var previous, current ec2types.InstanceStateName
+	if change.PreviousState != nil {
+		previous = change.PreviousState.Name
+	}
+	if change.CurrentState != nil {
+		current = change.CurrentState.Name
+	}
+	a.log().Info(msg, "id", aws.ToString(change.InstanceId), "previous", previous, "current", current)
+}
+
+// stateChange returns the change of state of the instance id among the
+// changes returned by the EC2 API.
+func stateChange(changes []ec2types.InstanceStateChange, id string) StateChange {
+	for _, change := range changes {
+		if aws.ToString(change.InstanceId) != id {
+			continue
+		}
+		var stateChange StateChange
+		if change.PreviousState != nil {
+			stateChange.Previous = InstanceState(change.PreviousState.Name)
+		}
+		if change.CurrentState != nil {
+			stateChange.Current = InstanceState(change.CurrentState.Name)
+		}
+		return stateChange
+	}
+	return StateChange{}
+}
+
+// awsRetryables are the checks of the errors worth retrying: those the SDK
+// retries by default, which include throttling errors like
+// RequestLimitExceeded, and the EC2 server errors.
+var awsRetryables = retry.IsErrorRetryables(append(retry.DefaultRetryables, retry.RetryableErrorCode{
+	Codes: map[string]struct{}{"InternalError": {}, "ServiceUnavailable": {}, "Unavailable": {}},
+}))
+
+// IsRetryable tells whether an error returned by the provider is worth
+// retrying.
+func (a AWSCloud) IsRetryable(err error) bool {
+	return awsRetryables.IsErrorRetryable(err) == aws.TrueTernary
+}
+
+func (a AWSCloud) log() *slog.Logger {
+	if a.Logger == nil {
+		return discardLogger
+	}
+	return a.Logger
+}
+
+func (a AWSCloud) GetCPUUtilization(id string, start, end time.Time) ([]MetricSample, error) {
+	if a.CloudWatchClient == nil {
+		return nil, errors.New("CloudWatch client not configured")
+	}
+
+	input := &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/EC2"),
+		MetricName: aws.String("CPUUtilization"),
+		Dimensions: []cloudwatchtypes.Dimension{
+			{Name: aws.String("InstanceId"), Value: aws.String(id)},
+		},
+		StartTime:  aws.Time(start),
+		EndTime:    aws.Time(end),
+		Period:     aws.Int32(int32(cloudWatchPeriod.Seconds())),
+		Statistics: []cloudwatchtypes.Statistic{cloudwatchtypes.StatisticAverage},
+	}
+	ctx, done := a.call("CloudWatch", "GetMetricStatistics", id)
+	output, err := a.CloudWatchClient.GetMetricStatistics(ctx, input)
+	done(err)
+	if err != nil {
+		return nil, fmt.Errorf("get CPU utilization of %q: %v", id, err)
+	}
+
+	samples := make([]MetricSample, 0, len(output.Datapoints))
+	for _, datapoint := range output.Datapoints {
+		if datapoint.Timestamp == nil || datapoint.Average == nil {
+			continue
+		}
+		samples = append(samples, MetricSample{Time: *datapoint.Timestamp, Value: *datapoint.Average})
+	}
+
+	return samples, nil
+}
+
+// TraceCredentials returns a credentials provider tracing the retrieval of
+// the credentials of provider, as part of the API calls they are retrieved
+// for.
+func TraceCredentials(provider aws.CredentialsProvider) aws.CredentialsProvider {
+	return tracedCredentials{provider}
+}
+
+type tracedCredentials struct {
+	provider aws.CredentialsProvider
+}
+
+func (c tracedCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	ctx, span := tracer().Start(ctx, "aws.RetrieveCredentials")
+	credentials, err := c.provider.Retrieve(ctx)
+	if err == nil {
+		span.SetAttributes(attribute.String("aws.credentials.source", credentials.Source))
+	}
+	endSpan(span, err)
+	return credentials, err
 }
@@ -0,0 +1,178 @@
+package instances_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/httpreplay"
+)
+
+// recordFixturesEnv is the environment variable to set to record the AWS
+// fixtures again against AWS, with the IDs of a running and a stopped
+// instance set in INSTANCES_RECORD_RUNNING_ID and INSTANCES_RECORD_STOPPED_ID.
+// Stopping the running instance is part of the recording.
+const recordFixturesEnv = "INSTANCES_RECORD_FIXTURES"
+
+// fixtureIDs are the IDs of the instances in the AWS fixtures, which replace
+// the real ones when recording.
+var fixtureIDs = instanceIDs{
+	running: "i-0123456789abcdef0",
+	stopped: "i-0fedcba9876543210",
+	unknown: "i-0aaaaaaaaaaaaaaaa",
+}
+
+type instanceIDs struct {
+	running, stopped, unknown string
+}
+
+// accountIDPattern matches the IDs of the AWS accounts in the responses.
+var accountIDPattern = regexp.MustCompile(`<ownerId>\d{12}</ownerId>`)
+
+// newReplayedAWSCloud returns an AWSCloud replaying the interactions of the
+// fixture testdata/aws/name.json, or recording them if recordFixturesEnv is
+// set, and the IDs of the instances to call it about.
+func newReplayedAWSCloud(t *testing.T, name string) (instances.AWSCloud, instanceIDs) {
+	t.Helper()
+	mode := httpreplay.ModeFromEnv(recordFixturesEnv)
+	ids := fixtureIDs
+	cfg := aws.Config{
+		Region:      "eu-west-3",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDFIXTURE", "fixture", ""),
+	}
+	if mode == httpreplay.Record {
+		ids.running, ids.stopped = os.Getenv("INSTANCES_RECORD_RUNNING_ID"), os.Getenv("INSTANCES_RECORD_STOPPED_ID")
+		var err error
+		cfg, err = config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.Retryer = func() aws.Retryer { return aws.NopRetryer{} }
+
+	replacer := strings.NewReplacer(ids.running, fixtureIDs.running, ids.stopped, fixtureIDs.stopped)
+	transport, err := httpreplay.New(filepath.Join("testdata", "aws", name+".json"), mode,
+		httpreplay.WithIgnoredParams("StartTime", "EndTime"),
+		httpreplay.WithScrubber(func(interaction *httpreplay.Interaction) {
+			interaction.Request.Body = replacer.Replace(interaction.Request.Body)
+			interaction.Response.Body = accountIDPattern.ReplaceAllString(replacer.Replace(interaction.Response.Body), "<ownerId>123456789012</ownerId>")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := transport.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return instances.NewAWSCloud(cfg, instances.WithAWSHTTPClient(transport.Client())), ids
+}
+
+func TestAWSCloudReplay(t *testing.T) {
+	tests := map[string]struct {
+		run     func(cloud instances.AWSCloud, ids instanceIDs) error
+		wantErr error
+	}{
+		"status": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				return expectStatus(cloud, ids.running, instances.InstanceStateRunning)
+			},
+		},
+		"status_stopped": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				return expectStatus(cloud, ids.stopped, instances.InstanceStateStopped)
+			},
+		},
+		"status_unknown": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				_, err := cloud.GetInstanceStatus(ids.unknown)
+				return err
+			},
+			wantErr: instances.ErrNotFound,
+		},
+		"start_running": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				return cloud.StartInstance(ids.running)
+			},
+			wantErr: instances.ErrInvalidState,
+		},
+		"start_unknown": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				return cloud.StartInstance(ids.unknown)
+			},
+			wantErr: instances.ErrNotFound,
+		},
+		"reboot_stopped": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				return cloud.RebootInstance(ids.stopped)
+			},
+			wantErr: instances.ErrInvalidState,
+		},
+		"describe": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				details, err := cloud.DescribeInstance(ids.running)
+				if err == nil && details.Type != "t3.micro" {
+					return fmt.Errorf("got type %q, want t3.micro", details.Type)
+				}
+				return err
+			},
+		},
+		"cpu_utilization": {
+			run: func(cloud instances.AWSCloud, ids instanceIDs) error {
+				end := time.Now()
+				samples, err := cloud.GetCPUUtilization(ids.running, end.Add(-time.Hour), end)
+				if err == nil && len(samples) == 0 {
+					return errors.New("no samples")
+				}
+				return err
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The instances are shared by the recordings.
+			if httpreplay.ModeFromEnv(recordFixturesEnv) == httpreplay.Replay {
+				t.Parallel()
+			}
+			cloud, ids := newReplayedAWSCloud(t, name)
+			err := test.run(cloud, ids)
+			if test.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// TestAWSCloudReplayStop is run after TestAWSCloudReplay, as its recording
+// stops the running instance.
+func TestAWSCloudReplayStop(t *testing.T) {
+	cloud, ids := newReplayedAWSCloud(t, "stop")
+	if err := cloud.StopInstance(ids.running); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// expectStatus returns an error if the instance id isn't in the state want.
+func expectStatus(cloud instances.AWSCloud, id string, want instances.InstanceState) error {
+	state, err := cloud.GetInstanceStatus(id)
+	if err == nil && state != want {
+		return fmt.Errorf("got state %q, want %q", state, want)
+	}
+	return err
+}
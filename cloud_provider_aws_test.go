@@ -2,48 +2,28 @@ package instances_test
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
 )
 
 const runningInstanceId = "i-1234"
 const nonRunningInstanceId = "i-5678"
 
-type mockEC2Manager struct{}
-
-func (m mockEC2Manager) DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
-	out := ec2.DescribeInstanceStatusOutput{}
-
-	if len(params.InstanceIds) == 1 {
-		id := params.InstanceIds[0]
-		switch id {
-		case runningInstanceId:
-			status := types.InstanceStatus{
-				InstanceState: &types.InstanceState{Name: types.InstanceStateNameRunning},
-				InstanceId:    &id,
-			}
-			out.InstanceStatuses = append(out.InstanceStatuses, status)
-		case nonRunningInstanceId:
-			status := types.InstanceStatus{
-				InstanceState: &types.InstanceState{Name: types.InstanceStateNameStopped},
-				InstanceId:    &id,
-			}
-			out.InstanceStatuses = append(out.InstanceStatuses, status)
-		}
-	}
-
-	return &out, nil
-}
-
-func (m mockEC2Manager) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
-	return &ec2.StartInstancesOutput{}, nil
-}
-
-func (m mockEC2Manager) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
-	return &ec2.StopInstancesOutput{}, nil
+// newFakeCloud returns a fake cloud with a running and a stopped instance.
+func newFakeCloud(opts ...fakecloud.Option) *fakecloud.Cloud {
+	cloud := fakecloud.New(opts...)
+	cloud.AddInstance(runningInstanceId, instances.InstanceStateRunning, instances.InstanceDetails{Type: "t3.micro"})
+	cloud.AddInstance(nonRunningInstanceId, instances.InstanceStateStopped, instances.InstanceDetails{Type: "t3.micro"})
+	return cloud
 }
 
 func TestStartEC2Instance(t *testing.T) {
@@ -59,12 +39,15 @@ func TestStartEC2Instance(t *testing.T) {
 			instanceID: nonRunningInstanceId,
 			wantErr:    "",
 		},
+		"nonexisting instance": {
+			instanceID: "i-0000",
+			wantErr:    "not found",
+		},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			client := mockEC2Manager{}
-			AWSCloud := instances.AWSCloud{Ec2Client: client}
+			AWSCloud := instances.AWSCloud{Ec2Client: newFakeCloud().EC2()}
 			err := AWSCloud.StartInstance(test.instanceID)
 			if !errorContains(err, test.wantErr) {
 				t.Fatalf("unexpected error: %v", err)
@@ -78,10 +61,10 @@ func TestStopEC2Instance(t *testing.T) {
 		instanceID string
 		wantErr    string
 	}{
-		// "running instance": {
-		// 	instanceID: runningInstanceId,
-		// 	wantErr:    "",
-		// },
+		"running instance": {
+			instanceID: runningInstanceId,
+			wantErr:    "",
+		},
 		"non-running instance": {
 			instanceID: nonRunningInstanceId,
 			wantErr:    "not running",
@@ -90,8 +73,7 @@ func TestStopEC2Instance(t *testing.T) {
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			client := mockEC2Manager{}
-			AWSCloud := instances.AWSCloud{Ec2Client: client}
+			AWSCloud := instances.AWSCloud{Ec2Client: newFakeCloud().EC2()}
 			err := AWSCloud.StopInstance(test.instanceID)
 			if !errorContains(err, test.wantErr) {
 				t.Fatalf("unexpected error: %v", err)
@@ -99,3 +81,185 @@ func TestStopEC2Instance(t *testing.T) {
 		})
 	}
 }
+
+func TestRebootEC2Instance(t *testing.T) {
+	tests := map[string]struct {
+		instanceID string
+		wantErr    string
+	}{
+		"running instance": {
+			instanceID: runningInstanceId,
+			wantErr:    "",
+		},
+		"non-running instance": {
+			instanceID: nonRunningInstanceId,
+			wantErr:    "not running",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			AWSCloud := instances.AWSCloud{Ec2Client: newFakeCloud().EC2()}
+			err := AWSCloud.RebootInstance(test.instanceID)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEC2APICallMetrics(t *testing.T) {
+	metrics := instances.NewMetrics(time.Now)
+	AWSCloud := instances.AWSCloud{Ec2Client: newFakeCloud().EC2(), Metrics: metrics}
+	if _, err := AWSCloud.GetInstanceStatus(runningInstanceId); err != nil {
+		t.Fatal(err)
+	}
+	if err := AWSCloud.StartInstance(nonRunningInstanceId); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := metrics.Write(&out, func(instances.Instance) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`instances_provider_api_calls_total{provider="aws",operation="DescribeInstanceStatus"} 1`,
+		`instances_provider_api_calls_total{provider="aws",operation="StartInstances"} 1`,
+		`instances_provider_api_errors_total{provider="aws",operation="StartInstances"} 0`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// newFailingEC2 returns a fake EC2 client failing the calls changing the
+// state of the instances.
+func newFailingEC2() instances.EC2InstanceManager {
+	cloud := newFakeCloud()
+	for _, method := range []string{"StartInstances", "StopInstances", "RebootInstances"} {
+		cloud.InjectFailure(fakecloud.Failure{Method: method, Err: errors.New("UnauthorizedOperation")})
+	}
+	return cloud.EC2()
+}
+
+func TestEC2APICallErrors(t *testing.T) {
+	var logs strings.Builder
+	logger, err := instances.NewLogger(&logs, slog.LevelDebug, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	AWSCloud := instances.AWSCloud{Ec2Client: newFailingEC2(), Logger: logger}
+
+	tests := map[string]struct {
+		call    func(string) error
+		id      string
+		wantErr string
+	}{
+		"start": {
+			call:    AWSCloud.StartInstance,
+			id:      nonRunningInstanceId,
+			wantErr: `start instance "i-5678": UnauthorizedOperation`,
+		},
+		"stop": {
+			call:    AWSCloud.StopInstance,
+			id:      runningInstanceId,
+			wantErr: `stop instance "i-1234": UnauthorizedOperation`,
+		},
+		"reboot": {
+			call:    AWSCloud.RebootInstance,
+			id:      runningInstanceId,
+			wantErr: `reboot instance "i-1234": UnauthorizedOperation`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.call(tc.id); !errorContains(err, tc.wantErr) {
+				t.Errorf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	if !strings.Contains(logs.String(), `msg="AWS API call failed" operation=StartInstances`) {
+		t.Errorf("failed call not logged:\n%s", logs.String())
+	}
+}
+
+// mockCloudWatchClient returns the given datapoints, including incomplete
+// ones, which the fakecloud client never returns.
+type mockCloudWatchClient struct {
+	datapoints []cloudwatchtypes.Datapoint
+}
+
+func (m mockCloudWatchClient) GetMetricStatistics(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	if *params.Namespace != "AWS/EC2" || *params.MetricName != "CPUUtilization" {
+		return nil, errors.New("unexpected metric")
+	}
+	return &cloudwatch.GetMetricStatisticsOutput{Datapoints: m.datapoints}, nil
+}
+
+func TestGetEC2CPUUtilization(t *testing.T) {
+	now := time.Now()
+	tests := map[string]struct {
+		client      instances.CloudWatchMetricsGetter
+		wantSamples int
+		wantErr     string
+	}{
+		"datapoints": {
+			client: mockCloudWatchClient{datapoints: []cloudwatchtypes.Datapoint{
+				{Timestamp: aws.Time(now.Add(-10 * time.Minute)), Average: aws.Float64(1.5)},
+				{Timestamp: aws.Time(now.Add(-5 * time.Minute)), Average: aws.Float64(2.5)},
+				{Timestamp: aws.Time(now)},
+			}},
+			wantSamples: 2,
+		},
+		"no CloudWatch client": {
+			client:  nil,
+			wantErr: "CloudWatch client not configured",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			AWSCloud := instances.AWSCloud{Ec2Client: newFakeCloud().EC2(), CloudWatchClient: test.client}
+			samples, err := AWSCloud.GetCPUUtilization(runningInstanceId, now.Add(-time.Hour), now)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(samples) != test.wantSamples {
+				t.Fatalf("unexpected samples: got %d, want %d", len(samples), test.wantSamples)
+			}
+		})
+	}
+}
+
+func TestDescribeEC2Instance(t *testing.T) {
+	tests := map[string]struct {
+		instanceID string
+		want       instances.InstanceDetails
+		wantErr    string
+	}{
+		"existing instance": {
+			instanceID: runningInstanceId,
+			want:       instances.InstanceDetails{Type: "t3.micro", Region: "eu-west-3"},
+		},
+		"nonexisting instance": {
+			instanceID: "i-0000",
+			wantErr:    "not found",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			AWSCloud := instances.AWSCloud{Ec2Client: newFakeCloud().EC2(), Region: "eu-west-3"}
+			details, err := AWSCloud.DescribeInstance(test.instanceID)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if details != test.want {
+				t.Fatalf("unexpected details: got %+v, want %+v", details, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/nonatomiclabs/instances"
+)
+
+// exampleImageID is an image ID accepted by the EC2 emulators.
+const exampleImageID = "ami-12c6146b"
+
+// runInstances runs the instances command, returning its output.
+func runInstances(t *testing.T, args ...string) string {
+	t.Helper()
+	options, args, err := instances.ParseGlobalFlags(append([]string{"--no-cache", "--quiet"}, args...), os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := run(options, args, &out); err != nil {
+		t.Fatalf("instances %s: %v", strings.Join(args, " "), err)
+	}
+	return out.String()
+}
+
+// waitForStatus waits for the instance name to be in the state want.
+func waitForStatus(t *testing.T, name string, want instances.InstanceState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Minute)
+	for {
+		status := strings.TrimSpace(runInstances(t, "status", name))
+		if status == string(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instance %q still %q, want %q", name, status, want)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// TestIntegration runs the commands against an EC2 emulator, like LocalStack
+// or moto, whose URL is set in INSTANCES_AWS_ENDPOINT_URL.
+func TestIntegration(t *testing.T) {
+	if os.Getenv("INSTANCES_AWS_ENDPOINT_URL") == "" {
+		t.Fatal("INSTANCES_AWS_ENDPOINT_URL must be set to the URL of an EC2 emulator")
+	}
+	if os.Getenv("INSTANCES_AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("INSTANCES_AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("INSTANCES_AWS_SECRET_ACCESS_KEY", "test")
+	}
+	// Keep the configuration, the database and the AWS configuration of the
+	// user out of the test.
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("INSTANCES_CONFIG", "")
+
+	ctx := context.Background()
+	path, explicit := findConfig("")
+	conf, err := loadConfig(path, explicit, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := conf.Providers["aws"]
+	cfg, err := loadAWSConfig(ctx, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := instances.NewAWSCloud(cfg, instances.WithAWSEndpoint(provider.Endpoint)).Ec2Client.(*ec2.Client)
+	reservation, err := client.RunInstances(ctx, &ec2.RunInstancesInput{
+		ImageId:  aws.String(exampleImageID),
+		MinCount: aws.Int32(1),
+		MaxCount: aws.Int32(1),
+	})
+	if err != nil {
+		t.Fatalf("run an instance: %v", err)
+	}
+	id := aws.ToString(reservation.Instances[0].InstanceId)
+	t.Cleanup(func() {
+		if _, err := client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{id}}); err != nil {
+			t.Errorf("terminate %q: %v", id, err)
+		}
+	})
+
+	runInstances(t, "add", "-cloud", "aws", "-name", "web", id)
+	waitForStatus(t, "web", instances.InstanceStateRunning)
+
+	runInstances(t, "stop", "web")
+	waitForStatus(t, "web", instances.InstanceStateStopped)
+
+	runInstances(t, "start", "web")
+	waitForStatus(t, "web", instances.InstanceStateRunning)
+
+	list := runInstances(t, "list", "--status")
+	if !strings.Contains(list, "name: web\tid: "+id) || !strings.Contains(list, "state: running") {
+		t.Errorf("got list %q, want web running", list)
+	}
+}
@@ -5,23 +5,80 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/nonatomiclabs/instances"
+	"go.opentelemetry.io/otel"
 )
 
+// statusCacheTTL is how long the states of the instances are cached.
+const statusCacheTTL = 30 * time.Second
+
+// configEnv is the environment variable setting the path of the
+// configuration file, overridden by --config.
+const configEnv = "INSTANCES_CONFIG"
+
+// defaultEndpointRegion is the region used with a custom endpoint when none
+// is configured, as emulators accept any.
+const defaultEndpointRegion = "us-east-1"
+
 func main() {
-	userDir, err := os.UserHomeDir()
+	options, args, err := instances.ParseGlobalFlags(os.Args[1:], os.Stderr)
 	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if err := run(options, args, os.Stdout); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+}
 
-	dbPath := filepath.Join(userDir, ".instances.db.json")
+func run(options instances.GlobalOptions, args []string, out io.Writer) error {
+	logger := options.Logger
+	ctx := context.Background()
+
+	if options.Trace != "" {
+		tracerProvider, err := instances.NewTracerProvider(ctx, options.Trace)
+		if err != nil {
+			return err
+		}
+		otel.SetTracerProvider(tracerProvider)
+		defer func() {
+			// Flush the spans.
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				logger.Warn("export traces", "error", err)
+			}
+		}()
+	}
+
+	ctx, span := otel.Tracer("github.com/nonatomiclabs/instances/cmd/instances").Start(ctx, "instances")
+	defer span.End()
+
+	configPath, explicitConfig := findConfig(options.Config)
+	if len(args) > 0 && args[0] == "context" {
+		return instances.RunContextCommand(configPath, args[1:], out)
+	}
+
+	userDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	conf, err := loadConfig(configPath, explicitConfig, options.Context)
+	if err != nil {
+		return err
+	}
+	dbPath := expandHome(conf.Database.Path, userDir)
 
 	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
 		// The database doesn't exist yet, create an empty one
@@ -30,50 +87,158 @@ func main() {
 		}
 		f, err := os.OpenFile(dbPath, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
-			fmt.Printf("create default database file: %s\n", err)
-			os.Exit(1)
+			return fmt.Errorf("create default database file: %s", err)
 		}
 		err = json.NewEncoder(f).Encode(emptyDatabase)
 		if err != nil {
-			fmt.Printf("write default databse: %s\n", err)
-			os.Exit(1)
+			return fmt.Errorf("write default databse: %s", err)
 		}
 	}
 
-	f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+	// The commands save the database themselves.
+	db, err := instances.NewDatabaseContext(ctx, &instances.DatabaseFile{Path: dbPath}, instances.WithDatabaseLogger(logger))
 	if err != nil {
-		fmt.Printf("open database file: %s\n", err)
-		os.Exit(1)
+		return err
 	}
-	defer f.Close()
 
-	db, err := instances.NewDatabase(f)
+	metrics := instances.NewMetrics(time.Now)
+	cloudProviders, err := newCloudProviders(ctx, conf, metrics, logger)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+
+	auditLog := instances.FileAuditLog{Path: expandHome(conf.Database.AuditLog, userDir)}
+
+	cliOptions := []instances.CLIOption{
+		instances.WithOutput(out),
+		instances.WithAuditLog(auditLog),
+		instances.WithMetrics(metrics),
+		instances.WithLogger(logger),
+		instances.WithOutputFormat(conf.Output),
+		instances.WithDefaultCloud(conf.DefaultCloud),
+	}
+	if isTerminal(os.Stdin) {
+		cliOptions = append(cliOptions, instances.WithConfirmations(os.Stdin, os.Stderr))
+	}
+	if cacheDir, err := os.UserCacheDir(); err == nil && !options.NoCache {
+		statusCache := &instances.FileStatusCache{Path: filepath.Join(cacheDir, "instances", "status.json")}
+		cliOptions = append(cliOptions, instances.WithStatusCache(statusCache, statusCacheTTL))
+	}
+
+	CLI := instances.NewCLI(db, cloudProviders, cliOptions...)
+
+	return CLI.RunContext(ctx, args)
+}
+
+// isTerminal reports whether f is a terminal, which the user can type in.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// findConfig returns the path of the configuration file, given by --config
+// or INSTANCES_CONFIG, or else the one in the user configuration directory,
+// and whether it was given.
+func findConfig(path string) (string, bool) {
+	if path == "" {
+		path = os.Getenv(configEnv)
 	}
+	if path != "" {
+		return path, true
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(configDir, "instances", "config.json"), false
+}
 
-	defer func() {
-		err = f.Truncate(0)   // TODO: handle error
-		_, err = f.Seek(0, 0) // TODO: handle error
-		db.Save()             // TODO: handle error
-	}()
+// loadConfig loads the configuration of the context (or else of the current
+// one) from the configuration file at path, overridden by the environment
+// variables. The file may only be missing if it wasn't given.
+func loadConfig(path string, explicit bool, context string) (*instances.Config, error) {
+	f, err := os.Open(path)
+	if !explicit && (path == "" || errors.Is(err, os.ErrNotExist)) {
+		return instances.LoadConfig(nil, context, os.Getenv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open config file: %s", err)
+	}
+	defer f.Close()
 
-	ctx := context.TODO()
-	cfg, err := config.LoadDefaultConfig(ctx)
+	conf, err := instances.LoadConfig(f, context, os.Getenv)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
-	ec2Client := ec2.NewFromConfig(cfg)
+	return conf, nil
+}
 
-	cloudProviders := map[string]instances.CloudProvider{
-		"aws": instances.AWSCloud{Ec2Client: ec2Client},
+// expandHome replaces the "~" at the start of path with the home directory.
+func expandHome(path, home string) string {
+	if path == "~" {
+		return home
+	}
+	if rest, found := strings.CutPrefix(path, "~/"); found {
+		return filepath.Join(home, rest)
 	}
+	return path
+}
 
-	CLI := instances.NewCLI(db, cloudProviders)
+// newCloudProviders returns the cloud providers enabled by the
+// configuration, by name.
+func newCloudProviders(ctx context.Context, conf *instances.Config, metrics *instances.Metrics, logger *slog.Logger) (map[string]instances.CloudProvider, error) {
+	cloudProviders := map[string]instances.CloudProvider{}
+	for name, provider := range conf.Providers {
+		// AWS is the only type of provider.
+		cfg, err := loadAWSConfig(ctx, provider)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %v", name, err)
+		}
 
-	if err = CLI.Run(os.Args[1:]); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		retryPolicy := instances.DefaultRetryPolicy
+		switch {
+		case provider.MaxAttempts > 0:
+			retryPolicy.MaxAttempts = provider.MaxAttempts
+		case cfg.RetryMaxAttempts > 0:
+			// Set by AWS_MAX_ATTEMPTS or max_attempts in the AWS configuration.
+			retryPolicy.MaxAttempts = cfg.RetryMaxAttempts
+		}
+
+		var opts []instances.AWSCloudOption
+		if provider.Endpoint != "" {
+			opts = append(opts, instances.WithAWSEndpoint(provider.Endpoint))
+		}
+		awsCloud := instances.NewAWSCloud(cfg, opts...)
+		awsCloud.Name, awsCloud.Metrics, awsCloud.Logger = name, metrics, logger
+		cloudProviders[name] = instances.NewRetryingCloudProvider(awsCloud, retryPolicy, instances.WithRetryLogger(logger))
+	}
+	return cloudProviders, nil
+}
+
+// loadAWSConfig loads the AWS configuration of a provider, with its region,
+// profile and static credentials if set.
+func loadAWSConfig(ctx context.Context, provider instances.ProviderConfig) (aws.Config, error) {
+	// The calls are retried by the providers, not by the SDK.
+	loadOptions := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} }),
+	}
+	if provider.Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(provider.Region))
+	}
+	if provider.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(provider.Profile))
+	}
+	if provider.AccessKeyID != "" {
+		loadOptions = append(loadOptions, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(provider.AccessKeyID, provider.SecretAccessKey, "")))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("load AWS configuration: %s", err)
+	}
+	if cfg.Region == "" && provider.Endpoint != "" {
+		cfg.Region = defaultEndpointRegion
 	}
+	cfg.Credentials = instances.TraceCredentials(cfg.Credentials)
+	return cfg, nil
 }
@@ -0,0 +1,354 @@
+package instances
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Config is the configuration of the instances command. Its database,
+// providers and default provider are the ones of the default context, and
+// Contexts declares other ones, like one per project, each with its own
+// database and providers.
+type Config struct {
+	Database DatabaseConfig `json:"database"`
+	// Providers are the cloud providers enabled, by name. The instances
+	// added to one of them record its name.
+	Providers map[string]ProviderConfig `json:"providers,omitempty"`
+	// Output is the default output format of the commands, "text" or
+	// "json".
+	Output string `json:"output,omitempty"`
+	// DefaultCloud is the provider of the instances added without --cloud.
+	DefaultCloud string `json:"default-cloud,omitempty"`
+	// CurrentContext is the context used without --context, the default
+	// one if empty.
+	CurrentContext string `json:"current-context,omitempty"`
+	// Contexts are the contexts other than the default one, by name.
+	Contexts map[string]ContextConfig `json:"contexts,omitempty"`
+}
+
+// ContextConfig declares a context. The context uses the providers of the
+// default context if it doesn't declare any.
+type ContextConfig struct {
+	Database     DatabaseConfig            `json:"database"`
+	Providers    map[string]ProviderConfig `json:"providers,omitempty"`
+	DefaultCloud string                    `json:"default-cloud,omitempty"`
+}
+
+// DefaultContext is the name of the context of the top-level settings of a
+// Config.
+const DefaultContext = "default"
+
+// DatabaseConfig declares where the database is stored.
+type DatabaseConfig struct {
+	// Backend is how the database is stored, "file" (a JSON file) being the
+	// only backend supported.
+	Backend string `json:"backend,omitempty"`
+	// Path is the path of the file, which may start with "~/" for the home
+	// directory.
+	Path string `json:"path,omitempty"`
+	// AuditLog is the path of the audit log of the commands, which may
+	// start with "~/" too.
+	AuditLog string `json:"audit-log,omitempty"`
+}
+
+// ProviderConfig declares a cloud provider.
+type ProviderConfig struct {
+	// Type is the type of the provider, "aws" being the only type
+	// supported.
+	Type string `json:"type"`
+	// Region, Profile, Endpoint and the static credentials override those
+	// of the AWS configuration.
+	Region          string `json:"region,omitempty"`
+	Profile         string `json:"profile,omitempty"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	AccessKeyID     string `json:"access-key-id,omitempty"`
+	SecretAccessKey string `json:"secret-access-key,omitempty"`
+	// MaxAttempts caps the attempts of the calls to the provider, overriding
+	// the AWS configuration, and the default retry policy if neither sets it.
+	MaxAttempts int `json:"max-attempts,omitempty"`
+}
+
+// The environment variables overriding the configuration.
+const (
+	contextEnv            = "INSTANCES_CONTEXT"
+	databaseEnv           = "INSTANCES_DATABASE"
+	outputEnv             = "INSTANCES_OUTPUT"
+	defaultCloudEnv       = "INSTANCES_DEFAULT_CLOUD"
+	awsEndpointURLEnv     = "INSTANCES_AWS_ENDPOINT_URL"
+	awsAccessKeyIDEnv     = "INSTANCES_AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyEnv = "INSTANCES_AWS_SECRET_ACCESS_KEY"
+)
+
+// providerTypes are the types of the cloud providers supported.
+var providerTypes = []string{"aws"}
+
+// outputFormats are the output formats supported.
+var outputFormats = []string{"text", "json"}
+
+// contextNamePattern matches the valid names of contexts, which are part of
+// the default paths of their files.
+var contextNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// DefaultConfig returns the configuration used without a configuration
+// file: a database in ~/.instances.db.json and a provider "aws" using the
+// default AWS configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		Database:  defaultDatabase(DefaultContext),
+		Providers: map[string]ProviderConfig{"aws": {Type: "aws"}},
+		Output:    "text",
+	}
+}
+
+// defaultDatabase returns where the database of a context is stored by
+// default.
+func defaultDatabase(context string) DatabaseConfig {
+	if context == DefaultContext {
+		return DatabaseConfig{Backend: "file", Path: "~/.instances.db.json", AuditLog: "~/.instances.audit.jsonl"}
+	}
+	return DatabaseConfig{
+		Backend:  "file",
+		Path:     "~/.instances." + context + ".db.json",
+		AuditLog: "~/.instances." + context + ".audit.jsonl",
+	}
+}
+
+// ReadConfig reads a Config serialized in JSON, as written in the
+// configuration file, and validates all its contexts.
+func ReadConfig(r io.Reader) (*Config, error) {
+	var config Config
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("load config: %v", err)
+	}
+
+	noEnv := func(string) string { return "" }
+	if _, err := config.Resolve(DefaultContext, noEnv); err != nil {
+		return nil, err
+	}
+	for name := range config.Contexts {
+		if !contextNamePattern.MatchString(name) || name == DefaultContext {
+			return nil, fmt.Errorf("load config: invalid context name %q", name)
+		}
+		if _, err := config.Resolve(name, noEnv); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := config.Resolve("", noEnv); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// LoadConfig reads a Config serialized in JSON from r (none if r is nil),
+// and returns the configuration of its context named context, or else of
+// the one set by INSTANCES_CONTEXT or of its current context, overridden by
+// the environment variables read with getenv.
+func LoadConfig(r io.Reader, context string, getenv func(string) string) (*Config, error) {
+	config := &Config{}
+	if r != nil {
+		var err error
+		if config, err = ReadConfig(r); err != nil {
+			return nil, err
+		}
+	}
+	return config.Resolve(context, getenv)
+}
+
+// Resolve returns the configuration of the context name (or else of the one
+// set by INSTANCES_CONTEXT or of the current context), whose unset fields
+// have their default values, overridden by the environment variables read
+// with getenv, and validates it. The configuration returned has no
+// contexts.
+func (c *Config) Resolve(name string, getenv func(string) string) (*Config, error) {
+	if name == "" {
+		name = getenv(contextEnv)
+	}
+	if name == "" {
+		name = c.CurrentContext
+	}
+	if name == "" {
+		name = DefaultContext
+	}
+
+	resolved := DefaultConfig()
+	resolved.Database = overlayDatabase(resolved.Database, c.Database)
+	if c.Providers != nil {
+		// Only the providers of the file are enabled, if it declares any.
+		resolved.Providers = c.Providers
+	}
+	if c.Output != "" {
+		resolved.Output = c.Output
+	}
+	resolved.DefaultCloud = c.DefaultCloud
+
+	if name != DefaultContext {
+		context, exists := c.Contexts[name]
+		if !exists {
+			return nil, Errorf(ErrNotFound, "load config: no context named %q", name)
+		}
+		resolved.Database = overlayDatabase(defaultDatabase(name), context.Database)
+		if context.Providers != nil {
+			resolved.Providers = context.Providers
+			resolved.DefaultCloud = ""
+		}
+		if context.DefaultCloud != "" {
+			resolved.DefaultCloud = context.DefaultCloud
+		}
+	}
+	// The environment overrides the providers of the resolved config only.
+	resolved.Providers = maps.Clone(resolved.Providers)
+
+	resolved.applyEnv(getenv)
+
+	if err := resolved.Validate(); err != nil {
+		if name != DefaultContext {
+			return nil, fmt.Errorf("load config: context %q: %v", name, err)
+		}
+		return nil, fmt.Errorf("load config: %v", err)
+	}
+	return resolved, nil
+}
+
+// overlayDatabase returns the database config base, with the fields set in
+// override replacing its own.
+func overlayDatabase(base, override DatabaseConfig) DatabaseConfig {
+	if override.Backend != "" {
+		base.Backend = override.Backend
+	}
+	if override.Path != "" {
+		base.Path = override.Path
+	}
+	if override.AuditLog != "" {
+		base.AuditLog = override.AuditLog
+	}
+	return base
+}
+
+// ContextNames returns the names of the contexts, including the default
+// one, sorted.
+func (c *Config) ContextNames() []string {
+	names := append(sortedKeys(c.Contexts), DefaultContext)
+	slices.Sort(names)
+	return names
+}
+
+// AddContext adds a context, failing with an ErrConflict if one has the
+// same name.
+func (c *Config) AddContext(name string, context ContextConfig) error {
+	if !contextNamePattern.MatchString(name) {
+		return Errorf(ErrInvalidArgument, "invalid context name %q", name)
+	}
+	if _, exists := c.Contexts[name]; exists || name == DefaultContext {
+		return Errorf(ErrConflict, "context %q exists already", name)
+	}
+	if c.Contexts == nil {
+		c.Contexts = map[string]ContextConfig{}
+	}
+	c.Contexts[name] = context
+	if _, err := c.Resolve(name, func(string) string { return "" }); err != nil {
+		delete(c.Contexts, name)
+		return err
+	}
+	return nil
+}
+
+// UseContext makes a context the current one, failing with an ErrNotFound
+// if there is none with this name.
+func (c *Config) UseContext(name string) error {
+	if _, exists := c.Contexts[name]; !exists && name != DefaultContext {
+		return Errorf(ErrNotFound, "no context named %q", name)
+	}
+	c.CurrentContext = name
+	if name == DefaultContext {
+		c.CurrentContext = ""
+	}
+	return nil
+}
+
+// Write writes the configuration serialized in JSON, as read by ReadConfig.
+func (c *Config) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(c)
+}
+
+// applyEnv overrides the configuration with the environment variables. The
+// AWS ones apply to all the AWS providers, like to point them all to an
+// emulator.
+func (c *Config) applyEnv(getenv func(string) string) {
+	if path := getenv(databaseEnv); path != "" {
+		c.Database.Path = path
+	}
+	if output := getenv(outputEnv); output != "" {
+		c.Output = output
+	}
+	if cloud := getenv(defaultCloudEnv); cloud != "" {
+		c.DefaultCloud = cloud
+	}
+
+	endpoint := getenv(awsEndpointURLEnv)
+	accessKeyID, secretAccessKey := getenv(awsAccessKeyIDEnv), getenv(awsSecretAccessKeyEnv)
+	for name, provider := range c.Providers {
+		if provider.Type != "aws" {
+			continue
+		}
+		if endpoint != "" {
+			provider.Endpoint = endpoint
+		}
+		if accessKeyID != "" || secretAccessKey != "" {
+			provider.AccessKeyID, provider.SecretAccessKey = accessKeyID, secretAccessKey
+		}
+		c.Providers[name] = provider
+	}
+}
+
+// Validate checks that the database backend, the providers and the output
+// format are supported, and that the default provider is one of them.
+func (c *Config) Validate() error {
+	if c.Database.Backend != "file" {
+		return fmt.Errorf("database: unsupported backend %q, must be \"file\"", c.Database.Backend)
+	}
+	if c.Database.Path == "" {
+		return errors.New("database: missing path")
+	}
+
+	if len(c.Providers) == 0 {
+		return errors.New("no provider enabled")
+	}
+	for name, provider := range c.Providers {
+		if name == "" || name != strings.ToLower(name) {
+			return fmt.Errorf("provider %q: names must be lowercase and not empty", name)
+		}
+		if !slices.Contains(providerTypes, provider.Type) {
+			return fmt.Errorf("provider %q: unsupported type %q, must be one of %s", name, provider.Type, strings.Join(providerTypes, ", "))
+		}
+		if provider.Endpoint != "" {
+			if u, err := url.Parse(provider.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("provider %q: endpoint %q is not an absolute URL", name, provider.Endpoint)
+			}
+		}
+		if (provider.AccessKeyID == "") != (provider.SecretAccessKey == "") {
+			return fmt.Errorf("provider %q: access-key-id and secret-access-key must be set together", name)
+		}
+		if provider.MaxAttempts < 0 {
+			return fmt.Errorf("provider %q: max-attempts must be positive", name)
+		}
+	}
+
+	if !slices.Contains(outputFormats, c.Output) {
+		return fmt.Errorf("unsupported output %q, must be one of %s", c.Output, strings.Join(outputFormats, ", "))
+	}
+	if _, exists := c.Providers[c.DefaultCloud]; c.DefaultCloud != "" && !exists {
+		return fmt.Errorf("default-cloud %q is not an enabled provider", c.DefaultCloud)
+	}
+	return nil
+}
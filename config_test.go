@@ -0,0 +1,343 @@
+package instances_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nonatomiclabs/instances"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config  string
+		env     map[string]string
+		want    *instances.Config
+		wantErr string
+	}{
+		"no config file": {
+			want: instances.DefaultConfig(),
+		},
+		"empty config": {
+			config: `{}`,
+			want:   instances.DefaultConfig(),
+		},
+		"valid config": {
+			config: `{
+				"database": {"backend": "file", "path": "/var/lib/instances.json"},
+				"providers": {
+					"aws-eu": {"type": "aws", "region": "eu-west-3", "profile": "prod", "max-attempts": 10},
+					"local": {"type": "aws", "endpoint": "http://localhost:4566", "access-key-id": "test", "secret-access-key": "test"}
+				},
+				"output": "json",
+				"default-cloud": "aws-eu"
+			}`,
+			want: &instances.Config{
+				Database: instances.DatabaseConfig{Backend: "file", Path: "/var/lib/instances.json", AuditLog: "~/.instances.audit.jsonl"},
+				Providers: map[string]instances.ProviderConfig{
+					"aws-eu": {Type: "aws", Region: "eu-west-3", Profile: "prod", MaxAttempts: 10},
+					"local":  {Type: "aws", Endpoint: "http://localhost:4566", AccessKeyID: "test", SecretAccessKey: "test"},
+				},
+				Output:       "json",
+				DefaultCloud: "aws-eu",
+			},
+		},
+		"environment": {
+			config: `{"providers": {"aws-eu": {"type": "aws", "region": "eu-west-3"}}}`,
+			env: map[string]string{
+				"INSTANCES_DATABASE":              "/tmp/db.json",
+				"INSTANCES_OUTPUT":                "json",
+				"INSTANCES_DEFAULT_CLOUD":         "aws-eu",
+				"INSTANCES_AWS_ENDPOINT_URL":      "http://localhost:5000",
+				"INSTANCES_AWS_ACCESS_KEY_ID":     "id",
+				"INSTANCES_AWS_SECRET_ACCESS_KEY": "secret",
+			},
+			want: &instances.Config{
+				Database: instances.DatabaseConfig{Backend: "file", Path: "/tmp/db.json", AuditLog: "~/.instances.audit.jsonl"},
+				Providers: map[string]instances.ProviderConfig{
+					"aws-eu": {Type: "aws", Region: "eu-west-3", Endpoint: "http://localhost:5000", AccessKeyID: "id", SecretAccessKey: "secret"},
+				},
+				Output:       "json",
+				DefaultCloud: "aws-eu",
+			},
+		},
+		"unsupported backend": {
+			config:  `{"database": {"backend": "postgres"}}`,
+			wantErr: `database: unsupported backend "postgres"`,
+		},
+		"unsupported provider type": {
+			config:  `{"providers": {"gcp": {"type": "gcp"}}}`,
+			wantErr: `provider "gcp": unsupported type "gcp"`,
+		},
+		"uppercase provider name": {
+			config:  `{"providers": {"AWS": {"type": "aws"}}}`,
+			wantErr: "names must be lowercase",
+		},
+		"no provider": {
+			config:  `{"providers": {}}`,
+			wantErr: "no provider enabled",
+		},
+		"relative endpoint": {
+			config:  `{"providers": {"aws": {"type": "aws", "endpoint": "localhost:4566"}}}`,
+			wantErr: "not an absolute URL",
+		},
+		"partial credentials": {
+			config:  `{"providers": {"aws": {"type": "aws", "access-key-id": "test"}}}`,
+			wantErr: "must be set together",
+		},
+		"partial credentials in the environment": {
+			env:     map[string]string{"INSTANCES_AWS_ACCESS_KEY_ID": "id"},
+			wantErr: "must be set together",
+		},
+		"negative max attempts": {
+			config:  `{"providers": {"aws": {"type": "aws", "max-attempts": -1}}}`,
+			wantErr: `provider "aws": max-attempts must be positive`,
+		},
+		"unsupported output": {
+			config:  `{"output": "yaml"}`,
+			wantErr: `unsupported output "yaml"`,
+		},
+		"unknown default cloud": {
+			config:  `{"default-cloud": "azure"}`,
+			wantErr: `default-cloud "azure" is not an enabled provider`,
+		},
+		"unknown field": {
+			config:  `{"database": {"file": "db.json"}}`,
+			wantErr: "unknown field",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var r io.Reader
+			if test.config != "" {
+				r = strings.NewReader(test.config)
+			}
+			config, err := instances.LoadConfig(r, "", func(name string) string { return test.env[name] })
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.want != nil && !reflect.DeepEqual(config, test.want) {
+				t.Errorf("got config %+v, want %+v", config, test.want)
+			}
+		})
+	}
+}
+
+func TestCLIConfigDefaults(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	var out bytes.Buffer
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": newTestCloud()},
+		instances.WithOutput(&out),
+		instances.WithAuditLog(&instances.MemoryAuditLog{}),
+		instances.WithDefaultCloud("mock"),
+		instances.WithOutputFormat("json"),
+	)
+
+	if err := cli.Run([]string{"add", "--name", "other", existingInstanceIds[1]}); err != nil {
+		t.Fatalf("add without --cloud: %v", err)
+	}
+	if instance, err := db.GetInstance("other"); err != nil || instance.CloudProviderName != "mock" {
+		t.Fatalf("got instance %+v (error: %v), want one of mock", instance, err)
+	}
+
+	out.Reset()
+	if err := cli.Run([]string{"history"}); err != nil {
+		t.Fatal(err)
+	}
+	var entry instances.AuditEntry
+	if err := json.NewDecoder(&out).Decode(&entry); err != nil {
+		t.Fatalf("history not printed as JSON: %v", err)
+	}
+	if entry.Command != "add" {
+		t.Errorf("got entry %+v, want the one of add", entry)
+	}
+}
+
+func TestConfigContexts(t *testing.T) {
+	t.Parallel()
+	const config = `{
+		"providers": {"aws": {"type": "aws", "region": "us-east-1"}},
+		"default-cloud": "aws",
+		"current-context": "client-a",
+		"contexts": {
+			"client-a": {"providers": {"aws-a": {"type": "aws", "profile": "client-a"}}, "default-cloud": "aws-a"},
+			"client-b": {"database": {"path": "/data/b.json"}}
+		}
+	}`
+	tests := map[string]struct {
+		context string
+		env     map[string]string
+		want    *instances.Config
+		wantErr string
+	}{
+		"current context": {
+			want: &instances.Config{
+				Database:     instances.DatabaseConfig{Backend: "file", Path: "~/.instances.client-a.db.json", AuditLog: "~/.instances.client-a.audit.jsonl"},
+				Providers:    map[string]instances.ProviderConfig{"aws-a": {Type: "aws", Profile: "client-a"}},
+				Output:       "text",
+				DefaultCloud: "aws-a",
+			},
+		},
+		"context inheriting the providers": {
+			context: "client-b",
+			want: &instances.Config{
+				Database:     instances.DatabaseConfig{Backend: "file", Path: "/data/b.json", AuditLog: "~/.instances.client-b.audit.jsonl"},
+				Providers:    map[string]instances.ProviderConfig{"aws": {Type: "aws", Region: "us-east-1"}},
+				Output:       "text",
+				DefaultCloud: "aws",
+			},
+		},
+		"default context": {
+			context: "default",
+			want: &instances.Config{
+				Database:     instances.DatabaseConfig{Backend: "file", Path: "~/.instances.db.json", AuditLog: "~/.instances.audit.jsonl"},
+				Providers:    map[string]instances.ProviderConfig{"aws": {Type: "aws", Region: "us-east-1"}},
+				Output:       "text",
+				DefaultCloud: "aws",
+			},
+		},
+		"context from the environment": {
+			env: map[string]string{"INSTANCES_CONTEXT": "client-b"},
+			want: &instances.Config{
+				Database:     instances.DatabaseConfig{Backend: "file", Path: "/data/b.json", AuditLog: "~/.instances.client-b.audit.jsonl"},
+				Providers:    map[string]instances.ProviderConfig{"aws": {Type: "aws", Region: "us-east-1"}},
+				Output:       "text",
+				DefaultCloud: "aws",
+			},
+		},
+		"context overriding the environment": {
+			context: "default",
+			env:     map[string]string{"INSTANCES_CONTEXT": "client-b"},
+			want: &instances.Config{
+				Database:     instances.DatabaseConfig{Backend: "file", Path: "~/.instances.db.json", AuditLog: "~/.instances.audit.jsonl"},
+				Providers:    map[string]instances.ProviderConfig{"aws": {Type: "aws", Region: "us-east-1"}},
+				Output:       "text",
+				DefaultCloud: "aws",
+			},
+		},
+		"unknown context": {
+			context: "client-c",
+			wantErr: `no context named "client-c"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config, err := instances.LoadConfig(strings.NewReader(config), test.context, func(name string) string { return test.env[name] })
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.want != nil && !reflect.DeepEqual(config, test.want) {
+				t.Errorf("got config %+v, want %+v", config, test.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigContexts(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config  string
+		wantErr string
+	}{
+		"unknown current context": {
+			config:  `{"current-context": "client-a"}`,
+			wantErr: `no context named "client-a"`,
+		},
+		"invalid context name": {
+			config:  `{"contexts": {"client/a": {}}}`,
+			wantErr: `invalid context name "client/a"`,
+		},
+		"invalid context": {
+			config:  `{"contexts": {"client-a": {"providers": {"gcp": {"type": "gcp"}}}}}`,
+			wantErr: `context "client-a": provider "gcp": unsupported type`,
+		},
+		"default cloud of the default context": {
+			config:  `{"default-cloud": "aws", "contexts": {"client-a": {"providers": {"aws-a": {"type": "aws"}}}}}`,
+			wantErr: "",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := instances.ReadConfig(strings.NewReader(test.config))
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestContextCommand(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "instances", "config.json")
+
+	commands := []struct {
+		args    []string
+		wantErr string
+	}{
+		{args: []string{"create", "--profile", "client-a", "--use", "client-a"}},
+		{args: []string{"create", "--database", "/data/b.json", "client-b"}},
+		{args: []string{"create", "client-a"}, wantErr: "exists already"},
+		{args: []string{"create", "default"}, wantErr: "exists already"},
+		{args: []string{"create", "--endpoint", "localhost", "client-c"}, wantErr: "not an absolute URL"},
+		{args: []string{"create", "../client"}, wantErr: "invalid context name"},
+		{args: []string{"use", "client-c"}, wantErr: `no context named "client-c"`},
+		{args: []string{"remove", "client-a"}, wantErr: "unknown context command"},
+	}
+	for _, command := range commands {
+		err := instances.RunContextCommand(path, command.args, io.Discard)
+		if !errorContains(err, command.wantErr) {
+			t.Fatalf("context %v: unexpected error: %v", command.args, err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := instances.RunContextCommand(path, []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "name: client-a\tdatabase: ~/.instances.client-a.db.json\tproviders: aws\t(current)\n" +
+		"name: client-b\tdatabase: /data/b.json\tproviders: aws\n" +
+		"name: default\tdatabase: ~/.instances.db.json\tproviders: aws\n"
+	if out.String() != want {
+		t.Errorf("got contexts\n%s\nwant\n%s", out.String(), want)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got config file mode %v (error: %v), want 0600", info.Mode(), err)
+	}
+	config, err := instances.LoadConfig(f, "", func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider := config.Providers["aws"]; provider.Profile != "client-a" {
+		t.Errorf("got provider %+v in the current context, want the one of client-a", provider)
+	}
+
+	if err := instances.RunContextCommand(path, []string{"use", "default"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := instances.RunContextCommand(path, []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "name: default\tdatabase: ~/.instances.db.json\tproviders: aws\t(current)") {
+		t.Errorf("default context not current:\n%s", out.String())
+	}
+}
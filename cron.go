@@ -0,0 +1,152 @@
+package instances
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronExpr is a parsed standard 5-field cron expression
+// (minute, hour, day of month, month, day of week).
+type CronExpr struct {
+	minutes    uint64
+	hours      uint64
+	daysOfMon  uint64
+	months     uint64
+	daysOfWeek uint64
+	// domStar and dowStar record whether the day fields were unrestricted,
+	// which changes how they are combined (see Matches).
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Day of week accepts 7 as an alias for Sunday.
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// ParseCron parses a standard 5-field cron expression such as "0 8 * * 1-5".
+func ParseCron(expr string) (CronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return CronExpr{}, fmt.Errorf("cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	var c CronExpr
+	var err error
+	if c.minutes, err = cronMinute.parse(fields[0]); err != nil {
+		return CronExpr{}, fmt.Errorf("cron expression %q: %v", expr, err)
+	}
+	if c.hours, err = cronHour.parse(fields[1]); err != nil {
+		return CronExpr{}, fmt.Errorf("cron expression %q: %v", expr, err)
+	}
+	if c.daysOfMon, err = cronDom.parse(fields[2]); err != nil {
+		return CronExpr{}, fmt.Errorf("cron expression %q: %v", expr, err)
+	}
+	if c.months, err = cronMonth.parse(fields[3]); err != nil {
+		return CronExpr{}, fmt.Errorf("cron expression %q: %v", expr, err)
+	}
+	if c.daysOfWeek, err = cronDow.parse(fields[4]); err != nil {
+		return CronExpr{}, fmt.Errorf("cron expression %q: %v", expr, err)
+	}
+	if c.daysOfWeek&(1<<7) != 0 {
+		c.daysOfWeek |= 1
+	}
+	// Like in Vixie cron, steps over the whole range like */2 count as
+	// unrestricted.
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return c, nil
+}
+
+// Matches reports whether the expression fires at the minute containing t.
+// As in cron(8), when both day fields are restricted, a day matches if
+// either of them does.
+func (c CronExpr) Matches(t time.Time) bool {
+	if c.minutes&(1<<uint(t.Minute())) == 0 ||
+		c.hours&(1<<uint(t.Hour())) == 0 ||
+		c.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	domMatch := c.daysOfMon&(1<<uint(t.Day())) != 0
+	dowMatch := c.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			lo, err = f.value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = f.value(bounds[1])
+				if err != nil {
+					return 0, err
+				}
+			} else if step != 1 {
+				// "5/15" means "from 5 to the end, every 15".
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q in %s field", s, f.name)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d-%d] in %s field", v, f.min, f.max, f.name)
+	}
+	return v, nil
+}
@@ -0,0 +1,74 @@
+package instances_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+)
+
+func TestParseCron(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		expr    string
+		wantErr string
+	}{
+		"every minute":         {expr: "* * * * *"},
+		"weekdays":             {expr: "0 8 * * 1-5"},
+		"lists and steps":      {expr: "*/15 8,12,18 1-31/2 jan-jun mon,fri"},
+		"sunday as 7":          {expr: "0 0 * * 7"},
+		"too few fields":       {expr: "0 8 * *", wantErr: "expected 5 fields"},
+		"out of range":         {expr: "60 8 * * *", wantErr: "out of range"},
+		"invalid value":        {expr: "0 eight * * *", wantErr: "invalid value"},
+		"invalid step":         {expr: "*/0 * * * *", wantErr: "invalid step"},
+		"inverted range":       {expr: "0 8 * * 5-1", wantErr: "invalid range"},
+		"unknown day of week":  {expr: "0 8 * * funday", wantErr: "invalid value"},
+		"month name is parsed": {expr: "0 8 1 dec *"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := instances.ParseCron(test.expr)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	t.Parallel()
+	// 2023-04-10 is a Monday.
+	monday8 := time.Date(2023, 4, 10, 8, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		expr string
+		time time.Time
+		want bool
+	}{
+		"weekday at 8":                      {expr: "0 8 * * 1-5", time: monday8, want: true},
+		"weekday at 8, seconds ignored":     {expr: "0 8 * * 1-5", time: monday8.Add(30 * time.Second), want: true},
+		"weekday at 8, wrong minute":        {expr: "0 8 * * 1-5", time: monday8.Add(time.Minute), want: false},
+		"weekend only":                      {expr: "0 8 * * sat,sun", time: monday8, want: false},
+		"sunday as 7":                       {expr: "0 8 * * 7", time: monday8.AddDate(0, 0, 6), want: true},
+		"step":                              {expr: "*/15 * * * *", time: monday8.Add(45 * time.Minute), want: true},
+		"day of month or day of week":       {expr: "0 8 1 * 1", time: monday8, want: true},
+		"day of month only":                 {expr: "0 8 1 * *", time: monday8, want: false},
+		"day of month step and monday":      {expr: "0 8 */2 * 1", time: monday8, want: false},
+		"odd day of month and monday":       {expr: "0 8 */2 * 1", time: monday8.AddDate(0, 0, 7), want: true},
+		"odd day of month not monday":       {expr: "0 8 */2 * 1", time: monday8.AddDate(0, 0, 1), want: false},
+		"day of month and day of week step": {expr: "0 8 10 * */2", time: monday8, want: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := instances.ParseCron(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := expr.Matches(test.time); got != test.want {
+				t.Fatalf("Matches(%s) = %v, want %v", test.time, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package instances
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// defaultRefreshInterval is how often the dashboard event streams refresh the
+// instances by default.
+const defaultRefreshInterval = 5 * time.Second
+
+// dashboardInstance is an instance as shown by the dashboard.
+type dashboardInstance struct {
+	Name        string            `json:"name"`
+	Cloud       string            `json:"cloud"`
+	Group       string            `json:"group,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	LeaseExpiry *time.Time        `json:"lease-expiry,omitempty"`
+	State       InstanceState     `json:"state,omitempty"`
+	CanOperate  bool              `json:"can-operate"`
+}
+
+func (s *Server) getDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// streamDashboardEvents sends the instances readable by the principal of the
+// request, with their state, as server-sent events. An event is sent when the
+// stream starts, and then whenever the instances change, as checked every
+// refresh interval or when an event is published on the event bus.
+func (s *Server) streamDashboardEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming unsupported"))
+		return
+	}
+
+	_, _, events, cancel := s.manager.Events().Subscribe(0, false)
+	defer cancel()
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	principal := principalFrom(r.Context())
+	var last []byte
+	for {
+		data, err := json.Marshal(s.dashboardInstances(principal))
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(data, last) {
+			if _, err := fmt.Fprintf(w, "event: instances\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+			last = data
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		case _, ok := <-events:
+			if !ok {
+				// Too slow, the page reconnects.
+				return
+			}
+		}
+	}
+}
+
+// dashboardInstances returns the instances readable by principal with their
+// last observed state, so that the streams don't call the cloud providers:
+// the states are polled by the server, and returned by the operations.
+func (s *Server) dashboardInstances(principal *Principal) []dashboardInstance {
+	instances := []dashboardInstance{}
+	for _, instance := range s.manager.Instances() {
+		if !principal.Can(PermissionRead, instance.Instance) {
+			continue
+		}
+
+		item := dashboardInstance{
+			Name:        instance.Name,
+			Cloud:       instance.CloudProviderName,
+			Group:       instance.Group,
+			Tags:        instance.Tags,
+			LeaseExpiry: instance.LeaseExpiry,
+			CanOperate:  principal.Can(PermissionOperate, instance.Instance),
+		}
+		if item.CanOperate && s.manager.IsProtected(instance.Name) {
+			item.CanOperate = principal.Can(PermissionChangeProtected, instance.Instance)
+		}
+		if record, ok := s.manager.LastObservation(instance.Name); ok {
+			item.State = record.State
+		}
+		instances = append(instances, item)
+	}
+	return instances
+}
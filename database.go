@@ -1,38 +1,130 @@
 package instances
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
 )
 
 type Database struct {
 	Instances map[string]Instance `json:"instances"`
-	support   io.ReadWriter
+	Schedules map[string]Schedule `json:"schedules,omitempty"`
+	Actions   []Action            `json:"actions,omitempty"`
+	// DefaultAutoStop is the auto-stop policy of the instances without
+	// their own.
+	DefaultAutoStop *AutoStopPolicy    `json:"default-auto-stop,omitempty"`
+	Transitions     []StateRecord      `json:"transitions,omitempty"`
+	Webhooks        map[string]Webhook `json:"webhooks,omitempty"`
+	// ProtectedGroups are the groups whose instances are all protected.
+	ProtectedGroups []string `json:"protected-groups,omitempty"`
+	support         io.ReadWriter
+	logger          *slog.Logger
 }
 
+// DatabaseOption configures optional behavior of a Database.
+type DatabaseOption func(*Database)
+
+// WithDatabaseLogger sets the logger of the database. By default, it doesn't
+// log.
+func WithDatabaseLogger(logger *slog.Logger) DatabaseOption {
+	return func(d *Database) {
+		d.logger = logger
+	}
+}
+
+// maxActions and maxTransitions are the number of actions and state
+// transitions kept in the database, older ones are dropped first.
+const (
+	maxActions     = 1000
+	maxTransitions = 10000
+)
+
 // NewDatabase creates a new Database populated with the content read from the given
 // io.ReadWriter.
-func NewDatabase(support io.ReadWriter) (*Database, error) {
+func NewDatabase(support io.ReadWriter, opts ...DatabaseOption) (*Database, error) {
+	return NewDatabaseContext(context.Background(), support, opts...)
+}
+
+// NewDatabaseContext is like NewDatabase, with the load traced as part of the
+// operation of ctx.
+func NewDatabaseContext(ctx context.Context, support io.ReadWriter, opts ...DatabaseOption) (_ *Database, err error) {
+	_, span := tracer().Start(ctx, "database.load")
+	defer func() { endSpan(span, err) }()
+
 	database := Database{
 		support: support,
+		logger:  discardLogger,
 	}
-	err := json.NewDecoder(support).Decode(&database)
-	if err != nil {
+	for _, opt := range opts {
+		opt(&database)
+	}
+	if err := json.NewDecoder(support).Decode(&database); err != nil {
 		return &database, fmt.Errorf("open database: %s", err)
 	}
 
 	return &database, nil
 }
 
-// Save saves the database to the provided io.Writer.
+// Reload replaces the content of the database with the content of its
+// support, to pick up changes made by other processes. It is a no-op when the
+// support cannot be rewound.
+func (d *Database) Reload() (err error) {
+	_, span := tracer().Start(context.Background(), "database.reload")
+	defer func() { endSpan(span, err) }()
+
+	s, ok := d.support.(io.Seeker)
+	if !ok {
+		return nil
+	}
+
+	if _, err := s.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("reload database: %s", err)
+	}
+
+	reloaded := Database{support: d.support, logger: d.logger}
+	if err := json.NewDecoder(d.support).Decode(&reloaded); err != nil {
+		return fmt.Errorf("reload database: %s", err)
+	}
+	*d = reloaded
+
+	return nil
+}
+
+// Save saves the database to the provided io.Writer. If the support can be
+// truncated and rewound (like an *os.File), its previous content is replaced.
+// A DatabaseFile is replaced atomically.
 func (d *Database) Save() error {
+	return d.SaveContext(context.Background())
+}
+
+// SaveContext is like Save, with the save traced as part of the operation of
+// ctx.
+func (d *Database) SaveContext(ctx context.Context) (err error) {
+	_, span := tracer().Start(ctx, "database.save")
+	defer func() { endSpan(span, err) }()
+
 	b, err := json.MarshalIndent(d, "", "  ")
 	if err != nil {
 		return fmt.Errorf("serialize database: %s", err)
 	}
 
+	if t, ok := d.support.(interface {
+		io.Seeker
+		Truncate(size int64) error
+	}); ok {
+		if err = t.Truncate(0); err != nil {
+			return fmt.Errorf("save database: %s", err)
+		}
+		if _, err = t.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("save database: %s", err)
+		}
+	}
+
 	_, err = d.support.Write(b)
 	if err != nil {
 		return fmt.Errorf("save database: %s", err)
@@ -40,26 +132,162 @@ func (d *Database) Save() error {
 	return nil
 }
 
+// locker is implemented by the supports which can be locked against the
+// other processes changing them, like DatabaseFile.
+type locker interface {
+	Lock() (unlock func() error, err error)
+}
+
+// lock locks the support of the database against the other processes
+// changing it, if it can be locked, until the returned function is called.
+func (d *Database) lock() (unlock func() error, err error) {
+	locker, ok := d.support.(locker)
+	if !ok {
+		return func() error { return nil }, nil
+	}
+	return locker.Lock()
+}
+
+// Update reloads the database, applies change and saves the database, with
+// its support locked, so that the changes made by other processes are kept.
+// The database is saved even if change fails, as it may have recorded part
+// of its work, like failed actions.
+func (d *Database) Update(ctx context.Context, change func() error) (err error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil && unlockErr != nil {
+			err = fmt.Errorf("unlock database: %v", unlockErr)
+		}
+	}()
+
+	if err := d.Reload(); err != nil {
+		return err
+	}
+	err = change()
+	if saveErr := d.SaveContext(ctx); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// clone returns a copy of the database, without support, which can be
+// changed without changing the database.
+func (d *Database) clone() (*Database, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("copy database: %s", err)
+	}
+	clone := Database{logger: d.logger}
+	if err := json.Unmarshal(b, &clone); err != nil {
+		return nil, fmt.Errorf("copy database: %s", err)
+	}
+	return &clone, nil
+}
+
 // AddInstance adds an instance to the database.
 func (d *Database) AddInstance(id string, name string, cloudProvider CloudProvider) error {
-	log.Printf("adding instance %s", id)
+	d.logger.Debug("adding instance", "id", id, "name", name, "cloud", cloudProvider.GetName())
 
 	if _, instanceExists := d.Instances[name]; instanceExists {
-		return fmt.Errorf("instance %q exists already", name)
+		return Errorf(ErrConflict, "instance %q exists already", name)
+	}
+
+	if err := d.checkInstanceID(id, name, cloudProvider); err != nil {
+		return err
 	}
 
+	d.Instances[name] = Instance{Id: id, CloudProviderName: cloudProvider.GetName()}
+
+	return nil
+}
+
+// checkInstanceID checks that the instance id exists in the cloud provider
+// and isn't referenced by an instance other than the one named name.
+func (d *Database) checkInstanceID(id string, name string, cloudProvider CloudProvider) error {
 	for instanceName, instance := range d.Instances {
-		if instance.Id == id {
-			return fmt.Errorf("instance id %q already referenced by instance %q", id, instanceName)
+		if instance.Id == id && instanceName != name {
+			return Errorf(ErrConflict, "instance id %q already referenced by instance %q", id, instanceName)
 		}
 	}
 
 	_, err := cloudProvider.GetInstanceStatus(id)
+	return err
+}
+
+// RenameInstance renames an instance, along with the references to it in
+// the schedules, the webhooks and the recorded actions and states.
+func (d *Database) RenameInstance(name string, newName string) error {
+	d.logger.Debug("renaming instance", "name", name, "new_name", newName)
+
+	instance, err := d.GetInstance(name)
 	if err != nil {
 		return err
 	}
 
-	d.Instances[name] = Instance{Id: id, CloudProviderName: cloudProvider.GetName()}
+	if newName == "" {
+		return Errorf(ErrInvalidArgument, "instance name cannot be empty")
+	}
+
+	if _, instanceExists := d.Instances[newName]; instanceExists {
+		return Errorf(ErrConflict, "instance %q exists already", newName)
+	}
+
+	delete(d.Instances, name)
+	d.Instances[newName] = instance
+
+	for scheduleName, schedule := range d.Schedules {
+		if schedule.Instance == name {
+			schedule.Instance = newName
+			d.Schedules[scheduleName] = schedule
+		}
+	}
+	for webhookName, webhook := range d.Webhooks {
+		if i := slices.Index(webhook.Instances, name); i >= 0 {
+			webhook.Instances = slices.Clone(webhook.Instances)
+			webhook.Instances[i] = newName
+			d.Webhooks[webhookName] = webhook
+		}
+	}
+	for i := range d.Actions {
+		if d.Actions[i].Instance == name {
+			d.Actions[i].Instance = newName
+		}
+	}
+	for i := range d.Transitions {
+		if d.Transitions[i].Instance == name {
+			d.Transitions[i].Instance = newName
+		}
+	}
+
+	return nil
+}
+
+// RepointInstance makes an instance track the instance id of another cloud
+// provider or of the same one, like when it was replaced by a new instance,
+// keeping its group, tags, schedules and history. The uniqueness of the ID
+// and its existence are checked like by AddInstance.
+func (d *Database) RepointInstance(name string, id string, cloudProvider CloudProvider) error {
+	d.logger.Debug("repointing instance", "name", name, "id", id, "cloud", cloudProvider.GetName())
+
+	instance, err := d.GetInstance(name)
+	if err != nil {
+		return err
+	}
+
+	if err := d.checkInstanceID(id, name, cloudProvider); err != nil {
+		return err
+	}
+
+	if instance.Id != id || !strings.EqualFold(instance.CloudProviderName, cloudProvider.GetName()) {
+		// The type and region are the ones of the previous instance.
+		instance.Type, instance.Region = "", ""
+	}
+	instance.Id = id
+	instance.CloudProviderName = cloudProvider.GetName()
+	d.Instances[name] = instance
 
 	return nil
 }
@@ -68,17 +296,257 @@ func (d *Database) AddInstance(id string, name string, cloudProvider CloudProvid
 func (d *Database) GetInstance(name string) (Instance, error) {
 	instance, instanceExists := d.Instances[name]
 	if !instanceExists {
-		return Instance{}, fmt.Errorf("no instance named %s", name)
+		return Instance{}, Errorf(ErrNotFound, "no instance named %s", name)
 	}
 	return instance, nil
 }
 
-// RemoveInstance removes an instance from the database
+// RemoveInstance removes an instance from the database, along with its
+// schedules, which an instance added later under the same name mustn't
+// inherit.
 func (d *Database) RemoveInstance(name string) error {
 	_, instanceExists := d.Instances[name]
 	if !instanceExists {
-		return fmt.Errorf("no instance named %s", name)
+		return Errorf(ErrNotFound, "no instance named %s", name)
 	}
 	delete(d.Instances, name)
+	for scheduleName, schedule := range d.Schedules {
+		if schedule.Instance == name {
+			delete(d.Schedules, scheduleName)
+		}
+	}
+	return nil
+}
+
+// AddSchedule adds a named schedule to the database, replacing any existing
+// schedule with the same name.
+func (d *Database) AddSchedule(name string, schedule Schedule) error {
+	if name == "" {
+		return fmt.Errorf("schedule name cannot be empty")
+	}
+
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	if schedule.Instance != "" {
+		if _, instanceExists := d.Instances[schedule.Instance]; !instanceExists {
+			return Errorf(ErrNotFound, "no instance named %s", schedule.Instance)
+		}
+	}
+
+	if d.Schedules == nil {
+		d.Schedules = map[string]Schedule{}
+	}
+	d.Schedules[name] = schedule
+
+	return nil
+}
+
+// RemoveSchedule removes a schedule from the database
+func (d *Database) RemoveSchedule(name string) error {
+	if _, scheduleExists := d.Schedules[name]; !scheduleExists {
+		return Errorf(ErrNotFound, "no schedule named %s", name)
+	}
+	delete(d.Schedules, name)
+	return nil
+}
+
+// AddWebhook adds a named webhook to the database, replacing any existing
+// webhook with the same name.
+func (d *Database) AddWebhook(name string, webhook Webhook) error {
+	if name == "" {
+		return fmt.Errorf("webhook name cannot be empty")
+	}
+
+	if err := webhook.Validate(); err != nil {
+		return err
+	}
+
+	if d.Webhooks == nil {
+		d.Webhooks = map[string]Webhook{}
+	}
+	d.Webhooks[name] = webhook
+
+	return nil
+}
+
+// RemoveWebhook removes a webhook from the database.
+func (d *Database) RemoveWebhook(name string) error {
+	if _, webhookExists := d.Webhooks[name]; !webhookExists {
+		return Errorf(ErrNotFound, "no webhook named %s", name)
+	}
+	delete(d.Webhooks, name)
+	return nil
+}
+
+// UpdateInstance applies update to the instance stored under name.
+func (d *Database) UpdateInstance(name string, update func(*Instance)) error {
+	instance, instanceExists := d.Instances[name]
+	if !instanceExists {
+		return Errorf(ErrNotFound, "no instance named %s", name)
+	}
+	update(&instance)
+	d.Instances[name] = instance
+	return nil
+}
+
+// SetOverride sets or, when override is nil, clears the manual override of
+// an instance.
+func (d *Database) SetOverride(name string, override *Override) error {
+	return d.UpdateInstance(name, func(instance *Instance) {
+		instance.Override = override
+	})
+}
+
+// SetAutoStopPolicy sets or, when policy is nil, removes the auto-stop
+// policy of an instance, or the default one when name is empty.
+func (d *Database) SetAutoStopPolicy(name string, policy *AutoStopPolicy) error {
+	if policy != nil {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if name == "" {
+		d.DefaultAutoStop = policy
+		return nil
+	}
+
+	return d.UpdateInstance(name, func(instance *Instance) {
+		instance.AutoStop = policy
+	})
+}
+
+// AutoStopPolicy returns the auto-stop policy applying to an instance, or nil
+// if there is none or the instance opted out.
+func (d *Database) AutoStopPolicy(name string) *AutoStopPolicy {
+	instance, instanceExists := d.Instances[name]
+	if !instanceExists || instance.AutoStopOptOut {
+		return nil
+	}
+	if instance.AutoStop != nil {
+		return instance.AutoStop
+	}
+	return d.DefaultAutoStop
+}
+
+// SetLease sets or, when expiry is nil, clears the lease of an instance.
+// Protected instances can't have a lease.
+func (d *Database) SetLease(name string, expiry *time.Time) error {
+	if expiry != nil && d.IsProtected(name) {
+		return protectedLeaseError(name)
+	}
+	return d.UpdateInstance(name, func(instance *Instance) {
+		instance.LeaseExpiry = expiry
+	})
+}
+
+// ExtendLease pushes back the lease expiry of an instance by the given
+// duration. An expired lease is extended from now.
+func (d *Database) ExtendLease(name string, duration time.Duration, now time.Time) (time.Time, error) {
+	instance, err := d.GetInstance(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if instance.LeaseExpiry == nil {
+		return time.Time{}, fmt.Errorf("instance %q has no lease", name)
+	}
+
+	if duration <= 0 {
+		return time.Time{}, fmt.Errorf("lease extension must be positive")
+	}
+
+	expiry := *instance.LeaseExpiry
+	if expiry.Before(now) {
+		expiry = now
+	}
+	expiry = expiry.Add(duration)
+
+	if err := d.SetLease(name, &expiry); err != nil {
+		return time.Time{}, err
+	}
+	return expiry, nil
+}
+
+// protectedLeaseError is the error of setting a lease on a protected
+// instance, which the daemon wouldn't stop.
+func protectedLeaseError(name string) error {
+	return Errorf(ErrInvalidState, "instance %q is protected, it can't have a lease", name)
+}
+
+// SetProtected protects or unprotects an instance.
+func (d *Database) SetProtected(name string, protected bool) error {
+	return d.UpdateInstance(name, func(instance *Instance) {
+		instance.Protected = protected
+	})
+}
+
+// SetGroupProtected protects or unprotects all the instances of a group,
+// whatever their own protection.
+func (d *Database) SetGroupProtected(group string, protected bool) error {
+	if group == "" {
+		return Errorf(ErrInvalidArgument, "group name cannot be empty")
+	}
+
+	i := slices.Index(d.ProtectedGroups, group)
+	switch {
+	case protected && i < 0:
+		d.ProtectedGroups = append(d.ProtectedGroups, group)
+		slices.Sort(d.ProtectedGroups)
+	case !protected && i >= 0:
+		d.ProtectedGroups = slices.Delete(d.ProtectedGroups, i, i+1)
+	}
 	return nil
 }
+
+// IsProtected reports whether an instance is protected, on its own or by
+// its group.
+func (d *Database) IsProtected(name string) bool {
+	instance, instanceExists := d.Instances[name]
+	if !instanceExists {
+		return false
+	}
+	return instance.Protected || (instance.Group != "" && slices.Contains(d.ProtectedGroups, instance.Group))
+}
+
+// RecordAction appends an action to the database history.
+func (d *Database) RecordAction(action Action) {
+	d.Actions = append(d.Actions, action)
+	if len(d.Actions) > maxActions {
+		d.Actions = d.Actions[len(d.Actions)-maxActions:]
+	}
+}
+
+// ObserveState records the observed state of an instance if it differs from
+// the last one recorded, and reports whether it did.
+func (d *Database) ObserveState(record StateRecord) bool {
+	if state, known := d.LastState(record.Instance); known && state == record.State {
+		return false
+	}
+
+	d.Transitions = append(d.Transitions, record)
+	if len(d.Transitions) > maxTransitions {
+		d.Transitions = d.Transitions[len(d.Transitions)-maxTransitions:]
+	}
+	return true
+}
+
+// LastState returns the last recorded state of an instance, and whether
+// there is one.
+func (d *Database) LastState(name string) (InstanceState, bool) {
+	record, ok := d.LastObservation(name)
+	return record.State, ok
+}
+
+// LastObservation returns the last recorded transition of an instance, when
+// it entered its current state, and whether there is one.
+func (d *Database) LastObservation(name string) (StateRecord, bool) {
+	for i := len(d.Transitions) - 1; i >= 0; i-- {
+		if d.Transitions[i].Instance == name {
+			return d.Transitions[i], true
+		}
+	}
+	return StateRecord{}, false
+}
@@ -0,0 +1,87 @@
+package instances
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DatabaseFile is the support of a database stored in the file at Path.
+// Unlike an *os.File, its content is replaced atomically when the database
+// is saved, so that other processes never read a partial database, and it
+// can be locked against the other processes changing it (see
+// Database.Update).
+type DatabaseFile struct {
+	Path string
+	// content is the content being read, nil until the first read after
+	// the file is rewound.
+	content io.Reader
+}
+
+// Read reads the content of the file, as it was at the first read after the
+// file was rewound.
+func (f *DatabaseFile) Read(p []byte) (int, error) {
+	if f.content == nil {
+		b, err := os.ReadFile(f.Path)
+		if err != nil {
+			return 0, err
+		}
+		f.content = bytes.NewReader(b)
+	}
+	return f.content.Read(p)
+}
+
+// Seek rewinds the file, so that the next read gets its current content.
+// Only rewinding to the start is supported.
+func (f *DatabaseFile) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("database file can only be rewound")
+	}
+	f.content = nil
+	return 0, nil
+}
+
+// Write replaces the content of the file with p, through a temporary file
+// renamed over it.
+func (f *DatabaseFile) Write(p []byte) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(p); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Lock locks the file against the other processes locking it, until the
+// returned function is called. The lock is held on a separate file, next to
+// the database, as the database file itself is replaced on every save.
+func (f *DatabaseFile) Lock() (unlock func() error, err error) {
+	file, err := os.OpenFile(f.Path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("lock database: %v", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("lock database: %v", err)
+	}
+	return func() error {
+		err := unlockFile(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
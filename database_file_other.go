@@ -0,0 +1,15 @@
+//go:build !unix
+
+package instances
+
+import "os"
+
+// lockFile doesn't lock f: on these systems, the processes changing the
+// database aren't locked against each other.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
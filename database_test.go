@@ -2,12 +2,17 @@ package instances_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
 )
 
 // ErrorContains checks if the error message in out contains the text in
@@ -26,27 +31,14 @@ var existingInstanceIds = []string{"existingInstance1", "existingInstance2"}
 
 const existingInstanceName = "myInstance"
 
-type MockCloudProvider struct{}
-
-func (m MockCloudProvider) GetInstanceStatus(id string) (instances.InstanceState, error) {
-	switch id {
-	case existingInstanceIds[0], existingInstanceIds[1]:
-		return instances.InstanceStateRunning, nil
-	default:
-		return "", fmt.Errorf("instance %q not found in the cloud provider", id)
+// newTestCloud returns a fake cloud named "mock", in which the instances
+// existingInstanceIds are running.
+func newTestCloud() *fakecloud.Cloud {
+	cloud := fakecloud.New(fakecloud.WithName("mock"))
+	for _, id := range existingInstanceIds {
+		cloud.AddInstance(id, instances.InstanceStateRunning, instances.InstanceDetails{})
 	}
-}
-
-func (m MockCloudProvider) StartInstance(id string) error {
-	return nil
-}
-
-func (m MockCloudProvider) StopInstance(id string) error {
-	return nil
-}
-
-func (m MockCloudProvider) GetName() string {
-	return "mock"
+	return cloud
 }
 
 func TestNewDatabase(t *testing.T) {
@@ -89,7 +81,7 @@ func TestAddInstanceDBCloudProviderCheck(t *testing.T) {
 		},
 		"instance does not exist in cloud provider": {
 			instanceId: "noExists",
-			wantErr:    "not found in the cloud provider",
+			wantErr:    "not found",
 		},
 	}
 
@@ -101,7 +93,7 @@ func TestAddInstanceDBCloudProviderCheck(t *testing.T) {
 				t.Fatalf("could not acquire db: %s", err)
 			}
 
-			err = db.AddInstance(test.instanceId, "instanceName", MockCloudProvider{})
+			err = db.AddInstance(test.instanceId, "instanceName", newTestCloud())
 
 			if !errorContains(err, test.wantErr) {
 				t.Fatalf("unexpected error: %v", err)
@@ -134,12 +126,12 @@ func TestAddInstanceDBNameCheck(t *testing.T) {
 				t.Fatalf("could not acquire db: %s", err)
 			}
 
-			err = db.AddInstance(existingInstanceIds[0], "alreadyPresent", MockCloudProvider{})
+			err = db.AddInstance(existingInstanceIds[0], "alreadyPresent", newTestCloud())
 			if err != nil {
 				t.Fatal("failed to add pre-required instance")
 			}
 
-			err = db.AddInstance(existingInstanceIds[1], test.instanceName, MockCloudProvider{})
+			err = db.AddInstance(existingInstanceIds[1], test.instanceName, newTestCloud())
 			if !errorContains(err, test.wantErr) {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -166,7 +158,7 @@ func TestAddInstanceDBIdCheck(t *testing.T) {
 				t.Fatalf("test setup failed: %v", err)
 			}
 
-			err = db.AddInstance(test.instanceId, "testInstance", MockCloudProvider{})
+			err = db.AddInstance(test.instanceId, "testInstance", newTestCloud())
 			if !errorContains(err, test.wantErr) {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -181,7 +173,7 @@ func getInitializedDatabase() (*instances.Database, error) {
 		return nil, fmt.Errorf("could not acquire db: %s", err)
 	}
 
-	err = db.AddInstance(existingInstanceIds[0], existingInstanceName, MockCloudProvider{})
+	err = db.AddInstance(existingInstanceIds[0], existingInstanceName, newTestCloud())
 	if err != nil {
 		return nil, errors.New("failed to add pre-required instance")
 	}
@@ -241,11 +233,143 @@ func TestRemoveInstanceDB(t *testing.T) {
 			if err != nil {
 				t.Fatalf("test setup failed: %v", err)
 			}
+			for scheduleName, schedule := range map[string]instances.Schedule{
+				"nightly":      {Instance: existingInstanceName, Stop: "0 19 * * *"},
+				"office-hours": {Group: "dev", Start: "0 8 * * 1-5"},
+			} {
+				if err := db.AddSchedule(scheduleName, schedule); err != nil {
+					t.Fatal(err)
+				}
+			}
 
 			err = db.RemoveInstance(test.instanceName)
 			if !errorContains(err, test.wantErr) {
 				t.Fatalf("unexpected error: %v", err)
 			}
+
+			// Only the schedules of the removed instance are removed.
+			_, kept := db.Schedules["nightly"]
+			if kept != (err != nil) {
+				t.Errorf("schedule of the instance kept: %v", kept)
+			}
+			if _, kept := db.Schedules["office-hours"]; !kept {
+				t.Errorf("schedule of the group removed")
+			}
+		})
+	}
+}
+
+func TestRenameInstanceDB(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	if err := db.AddInstance(existingInstanceIds[1], "other", newTestCloud()); err != nil {
+		t.Fatal(err)
+	}
+	db.Instances[existingInstanceName] = instances.Instance{Id: existingInstanceIds[0], CloudProviderName: "mock", Tags: map[string]string{"env": "dev"}}
+	db.Schedules = map[string]instances.Schedule{"office-hours": {Instance: existingInstanceName, Stop: "0 19 * * *"}}
+	db.Webhooks = map[string]instances.Webhook{"chat": {URL: "https://example.com", Instances: []string{"other", existingInstanceName}}}
+	db.RecordAction(instances.Action{Instance: existingInstanceName, Action: instances.ActionStop})
+	db.ObserveState(instances.StateRecord{Instance: existingInstanceName, State: instances.InstanceStateStopped})
+
+	if err := db.RenameInstance(existingInstanceName, "other"); !errorContains(err, "exists already") {
+		t.Fatalf("unexpected error renaming to an existing name: %v", err)
+	}
+	if err := db.RenameInstance("iDontExist", "renamed"); !errorContains(err, "no instance named") {
+		t.Fatalf("unexpected error renaming a nonexisting instance: %v", err)
+	}
+	if err := db.RenameInstance(existingInstanceName, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.GetInstance(existingInstanceName); err == nil {
+		t.Error("instance still tracked under its previous name")
+	}
+	instance, err := db.GetInstance("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Tags["env"] != "dev" {
+		t.Errorf("got tags %v, want env=dev", instance.Tags)
+	}
+	if schedule := db.Schedules["office-hours"]; schedule.Instance != "renamed" {
+		t.Errorf("got schedule instance %q, want renamed", schedule.Instance)
+	}
+	if webhook := db.Webhooks["chat"]; webhook.Instances[1] != "renamed" {
+		t.Errorf("got webhook instances %v, want renamed", webhook.Instances)
+	}
+	if db.Actions[0].Instance != "renamed" {
+		t.Errorf("got action instance %q, want renamed", db.Actions[0].Instance)
+	}
+	if state, known := db.LastState("renamed"); !known || state != instances.InstanceStateStopped {
+		t.Errorf("got last state %q (known: %v), want stopped", state, known)
+	}
+}
+
+func TestRepointInstanceDB(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		instanceName string
+		instanceId   string
+		wantErr      string
+	}{
+		"new instance id": {
+			instanceName: existingInstanceName,
+			instanceId:   existingInstanceIds[1],
+			wantErr:      "",
+		},
+		"same instance id": {
+			instanceName: existingInstanceName,
+			instanceId:   existingInstanceIds[0],
+			wantErr:      "",
+		},
+		"instance id referenced by another instance": {
+			instanceName: "other",
+			instanceId:   existingInstanceIds[0],
+			wantErr:      "already referenced",
+		},
+		"instance does not exist in cloud provider": {
+			instanceName: existingInstanceName,
+			instanceId:   "noExists",
+			wantErr:      "not found",
+		},
+		"nonexisting instance": {
+			instanceName: "iDontExist",
+			instanceId:   existingInstanceIds[1],
+			wantErr:      "no instance named",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+			db.Instances["other"] = instances.Instance{Id: "anotherId", CloudProviderName: "mock"}
+			if err := db.UpdateInstance(existingInstanceName, func(instance *instances.Instance) {
+				instance.Group = "dev"
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.RepointInstance(test.instanceName, test.instanceId, newTestCloud())
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+
+			instance, err := db.GetInstance(test.instanceName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if instance.Id != test.instanceId || instance.Group != "dev" {
+				t.Errorf("got instance %+v, want ID %q in group dev", instance, test.instanceId)
+			}
 		})
 	}
 }
@@ -262,3 +386,57 @@ func TestSaveDatabase(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// openDatabaseFile opens the database stored at path, like another
+// invocation would.
+func openDatabaseFile(t *testing.T, path string) *instances.Database {
+	t.Helper()
+	db, err := instances.NewDatabase(&instances.DatabaseFile{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDatabaseFileUpdate(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(path, []byte(`{"instances": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cloud := newTestCloud()
+
+	// Both databases are loaded before either is changed.
+	first, second := openDatabaseFile(t, path), openDatabaseFile(t, path)
+	for i, db := range []*instances.Database{first, second} {
+		name := []string{"a", "b"}[i]
+		err := db.Update(context.Background(), func() error {
+			return db.AddInstance(existingInstanceIds[i], name, cloud)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := openDatabaseFile(t, path)
+	if got := sortedNames(saved); got != "a, b" {
+		t.Fatalf("got saved instances %s, want a, b", got)
+	}
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0] != path+".lock" {
+		t.Errorf("got files %v next to the database, want only its lock", matches)
+	}
+}
+
+// sortedNames returns the names of the instances of db, sorted.
+func sortedNames(db *instances.Database) string {
+	var names []string
+	for name := range db.Instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,39 @@
+package instances_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+)
+
+func TestParseDuration(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		input   string
+		want    time.Duration
+		wantErr string
+	}{
+		"hours":         {input: "2h", want: 2 * time.Hour},
+		"mixed":         {input: "1h30m", want: 90 * time.Minute},
+		"days":          {input: "30d", want: 30 * 24 * time.Hour},
+		"invalid":       {input: "soon", wantErr: "invalid duration"},
+		"invalid days":  {input: "1.5d", wantErr: "invalid duration"},
+		"zero days":     {input: "0d", wantErr: "must be positive"},
+		"zero":          {input: "0s", wantErr: "must be positive"},
+		"negative":      {input: "-2h", wantErr: "must be positive"},
+		"negative days": {input: "-3d", wantErr: "must be positive"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := instances.ParseDuration(test.input)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package instances
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors returned by the operations, to be checked with errors.Is.
+var (
+	// ErrNotFound is returned when an object doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when an object conflicts with an existing one.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidArgument is returned when an operation is given an invalid
+	// argument.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrUnauthenticated is returned when the caller of an operation can't be
+	// identified.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrPermissionDenied is returned when the caller of an operation isn't
+	// allowed to perform it.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrInvalidState is returned when an operation isn't possible in the
+	// current state of an instance.
+	ErrInvalidState = errors.New("invalid state")
+	// ErrUnsupported is returned when an operation isn't supported by the
+	// cloud provider of an instance.
+	ErrUnsupported = errors.New("unsupported")
+)
+
+// kindError is an error with its own message, matching one of the kinds of
+// errors.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e kindError) Error() string {
+	return e.msg
+}
+
+func (e kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Errorf formats an error of the given kind, one of the errors above, so that
+// the cloud providers of other packages return the same kinds of errors.
+func Errorf(kind error, format string, args ...any) error {
+	return kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
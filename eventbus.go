@@ -0,0 +1,90 @@
+package instances
+
+import "sync"
+
+// defaultEventBusCapacity is the number of events an EventBus keeps for the
+// subscribers resuming from a cursor.
+const defaultEventBusCapacity = 1000
+
+// eventBufferSize is the number of events a subscriber can lag behind
+// before being unsubscribed.
+const eventBufferSize = 64
+
+// EventBus broadcasts the events of the lifecycle operations and status
+// polling to subscribers, and keeps the latest ones so that subscribers can
+// resume from the ID of the last event they received. It is safe for
+// concurrent use.
+type EventBus struct {
+	mu          sync.Mutex
+	capacity    int
+	events      []Event
+	lastID      uint64
+	subscribers map[chan Event]struct{}
+}
+
+func NewEventBus(capacity int) *EventBus {
+	return &EventBus{capacity: capacity, subscribers: map[chan Event]struct{}{}}
+}
+
+// Publish assigns the next ID to an event and sends it to the subscribers.
+// Subscribers too slow to receive it are unsubscribed, their channel is
+// closed.
+func (b *EventBus) Publish(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event.ID = b.lastID
+	b.events = append(b.events, event)
+	if len(b.events) > b.capacity {
+		b.events = b.events[len(b.events)-b.capacity:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return event
+}
+
+// Subscribe returns the kept events following the one with ID after, and a
+// channel receiving the events published from now on, until cancel is
+// called. When resume is false, no kept event is returned. missed reports
+// whether events following after aren't kept anymore, or after is unknown.
+func (b *EventBus) Subscribe(after uint64, resume bool) (backlog []Event, missed bool, events <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if resume {
+		if after > b.lastID {
+			// The cursor comes from a previous run.
+			missed = true
+			after = 0
+		}
+		if len(b.events) > 0 && after+1 < b.events[0].ID {
+			missed = true
+		}
+		for _, event := range b.events {
+			if event.ID > after {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, eventBufferSize)
+	b.subscribers[ch] = struct{}{}
+
+	return backlog, missed, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, subscribed := b.subscribers[ch]; subscribed {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package instances_test
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nonatomiclabs/instances"
+)
+
+func TestEventBusSubscribe(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		after       uint64
+		resume      bool
+		wantBacklog []uint64
+		wantMissed  bool
+	}{
+		"live events only": {
+			after:  2,
+			resume: false,
+		},
+		"resume from the start": {
+			after:       0,
+			resume:      true,
+			wantBacklog: []uint64{3, 4, 5},
+			wantMissed:  true,
+		},
+		"resume from a kept event": {
+			after:       3,
+			resume:      true,
+			wantBacklog: []uint64{4, 5},
+		},
+		"resume from the event before the oldest kept": {
+			after:       2,
+			resume:      true,
+			wantBacklog: []uint64{3, 4, 5},
+		},
+		"resume from a dropped event": {
+			after:       1,
+			resume:      true,
+			wantBacklog: []uint64{3, 4, 5},
+			wantMissed:  true,
+		},
+		"resume from the last event": {
+			after:  5,
+			resume: true,
+		},
+		"resume from a previous run": {
+			after:       42,
+			resume:      true,
+			wantBacklog: []uint64{3, 4, 5},
+			wantMissed:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			bus := instances.NewEventBus(3)
+			for i := 0; i < 5; i++ {
+				bus.Publish(instances.Event{Type: instances.EventAction})
+			}
+
+			backlog, missed, events, cancel := bus.Subscribe(test.after, test.resume)
+			defer cancel()
+
+			var ids []uint64
+			for _, event := range backlog {
+				ids = append(ids, event.ID)
+			}
+			if len(ids) != len(test.wantBacklog) {
+				t.Fatalf("got backlog %v, want %v", ids, test.wantBacklog)
+			}
+			for i := range ids {
+				if ids[i] != test.wantBacklog[i] {
+					t.Fatalf("got backlog %v, want %v", ids, test.wantBacklog)
+				}
+			}
+			if missed != test.wantMissed {
+				t.Fatalf("got missed %t, want %t", missed, test.wantMissed)
+			}
+
+			bus.Publish(instances.Event{Type: instances.EventStateChange})
+			if event := <-events; event.ID != 6 || event.Type != instances.EventStateChange {
+				t.Fatalf("unexpected live event %+v", event)
+			}
+		})
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	t.Parallel()
+	bus := instances.NewEventBus(10)
+	_, _, events, cancel := bus.Subscribe(0, false)
+	defer cancel()
+
+	for i := 0; i < 100; i++ {
+		bus.Publish(instances.Event{Type: instances.EventAction})
+	}
+
+	received := 0
+	for range events {
+		received++
+	}
+	if received == 0 || received == 100 {
+		t.Fatalf("slow subscriber received %d events before being unsubscribed", received)
+	}
+}
+
+// readEvents reads n server-sent events, returning their type and ID.
+func readEvents(t *testing.T, scanner *bufio.Scanner, n int) []string {
+	t.Helper()
+	var events []string
+	var id string
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		if value, found := strings.CutPrefix(line, "id: "); found {
+			id = value
+		}
+		if value, found := strings.CutPrefix(line, "event: "); found {
+			events = append(events, value+" "+id)
+			id = ""
+		}
+	}
+	if len(events) < n {
+		t.Fatalf("got events %v before the stream ended: %v", events, scanner.Err())
+	}
+	return events
+}
+
+func TestServerEvents(t *testing.T) {
+	t.Parallel()
+	server, _ := newTestServer(t)
+
+	resp, err := server.Client().Get(server.URL + "/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	for _, request := range []struct{ method, path, body string }{
+		{http.MethodPost, "/v1/instances", `{"id": "id2", "name": "b", "cloud": "mock"}`},
+		{http.MethodPost, "/v1/instances/a/start", ""},
+		{http.MethodDelete, "/v1/instances/b", ""},
+	} {
+		req, err := http.NewRequest(request.method, server.URL+request.path, strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	got := readEvents(t, bufio.NewScanner(resp.Body), 3)
+	want := []string{"instance-added 1", "action 2", "instance-removed 3"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+
+	// Resume after the first event.
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+
+	got = readEvents(t, bufio.NewScanner(resumed.Body), 2)
+	want = []string{"action 2", "instance-removed 3"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("got resumed events %v, want %v", got, want)
+	}
+}
+
+func TestServerEventsInvalidCursor(t *testing.T) {
+	t.Parallel()
+	server, _ := newTestServer(t)
+
+	resp, err := server.Client().Get(server.URL + "/v1/events?after=yesterday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestServerEventsAuthorization(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(newAuthTestHandler(t, &instances.MemoryAuditLog{}))
+	defer server.Close()
+
+	request := func(method, path, token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := request(http.MethodGet, "/v1/events?after=0", "operator-token")
+	defer resp.Body.Close()
+	request(http.MethodPost, "/v1/instances/prodBox/stop", "admin-token").Body.Close()
+	request(http.MethodPost, "/v1/instances/devBox/start", "operator-token").Body.Close()
+
+	// The operator can only read the events of the dev group.
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "data: ") {
+			continue
+		}
+		if !strings.Contains(scanner.Text(), `"instance":"devBox"`) {
+			t.Fatalf("unexpected event %s", scanner.Text())
+		}
+		if strings.Contains(scanner.Text(), `"action":"start"`) {
+			return
+		}
+	}
+	t.Fatalf("stream ended: %v", scanner.Err())
+}
@@ -0,0 +1,59 @@
+package fakecloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/nonatomiclabs/instances"
+)
+
+// CloudWatchClient is an instances.CloudWatchMetricsGetter reporting the CPU
+// utilization of the instances of a Cloud. Like CloudWatch, it reports no
+// datapoints for unknown instances. The calls are recorded as
+// "GetMetricStatistics".
+type CloudWatchClient struct {
+	cloud *Cloud
+}
+
+// CloudWatch returns a CloudWatch client reporting the metrics of the
+// instances of the cloud.
+func (c *Cloud) CloudWatch() *CloudWatchClient {
+	return &CloudWatchClient{cloud: c}
+}
+
+var _ instances.CloudWatchMetricsGetter = &CloudWatchClient{}
+
+func (w *CloudWatchClient) GetMetricStatistics(ctx context.Context, params *cloudwatch.GetMetricStatisticsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	if aws.ToString(params.Namespace) != "AWS/EC2" || aws.ToString(params.MetricName) != "CPUUtilization" {
+		return nil, fmt.Errorf("unsupported metric %s/%s", aws.ToString(params.Namespace), aws.ToString(params.MetricName))
+	}
+
+	var id string
+	for _, dimension := range params.Dimensions {
+		if aws.ToString(dimension.Name) == "InstanceId" {
+			id = aws.ToString(dimension.Value)
+		}
+	}
+
+	out := &cloudwatch.GetMetricStatisticsOutput{}
+	err := w.cloud.call("GetMetricStatistics", id, func(inst *instance) error {
+		for _, sample := range inst.cpu {
+			if sample.Time.Before(aws.ToTime(params.StartTime)) || sample.Time.After(aws.ToTime(params.EndTime)) {
+				continue
+			}
+			out.Datapoints = append(out.Datapoints, cloudwatchtypes.Datapoint{
+				Timestamp: aws.Time(sample.Time),
+				Average:   aws.Float64(sample.Value),
+			})
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, instances.ErrNotFound) {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,148 @@
+package fakecloud
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/nonatomiclabs/instances"
+)
+
+// EC2Client is an instances.EC2InstanceManager backed by a Cloud, following
+// the rules of EC2: starting a running instance or stopping a stopped one is
+// a no-op, and the errors are EC2 API errors. The calls are recorded under
+// the name of the EC2 operation, like "StartInstances", once per instance.
+type EC2Client struct {
+	cloud *Cloud
+}
+
+// EC2 returns an EC2 client managing the instances of the cloud.
+func (c *Cloud) EC2() *EC2Client {
+	return &EC2Client{cloud: c}
+}
+
+var _ instances.EC2InstanceManager = &EC2Client{}
+
+// apiError converts the errors of a Cloud to the ones EC2 would return.
+func apiError(err error) error {
+	switch {
+	case errors.Is(err, instances.ErrNotFound):
+		return &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: err.Error(), Fault: smithy.FaultClient}
+	case errors.Is(err, instances.ErrInvalidState):
+		return &smithy.GenericAPIError{Code: "IncorrectInstanceState", Message: err.Error(), Fault: smithy.FaultClient}
+	default:
+		return err
+	}
+}
+
+func stateOf(state instances.InstanceState) *types.InstanceState {
+	return &types.InstanceState{Name: types.InstanceStateName(state)}
+}
+
+func (e *EC2Client) DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	out := &ec2.DescribeInstanceStatusOutput{}
+	for _, id := range params.InstanceIds {
+		err := e.cloud.call("DescribeInstanceStatus", id, func(inst *instance) error {
+			if inst.state != instances.InstanceStateRunning && !aws.ToBool(params.IncludeAllInstances) {
+				return nil
+			}
+			out.InstanceStatuses = append(out.InstanceStatuses, types.InstanceStatus{
+				InstanceId:    aws.String(id),
+				InstanceState: stateOf(inst.state),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, apiError(err)
+		}
+	}
+	return out, nil
+}
+
+func (e *EC2Client) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	out := &ec2.StartInstancesOutput{}
+	for _, id := range params.InstanceIds {
+		err := e.cloud.call("StartInstances", id, func(inst *instance) error {
+			previous := inst.state
+			switch inst.state {
+			case instances.InstanceStateStopped:
+				e.cloud.transition(inst, instances.InstanceStatePending, instances.InstanceStateRunning)
+			case instances.InstanceStateRunning, instances.InstanceStatePending:
+			default:
+				return instances.Errorf(instances.ErrInvalidState, "the instance %q is not in a state from which it can be started", id)
+			}
+			out.StartingInstances = append(out.StartingInstances, types.InstanceStateChange{
+				InstanceId:    aws.String(id),
+				PreviousState: stateOf(previous),
+				CurrentState:  stateOf(inst.state),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, apiError(err)
+		}
+	}
+	return out, nil
+}
+
+func (e *EC2Client) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	out := &ec2.StopInstancesOutput{}
+	for _, id := range params.InstanceIds {
+		err := e.cloud.call("StopInstances", id, func(inst *instance) error {
+			previous := inst.state
+			switch inst.state {
+			case instances.InstanceStateRunning:
+				e.cloud.transition(inst, instances.InstanceStateStopping, instances.InstanceStateStopped)
+			case instances.InstanceStateStopped, instances.InstanceStateStopping:
+			default:
+				return instances.Errorf(instances.ErrInvalidState, "the instance %q is not in a state from which it can be stopped", id)
+			}
+			out.StoppingInstances = append(out.StoppingInstances, types.InstanceStateChange{
+				InstanceId:    aws.String(id),
+				PreviousState: stateOf(previous),
+				CurrentState:  stateOf(inst.state),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, apiError(err)
+		}
+	}
+	return out, nil
+}
+
+func (e *EC2Client) RebootInstances(ctx context.Context, params *ec2.RebootInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RebootInstancesOutput, error) {
+	for _, id := range params.InstanceIds {
+		err := e.cloud.call("RebootInstances", id, func(inst *instance) error {
+			if inst.state != instances.InstanceStateRunning {
+				return instances.Errorf(instances.ErrInvalidState, "the instance %q is not in a state from which it can be rebooted", id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, apiError(err)
+		}
+	}
+	return &ec2.RebootInstancesOutput{}, nil
+}
+
+func (e *EC2Client) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	reservation := types.Reservation{}
+	for _, id := range params.InstanceIds {
+		err := e.cloud.call("DescribeInstances", id, func(inst *instance) error {
+			reservation.Instances = append(reservation.Instances, types.Instance{
+				InstanceId:   aws.String(id),
+				InstanceType: types.InstanceType(inst.details.Type),
+				State:        stateOf(inst.state),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, apiError(err)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{reservation}}, nil
+}
@@ -0,0 +1,329 @@
+// Package fakecloud provides an in-memory cloud provider simulating the
+// lifecycle of instances, for tests.
+//
+// A Cloud is a CloudProvider whose instances go through the states real ones
+// do (a started instance is pending before running, a stopped one is
+// stopping before stopped), with configurable delays. Failures and latency
+// can be injected in its calls, which it records. It can also be driven
+// through the EC2 API, to test AWSCloud against it.
+package fakecloud
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+)
+
+// Call is a call made to a Cloud.
+type Call struct {
+	Method string
+	ID     string
+	Err    error
+}
+
+// Failure is a failure injected in the calls to a Cloud.
+type Failure struct {
+	// Method is the method failing, like "StartInstance" (all if empty).
+	Method string
+	// ID is the ID of the instance whose calls fail (all if empty).
+	ID string
+	// Err is the error returned by the calls.
+	Err error
+	// Times is the number of calls failing, all if zero or less.
+	Times int
+}
+
+// instance is an instance of a Cloud.
+type instance struct {
+	state instances.InstanceState
+	// target is the state the instance is transitioning to, at until.
+	target instances.InstanceState
+	until  time.Time
+	// details and cpu are what the instance is described as, and the CPU
+	// utilization it reports.
+	details instances.InstanceDetails
+	cpu     []instances.MetricSample
+}
+
+// Cloud is a fake cloud provider.
+type Cloud struct {
+	mu              sync.Mutex
+	name            string
+	now             func() time.Time
+	transitionDelay time.Duration
+	latency         time.Duration
+	instances       map[string]*instance
+	failures        []*Failure
+	calls           []Call
+}
+
+// Option configures optional behavior of a Cloud.
+type Option func(*Cloud)
+
+// WithName sets the name of the cloud provider ("fake" by default).
+func WithName(name string) Option {
+	return func(c *Cloud) {
+		c.name = name
+	}
+}
+
+// WithClock sets the function used to get the current time (time.Now by
+// default), which drives the state transitions.
+func WithClock(now func() time.Time) Option {
+	return func(c *Cloud) {
+		c.now = now
+	}
+}
+
+// WithTransitionDelay sets how long the instances are pending when started
+// and stopping when stopped. By default, they transition at once.
+func WithTransitionDelay(delay time.Duration) Option {
+	return func(c *Cloud) {
+		c.transitionDelay = delay
+	}
+}
+
+// WithLatency sets how long each call takes. By default, they return at
+// once.
+func WithLatency(latency time.Duration) Option {
+	return func(c *Cloud) {
+		c.latency = latency
+	}
+}
+
+// New returns a Cloud without instances.
+func New(opts ...Option) *Cloud {
+	c := &Cloud{name: "fake", now: time.Now, instances: map[string]*instance{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// AddInstance adds an instance in the given state, replacing any with the
+// same ID.
+func (c *Cloud) AddInstance(id string, state instances.InstanceState, details instances.InstanceDetails) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances[id] = &instance{state: state, details: details}
+}
+
+// SetState sets the state of an instance, ending its transition if it is in
+// one.
+func (c *Cloud) SetState(id string, state instances.InstanceState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, err := c.instance(id)
+	if err != nil {
+		return err
+	}
+	inst.state, inst.target = state, ""
+	return nil
+}
+
+// SetCPUUtilization sets the CPU utilization samples reported for an
+// instance.
+func (c *Cloud) SetCPUUtilization(id string, samples []instances.MetricSample) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, err := c.instance(id)
+	if err != nil {
+		return err
+	}
+	inst.cpu = slices.Clone(samples)
+	return nil
+}
+
+// State returns the current state of an instance, without recording a call.
+func (c *Cloud) State(id string) (instances.InstanceState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, err := c.instance(id)
+	if err != nil {
+		return "", err
+	}
+	return inst.state, nil
+}
+
+// InjectFailure makes the matching calls fail, until it has failed them the
+// given number of times. The first matching failure injected applies.
+func (c *Cloud) InjectFailure(failure Failure) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = append(c.failures, &failure)
+}
+
+// Calls returns the calls made so far.
+func (c *Cloud) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.calls)
+}
+
+// CallCount returns the number of calls made so far to method.
+func (c *Cloud) CallCount(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	for _, call := range c.calls {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// instance returns an instance, after completing its transition if it is
+// due. It must be called with the lock held.
+func (c *Cloud) instance(id string) (*instance, error) {
+	inst, exists := c.instances[id]
+	if !exists {
+		return nil, instances.Errorf(instances.ErrNotFound, "instance %q not found in %s", id, c.name)
+	}
+	if inst.target != "" && !c.now().Before(inst.until) {
+		inst.state, inst.target = inst.target, ""
+	}
+	return inst, nil
+}
+
+// transition makes an instance go through state to target.
+func (c *Cloud) transition(inst *instance, state, target instances.InstanceState) {
+	if c.transitionDelay <= 0 {
+		inst.state, inst.target = target, ""
+		return
+	}
+	inst.state, inst.target, inst.until = state, target, c.now().Add(c.transitionDelay)
+}
+
+// call simulates the latency of a call, and runs it on the instance id
+// unless a failure is injected, recording it.
+func (c *Cloud) call(method, id string, f func(inst *instance) error) error {
+	if c.latency > 0 {
+		time.Sleep(c.latency)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.injectedFailure(method, id)
+	if err == nil {
+		var inst *instance
+		inst, err = c.instance(id)
+		if err == nil {
+			err = f(inst)
+		}
+	}
+	c.calls = append(c.calls, Call{Method: method, ID: id, Err: err})
+	return err
+}
+
+// injectedFailure returns the error of the first failure injected in the
+// call, if any. It must be called with the lock held.
+func (c *Cloud) injectedFailure(method, id string) error {
+	for i, failure := range c.failures {
+		if (failure.Method != "" && failure.Method != method) || (failure.ID != "" && failure.ID != id) {
+			continue
+		}
+		if failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				c.failures = slices.Delete(c.failures, i, i+1)
+			}
+		}
+		return failure.Err
+	}
+	return nil
+}
+
+func (c *Cloud) GetName() string {
+	return c.name
+}
+
+func (c *Cloud) GetInstanceStatus(id string) (instances.InstanceState, error) {
+	var state instances.InstanceState
+	err := c.call("GetInstanceStatus", id, func(inst *instance) error {
+		state = inst.state
+		return nil
+	})
+	return state, err
+}
+
+// StartInstance starts a stopped instance, which is pending until it is
+// running.
+func (c *Cloud) StartInstance(id string) error {
+	_, err := c.StartInstanceChange(id)
+	return err
+}
+
+func (c *Cloud) StartInstanceChange(id string) (instances.StateChange, error) {
+	var change instances.StateChange
+	err := c.call("StartInstance", id, func(inst *instance) error {
+		switch inst.state {
+		case instances.InstanceStateStopped:
+			change.Previous = inst.state
+			c.transition(inst, instances.InstanceStatePending, instances.InstanceStateRunning)
+			change.Current = inst.state
+			return nil
+		case instances.InstanceStateRunning, instances.InstanceStatePending:
+			return instances.Errorf(instances.ErrInvalidState, "instance %q running already", id)
+		default:
+			return instances.Errorf(instances.ErrInvalidState, "instance %q can't be started while %s", id, inst.state)
+		}
+	})
+	return change, err
+}
+
+// StopInstance stops a running instance, which is stopping until it is
+// stopped.
+func (c *Cloud) StopInstance(id string) error {
+	_, err := c.StopInstanceChange(id)
+	return err
+}
+
+func (c *Cloud) StopInstanceChange(id string) (instances.StateChange, error) {
+	var change instances.StateChange
+	err := c.call("StopInstance", id, func(inst *instance) error {
+		if inst.state != instances.InstanceStateRunning {
+			return instances.Errorf(instances.ErrInvalidState, "instance %q not running", id)
+		}
+		change.Previous = inst.state
+		c.transition(inst, instances.InstanceStateStopping, instances.InstanceStateStopped)
+		change.Current = inst.state
+		return nil
+	})
+	return change, err
+}
+
+// RebootInstance reboots a running instance, which stays running.
+func (c *Cloud) RebootInstance(id string) error {
+	return c.call("RebootInstance", id, func(inst *instance) error {
+		if inst.state != instances.InstanceStateRunning {
+			return instances.Errorf(instances.ErrInvalidState, "instance %q not running", id)
+		}
+		return nil
+	})
+}
+
+func (c *Cloud) DescribeInstance(id string) (instances.InstanceDetails, error) {
+	var details instances.InstanceDetails
+	err := c.call("DescribeInstance", id, func(inst *instance) error {
+		details = inst.details
+		return nil
+	})
+	return details, err
+}
+
+func (c *Cloud) GetCPUUtilization(id string, start, end time.Time) ([]instances.MetricSample, error) {
+	var samples []instances.MetricSample
+	err := c.call("GetCPUUtilization", id, func(inst *instance) error {
+		for _, sample := range inst.cpu {
+			if !sample.Time.Before(start) && !sample.Time.After(end) {
+				samples = append(samples, sample)
+			}
+		}
+		return nil
+	})
+	return samples, err
+}
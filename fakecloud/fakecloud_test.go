@@ -0,0 +1,165 @@
+package fakecloud_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func TestTransitions(t *testing.T) {
+	tests := map[string]struct {
+		state instances.InstanceState
+		// do is the operation run on the instance.
+		do         func(cloud *fakecloud.Cloud) error
+		wantErr    error
+		wantStates []instances.InstanceState
+	}{
+		"start stopped instance": {
+			state:      instances.InstanceStateStopped,
+			do:         func(cloud *fakecloud.Cloud) error { return cloud.StartInstance("i-1") },
+			wantStates: []instances.InstanceState{"pending", "pending", "running"},
+		},
+		"start running instance": {
+			state:      instances.InstanceStateRunning,
+			do:         func(cloud *fakecloud.Cloud) error { return cloud.StartInstance("i-1") },
+			wantErr:    instances.ErrInvalidState,
+			wantStates: []instances.InstanceState{"running", "running", "running"},
+		},
+		"stop running instance": {
+			state:      instances.InstanceStateRunning,
+			do:         func(cloud *fakecloud.Cloud) error { return cloud.StopInstance("i-1") },
+			wantStates: []instances.InstanceState{"stopping", "stopping", "stopped"},
+		},
+		"stop stopped instance": {
+			state:      instances.InstanceStateStopped,
+			do:         func(cloud *fakecloud.Cloud) error { return cloud.StopInstance("i-1") },
+			wantErr:    instances.ErrInvalidState,
+			wantStates: []instances.InstanceState{"stopped", "stopped", "stopped"},
+		},
+		"reboot running instance": {
+			state:      instances.InstanceStateRunning,
+			do:         func(cloud *fakecloud.Cloud) error { return cloud.RebootInstance("i-1") },
+			wantStates: []instances.InstanceState{"running", "running", "running"},
+		},
+		"unknown instance": {
+			state:      instances.InstanceStateRunning,
+			do:         func(cloud *fakecloud.Cloud) error { return cloud.StopInstance("i-2") },
+			wantErr:    instances.ErrNotFound,
+			wantStates: []instances.InstanceState{"running", "running", "running"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			cloud := fakecloud.New(fakecloud.WithClock(func() time.Time { return now }), fakecloud.WithTransitionDelay(time.Minute))
+			cloud.AddInstance("i-1", tc.state, instances.InstanceDetails{})
+
+			if err := tc.do(cloud); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+
+			// The states right after the operation, before the end of the
+			// transition and after it.
+			var states []instances.InstanceState
+			for _, elapsed := range []time.Duration{0, 59 * time.Second, time.Second} {
+				now = now.Add(elapsed)
+				state, err := cloud.GetInstanceStatus("i-1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				states = append(states, state)
+			}
+			if !slices.Equal(states, tc.wantStates) {
+				t.Errorf("got states %v, want %v", states, tc.wantStates)
+			}
+		})
+	}
+}
+
+func TestInjectFailure(t *testing.T) {
+	t.Parallel()
+
+	cloud := fakecloud.New()
+	cloud.AddInstance("i-1", instances.InstanceStateStopped, instances.InstanceDetails{})
+	cloud.AddInstance("i-2", instances.InstanceStateStopped, instances.InstanceDetails{})
+	errThrottled := errors.New("throttled")
+	cloud.InjectFailure(fakecloud.Failure{Method: "StartInstance", ID: "i-1", Err: errThrottled, Times: 2})
+
+	var errs []error
+	for _, id := range []string{"i-1", "i-2", "i-1", "i-1"} {
+		errs = append(errs, cloud.StartInstance(id))
+	}
+	if want := []error{errThrottled, nil, errThrottled, nil}; !slices.Equal(errs, want) {
+		t.Errorf("got errors %v, want %v", errs, want)
+	}
+
+	want := []fakecloud.Call{
+		{Method: "StartInstance", ID: "i-1", Err: errThrottled},
+		{Method: "StartInstance", ID: "i-2"},
+		{Method: "StartInstance", ID: "i-1", Err: errThrottled},
+		{Method: "StartInstance", ID: "i-1"},
+	}
+	if calls := cloud.Calls(); !slices.Equal(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+	if count := cloud.CallCount("StartInstance"); count != 4 {
+		t.Errorf("got %d calls to StartInstance, want 4", count)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	t.Parallel()
+
+	cloud := fakecloud.New(fakecloud.WithLatency(20 * time.Millisecond))
+	cloud.AddInstance("i-1", instances.InstanceStateRunning, instances.InstanceDetails{})
+
+	start := time.Now()
+	if _, err := cloud.GetInstanceStatus("i-1"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("call took %s, want at least 20ms", elapsed)
+	}
+}
+
+func TestEC2Client(t *testing.T) {
+	t.Parallel()
+
+	cloud := fakecloud.New(fakecloud.WithName("aws"))
+	cloud.AddInstance("i-1", instances.InstanceStateRunning, instances.InstanceDetails{Type: "t3.micro"})
+	aws := instances.AWSCloud{Ec2Client: cloud.EC2(), Region: "eu-west-3"}
+
+	if err := aws.StopInstance("i-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := aws.StopInstance("i-1"); !errors.Is(err, instances.ErrInvalidState) {
+		t.Errorf("got error %v stopping a stopped instance, want %v", err, instances.ErrInvalidState)
+	}
+	if err := aws.StartInstance("i-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := aws.StartInstance("i-1"); !errors.Is(err, instances.ErrInvalidState) {
+		t.Errorf("got error %v starting a running instance, want %v", err, instances.ErrInvalidState)
+	}
+	if _, err := aws.GetInstanceStatus("i-2"); !errors.Is(err, instances.ErrNotFound) {
+		t.Errorf("got error %v for an unknown instance, want %v", err, instances.ErrNotFound)
+	}
+
+	details, err := aws.DescribeInstance("i-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (instances.InstanceDetails{Type: "t3.micro", Region: "eu-west-3"}); details != want {
+		t.Errorf("got details %+v, want %+v", details, want)
+	}
+	if count := cloud.CallCount("StartInstances"); count != 2 {
+		t.Errorf("got %d calls to StartInstances, want 2", count)
+	}
+}
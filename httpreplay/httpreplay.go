@@ -0,0 +1,331 @@
+// Package httpreplay records HTTP interactions into fixture files, and
+// replays them in tests.
+//
+// A Transport in Record mode sends the requests to a real transport, and
+// saves the interactions to a fixture file when closed, scrubbed of their
+// secrets: the headers of the requests, which carry the credentials and
+// signatures, aren't recorded, nor are the cookies set by the responses or
+// the credentials in presigned URLs. A Transport in Replay mode answers the
+// requests with the recorded responses, without any network access.
+package httpreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Mode is whether a Transport records or replays the interactions.
+type Mode int
+
+const (
+	// Replay answers the requests with the recorded responses.
+	Replay Mode = iota
+	// Record sends the requests to a real transport and records the
+	// interactions.
+	Record
+)
+
+// ModeFromEnv returns Record if the environment variable name is set to a
+// non-empty value, Replay otherwise, to re-record the fixtures of tests on
+// demand.
+func ModeFromEnv(name string) Mode {
+	if os.Getenv(name) != "" {
+		return Record
+	}
+	return Replay
+}
+
+// Request is a recorded request.
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// ContentType is the media type of the body.
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// Interaction is a recorded request and its response.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// fixture is the content of a fixture file.
+type fixture struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// scrubbedParams are the query parameters of presigned URLs carrying
+// credentials or signatures.
+var scrubbedParams = []string{"X-Amz-Credential", "X-Amz-Security-Token", "X-Amz-Signature"}
+
+// Transport is an http.RoundTripper recording or replaying interactions.
+type Transport struct {
+	path          string
+	mode          Mode
+	transport     http.RoundTripper
+	scrubbers     []func(*Interaction)
+	ignoredParams []string
+
+	mu           sync.Mutex
+	interactions []Interaction
+	// used tells, in Replay mode, which interactions were replayed already.
+	used []bool
+}
+
+// Option configures optional behavior of a Transport.
+type Option func(*Transport)
+
+// WithTransport sets the transport the requests are sent to in Record mode
+// (http.DefaultTransport by default).
+func WithTransport(transport http.RoundTripper) Option {
+	return func(t *Transport) {
+		t.transport = transport
+	}
+}
+
+// WithScrubber adds a function scrubbing the interactions before they are
+// recorded, like by replacing the IDs of an account with placeholders.
+func WithScrubber(scrub func(*Interaction)) Option {
+	return func(t *Transport) {
+		t.scrubbers = append(t.scrubbers, scrub)
+	}
+}
+
+// WithIgnoredParams sets the query and form parameters ignored when matching
+// the requests with the recorded ones, like timestamps.
+func WithIgnoredParams(names ...string) Option {
+	return func(t *Transport) {
+		t.ignoredParams = append(t.ignoredParams, names...)
+	}
+}
+
+// New returns a Transport recording the interactions to, or replaying them
+// from, the fixture file at path.
+func New(path string, mode Mode, opts ...Option) (*Transport, error) {
+	t := &Transport{path: path, mode: mode, transport: http.DefaultTransport}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if mode == Replay {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read fixture: %w", err)
+		}
+		var f fixture
+		if err := json.Unmarshal(content, &f); err != nil {
+			return nil, fmt.Errorf("decode fixture %s: %w", path, err)
+		}
+		t.interactions = f.Interactions
+		t.used = make([]bool, len(f.Interactions))
+	}
+	return t, nil
+}
+
+// Client returns an HTTP client using the transport.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded, err := newRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.mode == Replay {
+		return t.replay(req, recorded)
+	}
+	return t.record(req, recorded)
+}
+
+// newRequest returns the recording of req, restoring its body so that it can
+// still be sent.
+func newRequest(req *http.Request) (Request, error) {
+	recorded := Request{Method: req.Method, URL: req.URL.String()}
+	if req.Body == nil || req.Body == http.NoBody {
+		return recorded, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return Request{}, fmt.Errorf("read request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	recorded.Body = string(body)
+	recorded.ContentType, _, _ = mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return recorded, nil
+}
+
+// replay returns the response of the first recorded interaction matching
+// the request which wasn't replayed yet.
+func (t *Transport) replay(req *http.Request, recorded Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, interaction := range t.interactions {
+		if t.used[i] || !t.matches(interaction.Request, recorded) {
+			continue
+		}
+		t.used[i] = true
+		response := interaction.Response
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+			StatusCode:    response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        response.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader([]byte(response.Body))),
+			ContentLength: int64(len(response.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded interaction left for %s %s %s in %s", recorded.Method, recorded.URL, recorded.Body, t.path)
+}
+
+// matches tells whether a recorded request matches a request, which it does
+// when they have the same method, path and parameters, whatever their host.
+func (t *Transport) matches(recorded, req Request) bool {
+	if recorded.Method != req.Method || recorded.ContentType != req.ContentType {
+		return false
+	}
+
+	recordedURL, err := url.Parse(recorded.URL)
+	if err != nil {
+		return false
+	}
+	reqURL, err := url.Parse(req.URL)
+	if err != nil {
+		return false
+	}
+	if recordedURL.Path != reqURL.Path || !t.sameParams(recordedURL.Query(), reqURL.Query()) {
+		return false
+	}
+
+	if req.ContentType != "application/x-www-form-urlencoded" {
+		return recorded.Body == req.Body
+	}
+	recordedForm, err := url.ParseQuery(recorded.Body)
+	if err != nil {
+		return false
+	}
+	reqForm, err := url.ParseQuery(req.Body)
+	if err != nil {
+		return false
+	}
+	return t.sameParams(recordedForm, reqForm)
+}
+
+// sameParams tells whether two sets of parameters are the same, but for the
+// ignored and scrubbed ones.
+func (t *Transport) sameParams(a, b url.Values) bool {
+	for _, name := range slices.Concat(t.ignoredParams, scrubbedParams) {
+		a.Del(name)
+		b.Del(name)
+	}
+	return maps.EqualFunc(a, b, slices.Equal)
+}
+
+// record sends the request to the real transport, and records the
+// interaction.
+func (t *Transport) record(req *http.Request, recorded Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	interaction := Interaction{
+		Request:  recorded,
+		Response: Response{StatusCode: resp.StatusCode, Header: header, Body: string(body)},
+	}
+	scrubURL(&interaction.Request)
+	for _, scrub := range t.scrubbers {
+		scrub(&interaction)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.interactions = append(t.interactions, interaction)
+	return resp, nil
+}
+
+// scrubURL removes the credentials of a presigned URL.
+func scrubURL(req *Request) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return
+	}
+	query := u.Query()
+	for _, name := range scrubbedParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+	req.URL = u.String()
+}
+
+// Close saves the recorded interactions to the fixture file in Record mode.
+// In Replay mode, it returns an error if some interactions weren't replayed,
+// as the requests they were recorded for weren't made.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.mode == Replay {
+		unused := 0
+		for _, used := range t.used {
+			if !used {
+				unused++
+			}
+		}
+		if unused > 0 {
+			return fmt.Errorf("%d recorded interactions of %s not replayed", unused, t.path)
+		}
+		return nil
+	}
+
+	// The bodies are kept readable, without escaping their HTML characters.
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(fixture{Interactions: t.interactions}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("create fixture directory: %w", err)
+	}
+	if err := os.WriteFile(t.path, content.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write fixture: %w", err)
+	}
+	return nil
+}
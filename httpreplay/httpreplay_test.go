@@ -0,0 +1,185 @@
+package httpreplay_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nonatomiclabs/instances/httpreplay"
+)
+
+// newServer returns a server answering the requests with their number, their
+// path and their posted form, setting a cookie.
+func newServer(t *testing.T) *httptest.Server {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "cookie-secret"})
+		fmt.Fprintf(w, "%d %s %s", requests.Add(1), r.URL.Path, r.PostForm.Encode())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, client *http.Client, u string) (string, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "header-secret")
+	return do(client, req)
+}
+
+func post(t *testing.T, client *http.Client, u string, form url.Values) (string, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("Authorization", "header-secret")
+	return do(client, req)
+}
+
+func do(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+	server := newServer(t)
+	path := filepath.Join(t.TempDir(), "fixtures", "interactions.json")
+
+	recorder, err := httpreplay.New(path, httpreplay.Record, httpreplay.WithIgnoredParams("Time"),
+		httpreplay.WithScrubber(func(interaction *httpreplay.Interaction) {
+			interaction.Request.Body = strings.ReplaceAll(interaction.Request.Body, "account-1234", "account-0000")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded []string
+	for _, request := range []func(client *http.Client, u string) (string, error){
+		func(client *http.Client, u string) (string, error) {
+			return get(t, client, u+"/presigned?X-Amz-Signature=query-secret")
+		},
+		func(client *http.Client, u string) (string, error) {
+			return post(t, client, u+"/", url.Values{"Action": {"Describe"}, "Account": {"account-1234"}, "Time": {"1"}})
+		},
+		// The same request, answered differently.
+		func(client *http.Client, u string) (string, error) {
+			return post(t, client, u+"/", url.Values{"Action": {"Describe"}, "Account": {"account-1234"}, "Time": {"2"}})
+		},
+	} {
+		body, err := request(recorder.Client(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, body)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"header-secret", "query-secret", "cookie-secret"} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("fixture contains %q:\n%s", secret, content)
+		}
+	}
+
+	replayer, err := httpreplay.New(path, httpreplay.Replay, httpreplay.WithIgnoredParams("Time"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The requests are matched whatever their host, the order of their
+	// parameters and their ignored parameters.
+	replayed := make([]string, 3)
+	replayed[1], err = post(t, replayer.Client(), "https://api.example.com/", url.Values{"Time": {"3"}, "Account": {"account-0000"}, "Action": {"Describe"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed[0], err = get(t, replayer.Client(), "https://api.example.com/presigned?X-Amz-Signature=other-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed[2], err = post(t, replayer.Client(), "https://api.example.com/", url.Values{"Action": {"Describe"}, "Account": {"account-0000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range recorded {
+		if replayed[i] != recorded[i] {
+			t.Errorf("got response %q for request %d, want %q", replayed[i], i, recorded[i])
+		}
+	}
+
+	_, err = post(t, replayer.Client(), "https://api.example.com/", url.Values{"Action": {"Describe"}, "Account": {"account-0000"}})
+	if !errorContains(err, "no recorded interaction left") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := replayer.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplayUnused(t *testing.T) {
+	t.Parallel()
+	server := newServer(t)
+	path := filepath.Join(t.TempDir(), "interactions.json")
+
+	recorder, err := httpreplay.New(path, httpreplay.Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := get(t, recorder.Client(), server.URL+p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := httpreplay.New(path, httpreplay.Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, replayer.Client(), server.URL+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayer.Close(); !errorContains(err, "1 recorded interactions") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplayMissingFixture(t *testing.T) {
+	t.Parallel()
+	_, err := httpreplay.New(filepath.Join(t.TempDir(), "missing.json"), httpreplay.Replay)
+	if !errorContains(err, "read fixture") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func errorContains(err error, want string) bool {
+	if err == nil {
+		return want == ""
+	}
+	return want != "" && strings.Contains(err.Error(), want)
+}
@@ -3,6 +3,7 @@ package instances
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 type InstanceState string
@@ -16,9 +17,45 @@ const (
 	InstanceStateTerminated   InstanceState = "terminated"
 )
 
+// instanceStates are all the known states of an instance.
+var instanceStates = []InstanceState{
+	InstanceStatePending,
+	InstanceStateRunning,
+	InstanceStateShuttingDown,
+	InstanceStateStopping,
+	InstanceStateStopped,
+	InstanceStateTerminated,
+}
+
 type Instance struct {
-	Id                string `json:"id"`
-	CloudProviderName string `json:"cloud-provider"`
+	Id                string            `json:"id"`
+	CloudProviderName string            `json:"cloud-provider"`
+	Group             string            `json:"group,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	Type              string            `json:"type,omitempty"`
+	Region            string            `json:"region,omitempty"`
+	Override          *Override         `json:"override,omitempty"`
+	// AutoStop is the instance's own auto-stop policy, taking precedence over
+	// the database default one.
+	AutoStop *AutoStopPolicy `json:"auto-stop,omitempty"`
+	// AutoStopOptOut exempts the instance from any auto-stop policy.
+	AutoStopOptOut bool `json:"auto-stop-opt-out,omitempty"`
+	// LeaseExpiry is when the instance is to be stopped, if it was started
+	// for a limited time.
+	LeaseExpiry *time.Time `json:"lease-expiry,omitempty"`
+	// Owner, Description and Notes document who the instance belongs to and
+	// what it is for.
+	Owner       string `json:"owner,omitempty"`
+	Description string `json:"description,omitempty"`
+	Notes       string `json:"notes,omitempty"`
+	// CreatedAt is when the instance was added.
+	CreatedAt *time.Time `json:"created-at,omitempty"`
+	// Expiry is when the instance is no longer needed and can be deleted,
+	// if it is known. Unlike a lease, it doesn't stop the instance.
+	Expiry *time.Time `json:"expires-at,omitempty"`
+	// Protected requires the commands changing the instance to be confirmed
+	// (see Database.IsProtected).
+	Protected bool `json:"protected,omitempty"`
 }
 
 func (i Instance) GetCloudProvider(cloudProviders map[string]CloudProvider) (CloudProvider, error) {
@@ -28,3 +65,34 @@ func (i Instance) GetCloudProvider(cloudProviders map[string]CloudProvider) (Clo
 	}
 	return cloudProvider, nil
 }
+
+// HasTags reports whether the instance has all the given tags.
+func (i Instance) HasTags(tags map[string]string) bool {
+	for key, value := range tags {
+		if instanceValue, ok := i.Tags[key]; !ok || instanceValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Expired reports whether the instance has an expiry date in the past.
+func (i Instance) Expired(now time.Time) bool {
+	return i.Expiry != nil && !i.Expiry.After(now)
+}
+
+// ParseExpiry parses an expiry date, either a date like "2024-12-31" (at
+// midnight in the time zone of now), an RFC 3339 time, or a duration from
+// now parsed by ParseDuration, like "30d".
+func ParseExpiry(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q, expected a date, an RFC 3339 time or a duration", s)
+}
@@ -2,14 +2,16 @@ package instances_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/nonatomiclabs/instances"
 )
 
 func TestGetCloudProvider(t *testing.T) {
 	t.Parallel()
+	cloud := newTestCloud()
 	cloudProviders := map[string]instances.CloudProvider{
-		"mock": MockCloudProvider{},
+		"mock": cloud,
 	}
 
 	tests := map[string]struct {
@@ -19,7 +21,7 @@ func TestGetCloudProvider(t *testing.T) {
 	}{
 		"existing cloud provider": {
 			instanceCloudProvider: "mock",
-			want:                  MockCloudProvider{},
+			want:                  cloud,
 			wantErr:               "",
 		},
 		"nonexisting cloud provider": {
@@ -49,3 +51,50 @@ func TestGetCloudProvider(t *testing.T) {
 	}
 
 }
+
+func TestParseExpiry(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		input   string
+		want    time.Time
+		wantErr string
+	}{
+		"date": {
+			input: "2024-12-31",
+			want:  time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC),
+		},
+		"time": {
+			input: "2024-12-31T18:00:00+01:00",
+			want:  time.Date(2024, 12, 31, 17, 0, 0, 0, time.UTC),
+		},
+		"days": {
+			input: "30d",
+			want:  time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC),
+		},
+		"duration": {
+			input: "36h",
+			want:  time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC),
+		},
+		"negative duration": {
+			input:   "-1d",
+			wantErr: "invalid expiry",
+		},
+		"invalid": {
+			input:   "someday",
+			wantErr: "invalid expiry",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := instances.ParseExpiry(test.input, now)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
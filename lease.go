@@ -0,0 +1,87 @@
+package instances
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reaper stops the instances whose lease has expired.
+type Reaper struct {
+	db             *Database
+	cloudProviders map[string]CloudProvider
+}
+
+func NewReaper(db *Database, cloudProviders map[string]CloudProvider) *Reaper {
+	return &Reaper{db: db, cloudProviders: cloudProviders}
+}
+
+// Run stops the instances whose lease expired at the given time and clears
+// their lease. Actions are recorded in the database and returned.
+func (r *Reaper) Run(now time.Time) []Action {
+	var actions []Action
+	for _, name := range sortedKeys(r.db.Instances) {
+		instance := r.db.Instances[name]
+		if instance.LeaseExpiry == nil || now.Before(*instance.LeaseExpiry) {
+			continue
+		}
+
+		action, done := r.reap(name, instance, now)
+		r.db.RecordAction(action)
+		actions = append(actions, action)
+
+		// Failed stops and instances not running yet, like still pending
+		// after being started for a lease, are retried on the next run.
+		// The leases of protected instances are ended without stopping
+		// them.
+		if done {
+			_ = r.db.SetLease(name, nil)
+		}
+	}
+	return actions
+}
+
+// reap stops an instance whose lease expired, and reports whether the lease
+// is over: the instance was stopped, is stopped or terminated already, or is
+// protected.
+func (r *Reaper) reap(name string, instance Instance, now time.Time) (Action, bool) {
+	record := Action{
+		Time:     now,
+		Instance: name,
+		Action:   ActionStop,
+		Source:   "lease",
+		Message:  fmt.Sprintf("lease expired at %s", instance.LeaseExpiry.Format(time.RFC3339)),
+	}
+
+	if r.db.IsProtected(name) {
+		record.Skipped = "instance protected"
+		return record, true
+	}
+
+	cloudProvider, err := instance.GetCloudProvider(r.cloudProviders)
+	if err != nil {
+		record.Error = err.Error()
+		return record, false
+	}
+
+	state, err := cloudProvider.GetInstanceStatus(instance.Id)
+	if err != nil {
+		record.Error = err.Error()
+		return record, false
+	}
+
+	if state != InstanceStateRunning {
+		record.Skipped = fmt.Sprintf("instance %s", state)
+		switch state {
+		case InstanceStateStopping, InstanceStateStopped, InstanceStateShuttingDown, InstanceStateTerminated:
+			return record, true
+		default:
+			return record, false
+		}
+	}
+
+	if err := cloudProvider.StopInstance(instance.Id); err != nil {
+		record.Error = err.Error()
+		return record, false
+	}
+	return record, true
+}
@@ -0,0 +1,224 @@
+package instances_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func TestReaper(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		expiry      *time.Time
+		state       instances.InstanceState
+		protected   bool
+		wantCalls   []string
+		wantLease   bool
+		wantActions int
+	}{
+		"expired lease": {
+			expiry:      timePtr(now.Add(-time.Minute)),
+			state:       instances.InstanceStateRunning,
+			wantCalls:   []string{"stop id1"},
+			wantActions: 1,
+		},
+		"active lease": {
+			expiry:    timePtr(now.Add(time.Minute)),
+			state:     instances.InstanceStateRunning,
+			wantLease: true,
+		},
+		"expired lease, instance stopped already": {
+			expiry:      timePtr(now.Add(-time.Minute)),
+			state:       instances.InstanceStateStopped,
+			wantActions: 1,
+		},
+		"expired lease, instance pending": {
+			expiry:      timePtr(now.Add(-time.Minute)),
+			state:       instances.InstanceStatePending,
+			wantLease:   true,
+			wantActions: 1,
+		},
+		"no lease": {
+			state: instances.InstanceStateRunning,
+		},
+		"expired lease, instance protected": {
+			expiry:      timePtr(now.Add(-time.Minute)),
+			state:       instances.InstanceStateRunning,
+			protected:   true,
+			wantActions: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+
+			provider := fakecloud.New(fakecloud.WithName("mock"))
+			provider.AddInstance("id1", test.state, instances.InstanceDetails{})
+			if err := db.AddInstance("id1", "a", provider); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetLease("a", test.expiry); err != nil {
+				t.Fatal(err)
+			}
+			// The lease was set before protecting the instance.
+			if err := db.SetProtected("a", test.protected); err != nil {
+				t.Fatal(err)
+			}
+
+			reaper := instances.NewReaper(db, map[string]instances.CloudProvider{"mock": provider})
+			actions := reaper.Run(now)
+
+			if len(actions) != test.wantActions {
+				t.Fatalf("unexpected actions: %v", actions)
+			}
+			if test.protected && actions[0].Skipped != "instance protected" {
+				t.Fatalf("protected instance not skipped: %v", actions)
+			}
+
+			if calls := stateCalls(provider); fmt.Sprint(calls) != fmt.Sprint(test.wantCalls) {
+				t.Fatalf("unexpected calls: got %v, want %v", calls, test.wantCalls)
+			}
+
+			if hasLease := db.Instances["a"].LeaseExpiry != nil; hasLease != test.wantLease {
+				t.Fatalf("unexpected lease: got %v, want %v", hasLease, test.wantLease)
+			}
+		})
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		expiry     *time.Time
+		duration   time.Duration
+		protected  bool
+		wantExpiry time.Time
+		wantErr    string
+	}{
+		"active lease": {
+			expiry:     timePtr(now.Add(time.Hour)),
+			duration:   time.Hour,
+			wantExpiry: now.Add(2 * time.Hour),
+		},
+		"expired lease": {
+			expiry:     timePtr(now.Add(-time.Hour)),
+			duration:   time.Hour,
+			wantExpiry: now.Add(time.Hour),
+		},
+		"no lease": {
+			duration: time.Hour,
+			wantErr:  "has no lease",
+		},
+		"negative duration": {
+			expiry:   timePtr(now.Add(time.Hour)),
+			duration: -time.Hour,
+			wantErr:  "must be positive",
+		},
+		"protected instance": {
+			expiry:    timePtr(now.Add(time.Hour)),
+			duration:  time.Hour,
+			protected: true,
+			wantErr:   "is protected",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+			if err := db.SetLease(existingInstanceName, test.expiry); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetProtected(existingInstanceName, test.protected); err != nil {
+				t.Fatal(err)
+			}
+
+			expiry, err := db.ExtendLease(existingInstanceName, test.duration, now)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !expiry.Equal(test.wantExpiry) {
+				t.Fatalf("unexpected expiry: got %s, want %s", expiry, test.wantExpiry)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+// interferingCloud is a fake cloud running change while it stops an
+// instance, like another invocation changing the database during a run of
+// the daemon.
+type interferingCloud struct {
+	*fakecloud.Cloud
+	change func()
+}
+
+func (c interferingCloud) StopInstance(id string) error {
+	c.change()
+	return c.Cloud.StopInstance(id)
+}
+
+func TestDaemonKeepsOtherChanges(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(path, []byte(`{"instances": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)
+	expiry := now.Add(-time.Minute)
+	cloud := newTestCloud()
+	db := openDatabaseFile(t, path)
+	err := db.Update(context.Background(), func() error {
+		if err := db.AddInstance(existingInstanceIds[0], "a", cloud); err != nil {
+			return err
+		}
+		return db.SetLease("a", &expiry)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := interferingCloud{Cloud: cloud, change: func() {
+		other := openDatabaseFile(t, path)
+		err := other.Update(context.Background(), func() error {
+			return other.AddInstance(existingInstanceIds[1], "b", cloud)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}}
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": provider},
+		instances.WithOutput(io.Discard),
+		instances.WithClock(func() time.Time { return now }),
+	)
+	if err := cli.Run([]string{"daemon", "--once"}); err != nil {
+		t.Fatalf("daemon failed: %v", err)
+	}
+
+	saved := openDatabaseFile(t, path)
+	if got := sortedNames(saved); got != "a, b" {
+		t.Fatalf("got saved instances %s, want a, b", got)
+	}
+	if saved.Instances["a"].LeaseExpiry != nil || len(saved.Actions) != 1 {
+		t.Fatalf("stop of the expired lease not saved: %+v", saved)
+	}
+}
@@ -0,0 +1,24 @@
+package instances
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// discardLogger is the logger of the components given none.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// NewLogger returns a logger writing records of at least the given level
+// to w, in the given format ("text" or "json").
+func NewLogger(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+}
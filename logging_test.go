@@ -0,0 +1,117 @@
+package instances_test
+
+import (
+	"bytes"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nonatomiclabs/instances"
+)
+
+func TestParseGlobalFlags(t *testing.T) {
+	tests := map[string]struct {
+		args      []string
+		wantArgs  []string
+		wantTrace string
+		// wantLogs are the logs expected after a debug, a warning and an
+		// error are logged.
+		wantLogs []string
+		wantErr  string
+	}{
+		"default": {
+			args:     []string{"list"},
+			wantArgs: []string{"list"},
+			wantLogs: []string{"level=WARN msg=warning", "level=ERROR msg=error"},
+		},
+		"verbose": {
+			args:     []string{"--verbose", "start", "foo"},
+			wantArgs: []string{"start", "foo"},
+			wantLogs: []string{"level=DEBUG msg=debug", "level=WARN msg=warning", "level=ERROR msg=error"},
+		},
+		"quiet": {
+			args:     []string{"--quiet", "list"},
+			wantArgs: []string{"list"},
+			wantLogs: []string{"level=ERROR msg=error"},
+		},
+		"json": {
+			args:     []string{"--log-format", "json", "list"},
+			wantArgs: []string{"list"},
+			wantLogs: []string{`"level":"WARN","msg":"warning"`, `"level":"ERROR","msg":"error"`},
+		},
+		"trace": {
+			args:      []string{"--trace", "otlp", "start", "foo"},
+			wantArgs:  []string{"start", "foo"},
+			wantTrace: "otlp",
+			wantLogs:  []string{"level=WARN msg=warning", "level=ERROR msg=error"},
+		},
+		"command flags": {
+			args:     []string{"list", "--verbose"},
+			wantArgs: []string{"list", "--verbose"},
+			wantLogs: []string{"level=WARN msg=warning", "level=ERROR msg=error"},
+		},
+		"verbose and quiet": {
+			args:    []string{"--verbose", "--quiet", "list"},
+			wantErr: "mutually exclusive",
+		},
+		"unknown format": {
+			args:    []string{"--log-format", "xml", "list"},
+			wantErr: `unknown log format "xml"`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var out strings.Builder
+			options, args, err := instances.ParseGlobalFlags(tc.args, &out)
+			if !errorContains(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(args, tc.wantArgs) {
+				t.Errorf("got arguments %q, want %q", args, tc.wantArgs)
+			}
+			if options.Trace != tc.wantTrace {
+				t.Errorf("got trace destination %q, want %q", options.Trace, tc.wantTrace)
+			}
+
+			options.Logger.Debug("debug")
+			options.Logger.Warn("warning")
+			options.Logger.Error("error")
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if len(lines) != len(tc.wantLogs) {
+				t.Fatalf("got logs:\n%s\nwant %d lines", out.String(), len(tc.wantLogs))
+			}
+			for i, want := range tc.wantLogs {
+				if !strings.Contains(lines[i], want) {
+					t.Errorf("got log %q, want it to contain %q", lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDatabaseLogger(t *testing.T) {
+	var logs strings.Builder
+	logger, err := instances.NewLogger(&logs, slog.LevelDebug, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := instances.NewDatabase(bytes.NewBufferString(`{"instances": {}}`), instances.WithDatabaseLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddInstance(existingInstanceIds[0], "foo", newTestCloud()); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `msg="adding instance" id=existingInstance1 name=foo`; !strings.Contains(logs.String(), want) {
+		t.Errorf("got logs %q, want them to contain %q", logs.String(), want)
+	}
+}
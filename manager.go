@@ -0,0 +1,497 @@
+package instances
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manager performs the lifecycle operations on the instances of a Database,
+// for the CLI and the API server. It is safe for concurrent use, as long as
+// the database isn't accessed directly at the same time.
+type Manager struct {
+	mu sync.Mutex
+	// updates serializes the updates of the database, which reload it.
+	updates        sync.Mutex
+	db             *Database
+	cloudProviders map[string]CloudProvider
+	now            func() time.Time
+	notifier       *Notifier
+	events         *EventBus
+}
+
+// ManagerOption configures optional behavior of a Manager.
+type ManagerOption func(*Manager)
+
+// WithManagerNotifier notifies the webhooks of the database of the actions
+// performed by the manager. By default, they aren't notified.
+func WithManagerNotifier(notifier *Notifier) ManagerOption {
+	return func(m *Manager) {
+		m.notifier = notifier
+	}
+}
+
+func NewManager(db *Database, cloudProviders map[string]CloudProvider, now func() time.Time, opts ...ManagerOption) *Manager {
+	m := &Manager{db: db, cloudProviders: cloudProviders, now: now, events: NewEventBus(defaultEventBusCapacity)}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Events returns the bus the manager publishes the events of its operations
+// and of its pollers to.
+func (m *Manager) Events() *EventBus {
+	return m.events
+}
+
+// NamedInstance is an instance with the name it is tracked under.
+type NamedInstance struct {
+	Name string `json:"name"`
+	Instance
+}
+
+// Instances returns the tracked instances, sorted by name.
+func (m *Manager) Instances() []NamedInstance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	instances := make([]NamedInstance, 0, len(m.db.Instances))
+	for name, instance := range m.db.Instances {
+		instances = append(instances, NamedInstance{Name: name, Instance: instance})
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+	return instances
+}
+
+// Instance returns a tracked instance.
+func (m *Manager) Instance(name string) (Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.db.GetInstance(name)
+}
+
+// IsProtected reports whether a tracked instance is protected.
+func (m *Manager) IsProtected(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.db.IsProtected(name)
+}
+
+// InstanceOptions holds the optional attributes of an instance.
+type InstanceOptions struct {
+	Group       string
+	Tags        map[string]string
+	Owner       string
+	Description string
+	Notes       string
+	Expiry      *time.Time
+	Protected   bool
+}
+
+// AddInstance starts tracking the instance id of the named cloud provider
+// under the given name, and returns its current state.
+func (m *Manager) AddInstance(id, name, cloudName string, opts InstanceOptions) (string, error) {
+	if id == "" {
+		return "", Errorf(ErrInvalidArgument, "missing instance ID")
+	}
+
+	cloudProvider, exists := m.cloudProviders[strings.ToLower(cloudName)]
+	if !exists {
+		return "", Errorf(ErrInvalidArgument, "unsupported cloud provider %q", cloudName)
+	}
+
+	m.mu.Lock()
+	err := m.db.AddInstance(id, name, cloudProvider)
+	m.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	var details InstanceDetails
+	if describer, ok := capability[InstanceDescriber](cloudProvider); ok {
+		// The details are only used for cost estimates, they are fetched
+		// again when generating reports if this fails.
+		details, _ = describer.DescribeInstance(id)
+	}
+
+	createdAt := m.now()
+	m.mu.Lock()
+	err = m.db.UpdateInstance(name, func(instance *Instance) {
+		instance.Group = opts.Group
+		instance.Tags = opts.Tags
+		instance.Type = details.Type
+		instance.Region = details.Region
+		instance.Owner = opts.Owner
+		instance.Description = opts.Description
+		instance.Notes = opts.Notes
+		instance.CreatedAt = &createdAt
+		instance.Expiry = opts.Expiry
+		instance.Protected = opts.Protected
+	})
+	m.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	m.events.Publish(Event{
+		Type:     EventInstanceAdded,
+		Time:     m.now(),
+		Instance: name,
+		Group:    opts.Group,
+		Tags:     opts.Tags,
+	})
+
+	return currentState(cloudProvider, id), nil
+}
+
+// RemoveInstance stops tracking an instance.
+func (m *Manager) RemoveInstance(name string) error {
+	m.mu.Lock()
+	instance, err := m.db.GetInstance(name)
+	if err == nil {
+		err = m.db.RemoveInstance(name)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.events.Publish(Event{
+		Type:     EventInstanceRemoved,
+		Time:     m.now(),
+		Instance: name,
+		Group:    instance.Group,
+		Tags:     instance.Tags,
+	})
+	return nil
+}
+
+// RenameInstance renames a tracked instance, keeping its history.
+func (m *Manager) RenameInstance(name, newName string) error {
+	m.mu.Lock()
+	instance, err := m.db.GetInstance(name)
+	if err == nil {
+		err = m.db.RenameInstance(name, newName)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// For the subscribers, the instance is tracked under its new name.
+	now := m.now()
+	m.events.Publish(Event{
+		Type:     EventInstanceRemoved,
+		Time:     now,
+		Instance: name,
+		Group:    instance.Group,
+		Tags:     instance.Tags,
+	})
+	m.events.Publish(Event{
+		Type:     EventInstanceAdded,
+		Time:     now,
+		Instance: newName,
+		Group:    instance.Group,
+		Tags:     instance.Tags,
+	})
+	return nil
+}
+
+// EditInstance makes a tracked instance track the instance id of the named
+// cloud provider, keeping its current ID or cloud provider when id or
+// cloudName is empty, and returns the current state of the instance id.
+func (m *Manager) EditInstance(name, id, cloudName string) (string, error) {
+	instance, err := m.Instance(name)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		id = instance.Id
+	}
+	if cloudName == "" {
+		cloudName = instance.CloudProviderName
+	}
+
+	cloudProvider, exists := m.cloudProviders[strings.ToLower(cloudName)]
+	if !exists {
+		return "", Errorf(ErrInvalidArgument, "unsupported cloud provider %q", cloudName)
+	}
+
+	m.mu.Lock()
+	err = m.db.RepointInstance(name, id, cloudProvider)
+	m.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if describer, ok := capability[InstanceDescriber](cloudProvider); ok {
+		if details, err := describer.DescribeInstance(id); err == nil {
+			m.mu.Lock()
+			err = m.db.UpdateInstance(name, func(instance *Instance) {
+				instance.Type = details.Type
+				instance.Region = details.Region
+			})
+			m.mu.Unlock()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return currentState(cloudProvider, id), nil
+}
+
+// LastObservation returns the last observed state of a tracked instance,
+// like Database.LastObservation.
+func (m *Manager) LastObservation(name string) (StateRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.db.LastObservation(name)
+}
+
+// InstanceStatus returns the state of an instance, and records it.
+func (m *Manager) InstanceStatus(name string) (InstanceState, error) {
+	instance, cloudProvider, err := m.resolve(name)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := cloudProvider.GetInstanceStatus(instance.Id)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.db.ObserveState(StateRecord{Time: m.now(), Instance: name, State: state})
+	m.mu.Unlock()
+
+	return state, nil
+}
+
+// StartInstance starts an instance, for the lease duration if it is
+// positive, and returns the change of state returned by its cloud provider,
+// if it returns it.
+func (m *Manager) StartInstance(name string, lease time.Duration, source string) (string, error) {
+	instance, cloudProvider, err := m.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if lease > 0 && m.IsProtected(name) {
+		return "", protectedLeaseError(name)
+	}
+
+	var change StateChange
+	changer, changes := capability[StateChanger](cloudProvider)
+	if changes {
+		change, err = changer.StartInstanceChange(instance.Id)
+	} else {
+		err = cloudProvider.StartInstance(instance.Id)
+	}
+	m.recordAction(name, ActionStart, source, err)
+	if err != nil {
+		return "", err
+	}
+
+	var response string
+	if changes {
+		m.observe(name, change.Current)
+		response = change.String()
+	}
+
+	if lease > 0 {
+		expiry := m.now().Add(lease)
+		m.mu.Lock()
+		err = m.db.SetLease(name, &expiry)
+		m.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return response, nil
+}
+
+// StopInstance stops an instance, ending its lease if it has one, and
+// returns the change of state returned by its cloud provider, if it returns
+// it.
+func (m *Manager) StopInstance(name string, source string) (string, error) {
+	instance, cloudProvider, err := m.resolve(name)
+	if err != nil {
+		return "", err
+	}
+
+	var change StateChange
+	changer, changes := capability[StateChanger](cloudProvider)
+	if changes {
+		change, err = changer.StopInstanceChange(instance.Id)
+	} else {
+		err = cloudProvider.StopInstance(instance.Id)
+	}
+	m.recordAction(name, ActionStop, source, err)
+	if err != nil {
+		return "", err
+	}
+
+	var response string
+	if changes {
+		m.observe(name, change.Current)
+		response = change.String()
+	}
+
+	if instance.LeaseExpiry != nil {
+		m.mu.Lock()
+		err = m.db.SetLease(name, nil)
+		m.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return response, nil
+}
+
+// RebootInstance reboots an instance, if its cloud provider supports it.
+// Cloud providers return nothing about reboots, so the response is always
+// empty.
+func (m *Manager) RebootInstance(name string, source string) (string, error) {
+	instance, cloudProvider, err := m.resolve(name)
+	if err != nil {
+		return "", err
+	}
+
+	rebooter, ok := capability[Rebooter](cloudProvider)
+	if !ok {
+		return "", Errorf(ErrUnsupported, "cloud provider %q can't reboot instances", cloudProvider.GetName())
+	}
+
+	err = rebooter.RebootInstance(instance.Id)
+	m.recordAction(name, ActionReboot, source, err)
+	if err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
+
+// NewPoller returns a Poller of the instances of the manager, safe to run
+// concurrently with its operations, notifying the state changes to its
+// notifier and publishing them on its event bus.
+func (m *Manager) NewPoller() *Poller {
+	return &Poller{db: m.db, cloudProviders: m.cloudProviders, mu: &m.mu, Notifier: m.notifier, events: m.events}
+}
+
+// Update runs operation on the database as saved by the other processes and
+// saves it, like Database.Update, one update at a time.
+func (m *Manager) Update(ctx context.Context, operation func() error) (err error) {
+	m.updates.Lock()
+	defer m.updates.Unlock()
+
+	unlock, err := m.db.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil && unlockErr != nil {
+			err = fmt.Errorf("unlock database: %v", unlockErr)
+		}
+	}()
+
+	m.mu.Lock()
+	err = m.db.Reload()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = operation()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if saveErr := m.db.SaveContext(ctx); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// ObserveStates records the states observed by a poller of the manager,
+// like after the database was reloaded.
+func (m *Manager) ObserveStates(records []StateRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, record := range records {
+		m.db.ObserveState(record)
+	}
+}
+
+// resolve returns a tracked instance and its cloud provider.
+func (m *Manager) resolve(name string) (Instance, CloudProvider, error) {
+	instance, err := m.Instance(name)
+	if err != nil {
+		return Instance{}, nil, err
+	}
+
+	cloudProvider, err := instance.GetCloudProvider(m.cloudProviders)
+	if err != nil {
+		return Instance{}, nil, err
+	}
+
+	return instance, cloudProvider, nil
+}
+
+// recordAction records in the database an action performed on behalf of a
+// user, and notifies the webhooks.
+func (m *Manager) recordAction(name string, action ActionType, source string, err error) {
+	record := Action{Time: m.now(), Instance: name, Action: action, Source: source}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	m.db.RecordAction(record)
+	event := ActionEvent(record, m.db.Instances[name])
+	webhooks := maps.Clone(m.db.Webhooks)
+	m.mu.Unlock()
+
+	event = m.events.Publish(event)
+	if m.notifier != nil {
+		m.notifier.Notify(event, webhooks)
+	}
+}
+
+// observe records the state of an instance returned by its cloud provider,
+// and publishes and notifies it if it changed, like a poller would.
+func (m *Manager) observe(name string, state InstanceState) {
+	m.mu.Lock()
+	record := StateRecord{Time: m.now(), Instance: name, State: state}
+	record.Previous, _ = m.db.LastState(name)
+	var events []Event
+	if m.db.ObserveState(record) {
+		events = StateChangeEvents(m.db, []StateRecord{record})
+	}
+	webhooks := maps.Clone(m.db.Webhooks)
+	m.mu.Unlock()
+
+	for _, event := range events {
+		event = m.events.Publish(event)
+		if m.notifier != nil {
+			m.notifier.Notify(event, webhooks)
+		}
+	}
+}
+
+// currentState describes the current state of an instance, as reported by
+// its cloud provider, which is the response of the operations not changing
+// it.
+func currentState(cloudProvider CloudProvider, id string) string {
+	state, err := cloudProvider.GetInstanceStatus(id)
+	if err != nil {
+		return fmt.Sprintf("current state unknown: %v", err)
+	}
+	return fmt.Sprintf("current state %s", state)
+}
@@ -0,0 +1,268 @@
+package instances
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiCallBuckets are the upper bounds, in seconds, of the buckets of the
+// cloud provider API call duration histogram.
+var apiCallBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the states of the instances observed by a Poller and the
+// calls made to the cloud provider APIs, and exports them in the Prometheus
+// text format. It is safe for concurrent use.
+type Metrics struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	instances []InstanceObservation
+	lastPoll  time.Time
+	apiCalls  map[apiCall]*apiCallStats
+}
+
+// InstanceObservation is the last observed state of an instance.
+type InstanceObservation struct {
+	NamedInstance
+	// State is the last observed state, and Since the time it was first
+	// observed. State is empty if it was never observed.
+	State InstanceState
+	Since time.Time
+	// LastPoll is the last time the state was successfully polled.
+	LastPoll time.Time
+}
+
+type apiCall struct {
+	provider  string
+	operation string
+}
+
+type apiCallStats struct {
+	count   uint64
+	errors  uint64
+	sum     float64
+	buckets []uint64
+}
+
+func NewMetrics(now func() time.Time) *Metrics {
+	return &Metrics{now: now, apiCalls: map[apiCall]*apiCallStats{}}
+}
+
+// ObserveAPICall records a call to an operation of a cloud provider API.
+func (m *Metrics) ObserveAPICall(provider, operation string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := apiCall{provider: provider, operation: operation}
+	stats, exists := m.apiCalls[key]
+	if !exists {
+		stats = &apiCallStats{buckets: make([]uint64, len(apiCallBuckets))}
+		m.apiCalls[key] = stats
+	}
+
+	stats.count++
+	if err != nil {
+		stats.errors++
+	}
+	seconds := duration.Seconds()
+	stats.sum += seconds
+	for i, bound := range apiCallBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+}
+
+// ObserveInstances replaces the observations of the instances with the ones
+// of a poll that ended at the given time.
+func (m *Metrics) ObserveInstances(observations []InstanceObservation, polledAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.instances = observations
+	m.lastPoll = polledAt
+}
+
+// lastInstancePolls returns the last time the state of each instance was
+// successfully polled.
+func (m *Metrics) lastInstancePolls() map[string]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	polls := map[string]time.Time{}
+	for _, observation := range m.instances {
+		polls[observation.Name] = observation.LastPoll
+	}
+	return polls
+}
+
+// metricsContentType is the content type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ServeHTTP writes all the metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	m.Write(w, func(Instance) bool { return true })
+}
+
+// Write writes the metrics of the instances for which include returns true,
+// and the cloud provider API metrics, in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer, include func(Instance) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var b strings.Builder
+
+	var instances []InstanceObservation
+	for _, observation := range m.instances {
+		if include(observation.Instance) {
+			instances = append(instances, observation)
+		}
+	}
+
+	writeHeader(&b, "instances_instance_state", "gauge", "Whether the instance was in the state when last observed.")
+	for _, observation := range instances {
+		if observation.State == "" {
+			continue
+		}
+		// Every state has a series, set to 0 unless it is the observed one.
+		for _, state := range instanceStates {
+			value := 0.0
+			if observation.State == state {
+				value = 1
+			}
+			writeSample(&b, "instances_instance_state", instanceLabels(observation, "state", string(state)), value)
+		}
+	}
+
+	writeHeader(&b, "instances_instance_state_duration_seconds", "gauge", "How long the instance has been in its current state.")
+	for _, observation := range instances {
+		if observation.State == "" {
+			continue
+		}
+		labels := instanceLabels(observation, "state", string(observation.State))
+		writeSample(&b, "instances_instance_state_duration_seconds", labels, now.Sub(observation.Since).Seconds())
+	}
+
+	writeHeader(&b, "instances_instance_last_poll_timestamp_seconds", "gauge", "When the state of the instance was last successfully polled.")
+	for _, observation := range instances {
+		if observation.LastPoll.IsZero() {
+			continue
+		}
+		writeSample(&b, "instances_instance_last_poll_timestamp_seconds", instanceLabels(observation), timestamp(observation.LastPoll))
+	}
+
+	if !m.lastPoll.IsZero() {
+		writeHeader(&b, "instances_last_poll_timestamp_seconds", "gauge", "When the instances were last polled.")
+		writeSample(&b, "instances_last_poll_timestamp_seconds", nil, timestamp(m.lastPoll))
+	}
+
+	calls := make([]apiCall, 0, len(m.apiCalls))
+	for call := range m.apiCalls {
+		calls = append(calls, call)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].provider != calls[j].provider {
+			return calls[i].provider < calls[j].provider
+		}
+		return calls[i].operation < calls[j].operation
+	})
+
+	writeHeader(&b, "instances_provider_api_calls_total", "counter", "Calls made to the cloud provider APIs.")
+	for _, call := range calls {
+		writeSample(&b, "instances_provider_api_calls_total", call.labels(), float64(m.apiCalls[call].count))
+	}
+
+	writeHeader(&b, "instances_provider_api_errors_total", "counter", "Calls made to the cloud provider APIs which failed.")
+	for _, call := range calls {
+		writeSample(&b, "instances_provider_api_errors_total", call.labels(), float64(m.apiCalls[call].errors))
+	}
+
+	writeHeader(&b, "instances_provider_api_call_duration_seconds", "histogram", "Duration of the calls made to the cloud provider APIs.")
+	for _, call := range calls {
+		stats := m.apiCalls[call]
+		for i, bound := range apiCallBuckets {
+			labels := append(call.labels(), "le", strconv.FormatFloat(bound, 'g', -1, 64))
+			writeSample(&b, "instances_provider_api_call_duration_seconds_bucket", labels, float64(stats.buckets[i]))
+		}
+		writeSample(&b, "instances_provider_api_call_duration_seconds_bucket", append(call.labels(), "le", "+Inf"), float64(stats.count))
+		writeSample(&b, "instances_provider_api_call_duration_seconds_sum", call.labels(), stats.sum)
+		writeSample(&b, "instances_provider_api_call_duration_seconds_count", call.labels(), float64(stats.count))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (c apiCall) labels() []string {
+	return []string{"provider", c.provider, "operation", c.operation}
+}
+
+// instanceLabels returns the labels identifying an instance: its name,
+// provider, group and tags, followed by extra label pairs.
+func instanceLabels(observation InstanceObservation, extra ...string) []string {
+	labels := []string{"name", observation.Name, "provider", observation.CloudProviderName}
+	if observation.Group != "" {
+		labels = append(labels, "group", observation.Group)
+	}
+
+	// Tags whose keys sanitize to the same label name, like "cost-center"
+	// and "cost_center", would make duplicate labels, which Prometheus
+	// rejects. The one whose key is a valid label name already is kept, else
+	// the first one.
+	tagKeys := map[string]string{}
+	for _, key := range sortedKeys(observation.Tags) {
+		name := "tag_" + sanitizeLabelName(key)
+		if _, exists := tagKeys[name]; exists && sanitizeLabelName(key) != key {
+			continue
+		}
+		tagKeys[name] = key
+	}
+	for _, name := range sortedKeys(tagKeys) {
+		labels = append(labels, name, observation.Tags[tagKeys[name]])
+	}
+	return append(labels, extra...)
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes a sample of a metric with labels given as name/value
+// pairs.
+func writeSample(b *strings.Builder, name string, labels []string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", labels[i], labelValueEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(b, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sanitizeLabelName replaces the characters not allowed in Prometheus label
+// names with underscores.
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func timestamp(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
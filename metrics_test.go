@@ -0,0 +1,182 @@
+package instances_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func TestMetricsInstances(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	provider := fakecloud.New(fakecloud.WithName("mock"))
+	provider.AddInstance("id1", instances.InstanceStateRunning, instances.InstanceDetails{})
+	if err := db.AddInstance("id1", "web", provider); err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpdateInstance("web", func(instance *instances.Instance) {
+		instance.Group = "prod"
+		instance.Tags = map[string]string{"team": `web "front"`, "cost-center": "42"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2023, 4, 10, 8, 0, 0, 0, time.UTC)
+	now := start
+	metrics := instances.NewMetrics(func() time.Time { return now })
+	poller := instances.NewPoller(db, map[string]instances.CloudProvider{"mock": provider})
+	poller.Metrics = metrics
+
+	poller.Run(start)
+	now = start.Add(90 * time.Second)
+	poller.Run(start.Add(time.Minute))
+
+	var out strings.Builder
+	if err := metrics.Write(&out, func(instances.Instance) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := `name="web",provider="mock",group="prod",tag_cost_center="42",tag_team="web \"front\""`
+	for _, want := range []string{
+		"# TYPE instances_instance_state gauge\n",
+		`instances_instance_state{` + labels + `,state="running"} 1` + "\n",
+		`instances_instance_state{` + labels + `,state="stopped"} 0` + "\n",
+		`instances_instance_state_duration_seconds{` + labels + `,state="running"} 90` + "\n",
+		`instances_instance_last_poll_timestamp_seconds{` + labels + `} 1.68111366e+09` + "\n",
+		"instances_last_poll_timestamp_seconds 1.68111366e+09\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, out.String())
+		}
+	}
+
+	// The instance of the initial database can't be polled.
+	if strings.Contains(out.String(), `name="myInstance"`) {
+		t.Errorf("metrics contain an instance never observed:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := metrics.Write(&out, func(instance instances.Instance) bool { return instance.Group == "dev" }); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `name="web"`) {
+		t.Errorf("metrics contain an excluded instance:\n%s", out.String())
+	}
+}
+
+func TestMetricsTagCollisions(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		tags       map[string]string
+		wantLabels string
+	}{
+		"valid key kept": {
+			tags:       map[string]string{"cost-center": "a", "cost_center": "b"},
+			wantLabels: `tag_cost_center="b"`,
+		},
+		"first key kept": {
+			tags:       map[string]string{"cost.center": "b", "cost-center": "a"},
+			wantLabels: `tag_cost_center="a"`,
+		},
+		"no collision": {
+			tags:       map[string]string{"cost-center": "a", "team": "web"},
+			wantLabels: `tag_cost_center="a",tag_team="web"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+			err = db.UpdateInstance(existingInstanceName, func(instance *instances.Instance) {
+				instance.Tags = test.tags
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			metrics := instances.NewMetrics(time.Now)
+			poller := instances.NewPoller(db, map[string]instances.CloudProvider{"mock": newTestCloud()})
+			poller.Metrics = metrics
+			poller.Run(time.Now())
+
+			var out strings.Builder
+			if err := metrics.Write(&out, func(instances.Instance) bool { return true }); err != nil {
+				t.Fatal(err)
+			}
+			want := `instances_instance_state{name="` + existingInstanceName + `",provider="mock",` + test.wantLabels + `,state="running"} 1`
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("metrics don't contain %q:\n%s", want, out.String())
+			}
+		})
+	}
+}
+
+func TestMetricsAPICalls(t *testing.T) {
+	t.Parallel()
+	metrics := instances.NewMetrics(time.Now)
+	metrics.ObserveAPICall("aws", "StartInstances", 200*time.Millisecond, nil)
+	metrics.ObserveAPICall("aws", "StartInstances", 3*time.Second, errors.New("throttled"))
+
+	var out strings.Builder
+	if err := metrics.Write(&out, func(instances.Instance) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := `provider="aws",operation="StartInstances"`
+	for _, want := range []string{
+		`instances_provider_api_calls_total{` + labels + `} 2` + "\n",
+		`instances_provider_api_errors_total{` + labels + `} 1` + "\n",
+		"# TYPE instances_provider_api_call_duration_seconds histogram\n",
+		`instances_provider_api_call_duration_seconds_bucket{` + labels + `,le="0.1"} 0` + "\n",
+		`instances_provider_api_call_duration_seconds_bucket{` + labels + `,le="0.25"} 1` + "\n",
+		`instances_provider_api_call_duration_seconds_bucket{` + labels + `,le="5"} 2` + "\n",
+		`instances_provider_api_call_duration_seconds_bucket{` + labels + `,le="+Inf"} 2` + "\n",
+		`instances_provider_api_call_duration_seconds_sum{` + labels + `} 3.2` + "\n",
+		`instances_provider_api_call_duration_seconds_count{` + labels + `} 2` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	t.Parallel()
+	metrics := instances.NewMetrics(time.Now)
+	metrics.ObserveAPICall("aws", "DescribeInstanceStatus", time.Second, nil)
+	server, _ := newTestServer(t, instances.WithServerMetrics(metrics))
+
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), `instances_provider_api_calls_total{provider="aws",operation="DescribeInstanceStatus"} 1`) {
+		t.Fatalf("unexpected metrics:\n%s", body)
+	}
+}
@@ -0,0 +1,356 @@
+package instances
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// EventType is a kind of event webhooks are notified of.
+type EventType string
+
+const (
+	// EventAction is an action performed on an instance, by a user or an
+	// automated source.
+	EventAction EventType = "action"
+	// EventStateChange is a change of the state of an instance, observed
+	// when polling it.
+	EventStateChange EventType = "state-change"
+	// EventTest is sent by `instances webhook test`.
+	EventTest EventType = "test"
+	// EventInstanceAdded and EventInstanceRemoved are published on the
+	// event bus when an instance is added or removed.
+	EventInstanceAdded   EventType = "instance-added"
+	EventInstanceRemoved EventType = "instance-removed"
+)
+
+// unexpectedWindow is how long after an action on an instance a state change
+// it explains is expected.
+const unexpectedWindow = 15 * time.Minute
+
+// Event is an action on an instance, a change of its state, or its addition
+// or removal.
+type Event struct {
+	// ID is the sequence number of the event on an EventBus.
+	ID       uint64            `json:"id,omitempty"`
+	Type     EventType         `json:"type"`
+	Time     time.Time         `json:"time"`
+	Instance string            `json:"instance"`
+	Group    string            `json:"group,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// Action, Source, Message and Error describe an action.
+	Action  ActionType `json:"action,omitempty"`
+	Source  string     `json:"source,omitempty"`
+	Message string     `json:"message,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	// State and Previous describe a state change, which is unexpected when
+	// no recent action explains it.
+	State      InstanceState `json:"state,omitempty"`
+	Previous   InstanceState `json:"previous,omitempty"`
+	Unexpected bool          `json:"unexpected,omitempty"`
+}
+
+// ActionEvent returns the event of an action on an instance.
+func ActionEvent(action Action, instance Instance) Event {
+	return Event{
+		Type:     EventAction,
+		Time:     action.Time,
+		Instance: action.Instance,
+		Group:    instance.Group,
+		Tags:     instance.Tags,
+		Action:   action.Action,
+		Source:   action.Source,
+		Message:  action.Message,
+		Error:    action.Error,
+	}
+}
+
+// StateChangeEvents returns the events of the state transitions observed in
+// the database, skipping the first observations of instances.
+func StateChangeEvents(db *Database, transitions []StateRecord) []Event {
+	var events []Event
+	for _, transition := range transitions {
+		if transition.Previous == "" {
+			continue
+		}
+		instance := db.Instances[transition.Instance]
+		events = append(events, Event{
+			Type:       EventStateChange,
+			Time:       transition.Time,
+			Instance:   transition.Instance,
+			Group:      instance.Group,
+			Tags:       instance.Tags,
+			State:      transition.State,
+			Previous:   transition.Previous,
+			Unexpected: !db.explainsTransition(transition),
+		})
+	}
+	return events
+}
+
+// explainsTransition reports whether a recent successful action on the
+// instance explains a transition.
+func (d *Database) explainsTransition(transition StateRecord) bool {
+	for i := len(d.Actions) - 1; i >= 0; i-- {
+		action := d.Actions[i]
+		if action.Time.Before(transition.Time.Add(-unexpectedWindow)) {
+			break
+		}
+		if action.Instance != transition.Instance || action.Skipped != "" || action.Error != "" {
+			continue
+		}
+
+		switch action.Action {
+		case ActionStart:
+			return transition.State == InstanceStatePending || transition.State == InstanceStateRunning
+		case ActionStop:
+			return transition.State == InstanceStateStopping || transition.State == InstanceStateStopped
+		case ActionReboot:
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is an HTTP endpoint notified of the events matching its filters
+// with a JSON payload.
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret, if set, is the key of the HMAC-SHA256 signature of the
+	// payloads, sent in the X-Instances-Signature header.
+	Secret string `json:"secret,omitempty"`
+	// Template is a text/template rendering the payload from the Event. By
+	// default, the payload is the event itself.
+	Template string `json:"template,omitempty"`
+
+	// Events, Instances, Groups and States restrict the events the webhook
+	// is notified of, when they are set.
+	Events    []EventType     `json:"events,omitempty"`
+	Instances []string        `json:"instances,omitempty"`
+	Groups    []string        `json:"groups,omitempty"`
+	States    []InstanceState `json:"states,omitempty"`
+	// UnexpectedOnly restricts the state change events to the unexpected
+	// ones.
+	UnexpectedOnly bool `json:"unexpected-only,omitempty"`
+}
+
+// Validate checks that the webhook has an HTTP URL, known event types and a
+// valid template.
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", w.URL)
+	}
+	for _, eventType := range w.Events {
+		if eventType != EventAction && eventType != EventStateChange {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	if _, err := w.template(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Matches reports whether the webhook is notified of an event. Test events
+// match every webhook.
+func (w Webhook) Matches(event Event) bool {
+	if event.Type == EventTest {
+		return true
+	}
+	if len(w.Events) > 0 && !slices.Contains(w.Events, event.Type) {
+		return false
+	}
+	if len(w.Instances) > 0 && !slices.Contains(w.Instances, event.Instance) {
+		return false
+	}
+	if len(w.Groups) > 0 && !slices.Contains(w.Groups, event.Group) {
+		return false
+	}
+	if event.Type == EventStateChange {
+		if len(w.States) > 0 && !slices.Contains(w.States, event.State) {
+			return false
+		}
+		if w.UnexpectedOnly && !event.Unexpected {
+			return false
+		}
+	}
+	return true
+}
+
+// Payload renders the payload of an event.
+func (w Webhook) Payload(event Event) ([]byte, error) {
+	tmpl, err := w.template()
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == nil {
+		return json.Marshal(event)
+	}
+
+	var payload bytes.Buffer
+	if err := tmpl.Execute(&payload, event); err != nil {
+		return nil, fmt.Errorf("render webhook payload: %v", err)
+	}
+	if !json.Valid(payload.Bytes()) {
+		return nil, fmt.Errorf("render webhook payload: invalid JSON %q", payload.String())
+	}
+	return payload.Bytes(), nil
+}
+
+func (w Webhook) template() (*template.Template, error) {
+	if w.Template == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		// json encodes a value, to embed strings in the payload safely.
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(w.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// Sign returns the value of the X-Instances-Signature header of a payload.
+func (w Webhook) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notifier delivers events to webhooks in the background, retrying failed
+// deliveries.
+type Notifier struct {
+	client     *http.Client
+	attempts   int
+	retryDelay time.Duration
+	onError    func(name string, event Event, err error)
+	pending    sync.WaitGroup
+}
+
+// NotifierOption configures optional behavior of a Notifier.
+type NotifierOption func(*Notifier)
+
+// WithHTTPClient sets the client delivering the events (by default, a
+// client with a 10 seconds timeout).
+func WithHTTPClient(client *http.Client) NotifierOption {
+	return func(n *Notifier) {
+		n.client = client
+	}
+}
+
+// WithRetries sets how many times a delivery is attempted (3 by default)
+// and the delay before the first retry (1 second by default), doubled after
+// each attempt.
+func WithRetries(attempts int, delay time.Duration) NotifierOption {
+	return func(n *Notifier) {
+		n.attempts = attempts
+		n.retryDelay = delay
+	}
+}
+
+// WithDeliveryErrorHandler sets the function called when an event couldn't
+// be delivered to a webhook. By default, errors are ignored.
+func WithDeliveryErrorHandler(onError func(name string, event Event, err error)) NotifierOption {
+	return func(n *Notifier) {
+		n.onError = onError
+	}
+}
+
+func NewNotifier(opts ...NotifierOption) *Notifier {
+	n := &Notifier{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		attempts:   3,
+		retryDelay: time.Second,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// Notify delivers an event, in the background, to the webhooks it matches.
+func (n *Notifier) Notify(event Event, webhooks map[string]Webhook) {
+	for _, name := range sortedKeys(webhooks) {
+		webhook := webhooks[name]
+		if !webhook.Matches(event) {
+			continue
+		}
+
+		n.pending.Add(1)
+		go func() {
+			defer n.pending.Done()
+			if err := n.Deliver(webhook, event); err != nil && n.onError != nil {
+				n.onError(name, event, err)
+			}
+		}()
+	}
+}
+
+// Wait waits for the deliveries in progress to complete.
+func (n *Notifier) Wait() {
+	n.pending.Wait()
+}
+
+// Deliver sends an event to a webhook, retrying on network errors and
+// server errors.
+func (n *Notifier) Deliver(webhook Webhook, event Event) error {
+	payload, err := webhook.Payload(event)
+	if err != nil {
+		return err
+	}
+
+	delay := n.retryDelay
+	for attempt := 1; ; attempt++ {
+		retryable, err := n.post(webhook, event, payload)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= n.attempts {
+			return fmt.Errorf("deliver %s event to %s: %v", event.Type, webhook.URL, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a payload to a webhook, and reports whether a failure may be
+// temporary.
+func (n *Notifier) post(webhook Webhook, event Event, payload []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "instances-webhook")
+	req.Header.Set("X-Instances-Event", string(event.Type))
+	if webhook.Secret != "" {
+		req.Header.Set("X-Instances-Signature", webhook.Sign(payload))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.New(resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,312 @@
+package instances_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+// webhookReceiver is a local stand-in for a webhook endpoint, answering
+// with the given statuses in turn, then 204.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   string
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) (*webhookReceiver, string) {
+	t.Helper()
+	receiver := &webhookReceiver{statuses: statuses}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server.URL
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, receivedWebhook{header: req.Header, body: string(body)})
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *webhookReceiver) received() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedWebhook(nil), r.requests...)
+}
+
+func TestWebhookValidate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		webhook instances.Webhook
+		wantErr string
+	}{
+		"valid webhook": {
+			webhook: instances.Webhook{
+				URL:      "https://chat.example.com/hook",
+				Events:   []instances.EventType{instances.EventStateChange},
+				Template: `{"text": {{printf "%s is %s" .Instance .State | json}}}`,
+			},
+		},
+		"missing URL": {
+			webhook: instances.Webhook{},
+			wantErr: "invalid webhook URL",
+		},
+		"not an HTTP URL": {
+			webhook: instances.Webhook{URL: "ftp://example.com"},
+			wantErr: "invalid webhook URL",
+		},
+		"unknown event type": {
+			webhook: instances.Webhook{URL: "https://example.com", Events: []instances.EventType{"reboot"}},
+			wantErr: "unknown event type",
+		},
+		"invalid template": {
+			webhook: instances.Webhook{URL: "https://example.com", Template: "{{.Instance"},
+			wantErr: "invalid webhook template",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.webhook.Validate()
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	t.Parallel()
+	stopped := instances.Event{
+		Type:       instances.EventStateChange,
+		Instance:   "web",
+		Group:      "prod",
+		State:      instances.InstanceStateStopped,
+		Previous:   instances.InstanceStateRunning,
+		Unexpected: true,
+	}
+	tests := map[string]struct {
+		webhook instances.Webhook
+		event   instances.Event
+		want    bool
+	}{
+		"no filter": {
+			event: stopped,
+			want:  true,
+		},
+		"matching event type": {
+			webhook: instances.Webhook{Events: []instances.EventType{instances.EventStateChange}},
+			event:   stopped,
+			want:    true,
+		},
+		"other event type": {
+			webhook: instances.Webhook{Events: []instances.EventType{instances.EventAction}},
+			event:   stopped,
+			want:    false,
+		},
+		"other group": {
+			webhook: instances.Webhook{Groups: []string{"dev"}},
+			event:   stopped,
+			want:    false,
+		},
+		"other instance": {
+			webhook: instances.Webhook{Instances: []string{"db"}},
+			event:   stopped,
+			want:    false,
+		},
+		"matching state": {
+			webhook: instances.Webhook{States: []instances.InstanceState{instances.InstanceStateStopped}},
+			event:   stopped,
+			want:    true,
+		},
+		"other state": {
+			webhook: instances.Webhook{States: []instances.InstanceState{instances.InstanceStateRunning}},
+			event:   stopped,
+			want:    false,
+		},
+		"unexpected only": {
+			webhook: instances.Webhook{UnexpectedOnly: true},
+			event:   instances.Event{Type: instances.EventStateChange, State: instances.InstanceStateStopped},
+			want:    false,
+		},
+		"unexpected only doesn't filter actions": {
+			webhook: instances.Webhook{UnexpectedOnly: true},
+			event:   instances.Event{Type: instances.EventAction, Action: instances.ActionStop},
+			want:    true,
+		},
+		"test event": {
+			webhook: instances.Webhook{Events: []instances.EventType{instances.EventAction}, Groups: []string{"dev"}},
+			event:   instances.Event{Type: instances.EventTest},
+			want:    true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := test.webhook.Matches(test.event); got != test.want {
+				t.Fatalf("Matches() = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNotifierDeliver(t *testing.T) {
+	t.Parallel()
+	event := instances.Event{
+		Type:     instances.EventAction,
+		Time:     time.Date(2023, 4, 10, 8, 0, 0, 0, time.UTC),
+		Instance: `web "1"`,
+		Action:   instances.ActionStart,
+		Source:   "cli",
+	}
+	tests := map[string]struct {
+		statuses     []int
+		template     string
+		wantErr      string
+		wantAttempts int
+		wantBody     string
+	}{
+		"default payload": {
+			wantAttempts: 1,
+			wantBody:     `{"type":"action","time":"2023-04-10T08:00:00Z","instance":"web \"1\"","action":"start","source":"cli"}`,
+		},
+		"templated payload": {
+			template:     `{"text": {{printf "%s %s (%s)" .Action .Instance .Source | json}}}`,
+			wantAttempts: 1,
+			wantBody:     `{"text": "start web \"1\" (cli)"}`,
+		},
+		"template rendering invalid JSON": {
+			template:     `{"text": "{{.Instance}}"}`,
+			wantErr:      "invalid JSON",
+			wantAttempts: 0,
+		},
+		"retried server errors": {
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			wantAttempts: 3,
+		},
+		"too many server errors": {
+			statuses:     []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			wantErr:      "502 Bad Gateway",
+			wantAttempts: 3,
+		},
+		"client error not retried": {
+			statuses:     []int{http.StatusBadRequest},
+			wantErr:      "400 Bad Request",
+			wantAttempts: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			receiver, url := newWebhookReceiver(t, test.statuses...)
+			webhook := instances.Webhook{URL: url, Secret: "s3cr3t", Template: test.template}
+			notifier := instances.NewNotifier(instances.WithRetries(3, time.Millisecond))
+
+			err := notifier.Deliver(webhook, event)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			requests := receiver.received()
+			if len(requests) != test.wantAttempts {
+				t.Fatalf("got %d attempts, want %d", len(requests), test.wantAttempts)
+			}
+			if len(requests) == 0 {
+				return
+			}
+			request := requests[len(requests)-1]
+			if test.wantBody != "" && request.body != test.wantBody {
+				t.Fatalf("unexpected body %s, want %s", request.body, test.wantBody)
+			}
+			if request.header.Get("X-Instances-Event") != "action" {
+				t.Fatalf("unexpected event header %q", request.header.Get("X-Instances-Event"))
+			}
+			mac := hmac.New(sha256.New, []byte("s3cr3t"))
+			mac.Write([]byte(request.body))
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); request.header.Get("X-Instances-Signature") != want {
+				t.Fatalf("unexpected signature %q, want %q", request.header.Get("X-Instances-Signature"), want)
+			}
+		})
+	}
+}
+
+func TestNotifyActionsAndStateChanges(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	provider := fakecloud.New(fakecloud.WithName("mock"))
+	provider.AddInstance("id1", instances.InstanceStateStopped, instances.InstanceDetails{})
+	provider.AddInstance("id2", instances.InstanceStateRunning, instances.InstanceDetails{})
+	cloudProviders := map[string]instances.CloudProvider{"mock": provider}
+	for id, name := range map[string]string{"id1": "web", "id2": "db"} {
+		if err := db.AddInstance(id, name, provider); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actions, actionsURL := newWebhookReceiver(t)
+	unexpected, unexpectedURL := newWebhookReceiver(t)
+	if err := db.AddWebhook("actions", instances.Webhook{URL: actionsURL, Events: []instances.EventType{instances.EventAction}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddWebhook("unexpected", instances.Webhook{URL: unexpectedURL, UnexpectedOnly: true, Events: []instances.EventType{instances.EventStateChange}}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2023, 4, 10, 8, 0, 0, 0, time.UTC)
+	notifier := instances.NewNotifier()
+	manager := instances.NewManager(db, cloudProviders, func() time.Time { return now }, instances.WithManagerNotifier(notifier))
+	poller := manager.NewPoller()
+
+	// First observations aren't notified.
+	poller.Run(now)
+
+	// web is started by a user, db stops on its own.
+	if _, err := manager.StartInstance("web", 0, "cli"); err != nil {
+		t.Fatal(err)
+	}
+	provider.StopInstance("id2")
+	now = now.Add(time.Minute)
+	poller.Run(now)
+	notifier.Wait()
+
+	if got := actions.received(); len(got) != 1 || !containsAll(got[0].body, `"instance":"web"`, `"action":"start"`) {
+		t.Fatalf("unexpected action notifications: %+v", got)
+	}
+	if got := unexpected.received(); len(got) != 1 || !containsAll(got[0].body, `"instance":"db"`, `"state":"stopped"`, `"previous":"running"`, `"unexpected":true`) {
+		t.Fatalf("unexpected state change notifications: %+v", got)
+	}
+}
+
+func containsAll(s string, substrings ...string) bool {
+	for _, substring := range substrings {
+		if !strings.Contains(s, substring) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package instances
+
+import (
+	"sync"
+	"time"
+)
+
+// StateRecord is a state of an instance observed at a given time.
+type StateRecord struct {
+	Time     time.Time     `json:"time"`
+	Instance string        `json:"instance"`
+	State    InstanceState `json:"state"`
+	// Previous is the state recorded before, set on the transitions
+	// returned by a Poller.
+	Previous InstanceState `json:"-"`
+}
+
+// Poller gets the state of every instance of a Database and records the
+// transitions it observes.
+type Poller struct {
+	db             *Database
+	cloudProviders map[string]CloudProvider
+	// mu guards the database, it isn't held while the cloud providers are
+	// queried.
+	mu sync.Locker
+	// Metrics, if set, receives the observed states after every run.
+	Metrics *Metrics
+	// Notifier, if set, notifies the webhooks of the database of the
+	// transitions.
+	Notifier *Notifier
+	// events, if set, is the bus the transitions are published to.
+	events *EventBus
+}
+
+func NewPoller(db *Database, cloudProviders map[string]CloudProvider) *Poller {
+	return &Poller{db: db, cloudProviders: cloudProviders, mu: &sync.Mutex{}}
+}
+
+// Run gets the state of every instance and returns the transitions observed
+// since the previous known states. Instances whose state cannot be
+// retrieved are skipped.
+func (p *Poller) Run(now time.Time) []StateRecord {
+	p.mu.Lock()
+	instances := make(map[string]Instance, len(p.db.Instances))
+	for name, instance := range p.db.Instances {
+		instances[name] = instance
+	}
+	p.mu.Unlock()
+
+	states := map[string]InstanceState{}
+	for name, instance := range instances {
+		cloudProvider, err := instance.GetCloudProvider(p.cloudProviders)
+		if err != nil {
+			continue
+		}
+
+		state, err := freshInstanceStatus(cloudProvider, instance.Id)
+		if err != nil {
+			continue
+		}
+		states[name] = state
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var transitions []StateRecord
+	for _, name := range sortedKeys(states) {
+		if _, exists := p.db.Instances[name]; !exists {
+			// Removed while it was polled.
+			continue
+		}
+		record := StateRecord{Time: now, Instance: name, State: states[name]}
+		record.Previous, _ = p.db.LastState(name)
+		if p.db.ObserveState(record) {
+			transitions = append(transitions, record)
+		}
+	}
+
+	if p.Metrics != nil {
+		p.Metrics.ObserveInstances(p.observations(states, now), now)
+	}
+	for _, event := range StateChangeEvents(p.db, transitions) {
+		if p.events != nil {
+			event = p.events.Publish(event)
+		}
+		if p.Notifier != nil {
+			p.Notifier.Notify(event, p.db.Webhooks)
+		}
+	}
+
+	return transitions
+}
+
+// observations returns the last observed states of the instances, given the
+// states successfully polled at now.
+func (p *Poller) observations(polled map[string]InstanceState, now time.Time) []InstanceObservation {
+	lastPolls := p.Metrics.lastInstancePolls()
+
+	var observations []InstanceObservation
+	for _, name := range sortedKeys(p.db.Instances) {
+		observation := InstanceObservation{
+			NamedInstance: NamedInstance{Name: name, Instance: p.db.Instances[name]},
+			LastPoll:      lastPolls[name],
+		}
+		if _, ok := polled[name]; ok {
+			observation.LastPoll = now
+		}
+		if record, ok := p.db.LastObservation(name); ok {
+			observation.State = record.State
+			observation.Since = record.Time
+		}
+		observations = append(observations, observation)
+	}
+	return observations
+}
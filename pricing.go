@@ -0,0 +1,47 @@
+package instances
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// PriceTable gives the hourly price of running an instance.
+type PriceTable interface {
+	// HourlyPrice returns the price of running an instance of the given type
+	// in the given region for one hour, and whether it is known.
+	HourlyPrice(instanceType, region string) (float64, bool)
+}
+
+// StaticPriceTable is a PriceTable holding hourly prices by region, then by
+// instance type. The "*" region holds the prices applying to any region
+// without its own.
+type StaticPriceTable map[string]map[string]float64
+
+// LoadPriceTable reads a StaticPriceTable serialized in JSON, like
+//
+//	{"us-east-1": {"t3.micro": 0.0104}, "*": {"t3.micro": 0.0118}}
+func LoadPriceTable(r io.Reader) (StaticPriceTable, error) {
+	var table StaticPriceTable
+	if err := json.NewDecoder(r).Decode(&table); err != nil {
+		return nil, fmt.Errorf("load price table: %v", err)
+	}
+
+	for region, prices := range table {
+		for instanceType, price := range prices {
+			if price < 0 {
+				return nil, fmt.Errorf("load price table: negative price for %s in %s", instanceType, region)
+			}
+		}
+	}
+
+	return table, nil
+}
+
+func (t StaticPriceTable) HourlyPrice(instanceType, region string) (float64, bool) {
+	if price, ok := t[region][instanceType]; ok {
+		return price, true
+	}
+	price, ok := t["*"][instanceType]
+	return price, ok
+}
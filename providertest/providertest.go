@@ -0,0 +1,278 @@
+// Package providertest provides a conformance test suite for cloud
+// providers, checking they behave as the rest of the module expects.
+//
+// A provider conforms when:
+//   - the calls about an unknown instance fail with instances.ErrNotFound;
+//   - starting a running instance, or stopping or rebooting one which isn't
+//     running, fails with instances.ErrInvalidState and leaves it as is;
+//   - a started instance is pending or running until it is running, and a
+//     stopped one is stopping or stopped until it is stopped;
+//   - the optional capabilities it implements (instances.Rebooter,
+//     instances.InstanceDescriber, instances.MetricsProvider,
+//     instances.StateChanger and instances.ContextBinder) follow the same
+//     rules, and the state changes it returns are the ones of the
+//     instances.
+package providertest
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+)
+
+// Fixture is a cloud provider under test, with instances in known states.
+type Fixture struct {
+	Provider instances.CloudProvider
+	// RunningID and StoppedID are the IDs of a running and a stopped
+	// instance.
+	RunningID string
+	StoppedID string
+	// UnknownID is an ID of no instance.
+	UnknownID string
+	// Settle, if set, is called while waiting for the instances to
+	// transition, to make them progress (like by advancing a fake clock).
+	Settle func()
+	// Timeout is how long to wait for the instances to transition, 10
+	// seconds by default.
+	Timeout time.Duration
+}
+
+// Factory returns a new fixture, whose instances are in their initial
+// states, for each test of the suite.
+type Factory func(t *testing.T) Fixture
+
+// pollInterval is how often the state of the instances is polled while
+// waiting for them to transition.
+const pollInterval = 10 * time.Millisecond
+
+// RunConformance runs the conformance test suite against the cloud providers
+// returned by factory.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Run("Name", func(t *testing.T) {
+		if factory(t).Provider.GetName() == "" {
+			t.Error("empty name")
+		}
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		f := factory(t)
+		expectState(t, f, f.RunningID, instances.InstanceStateRunning)
+		expectState(t, f, f.StoppedID, instances.InstanceStateStopped)
+		_, err := f.Provider.GetInstanceStatus(f.UnknownID)
+		expectError(t, "status of an unknown instance", err, instances.ErrNotFound)
+	})
+
+	t.Run("Start", func(t *testing.T) {
+		t.Run("stopped instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "start", f.Provider.StartInstance(f.StoppedID), nil)
+			waitForState(t, f, f.StoppedID, instances.InstanceStateRunning, instances.InstanceStatePending)
+		})
+		t.Run("running instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "start", f.Provider.StartInstance(f.RunningID), instances.ErrInvalidState)
+			expectState(t, f, f.RunningID, instances.InstanceStateRunning)
+		})
+		t.Run("unknown instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "start", f.Provider.StartInstance(f.UnknownID), instances.ErrNotFound)
+		})
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		t.Run("running instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "stop", f.Provider.StopInstance(f.RunningID), nil)
+			waitForState(t, f, f.RunningID, instances.InstanceStateStopped, instances.InstanceStateStopping)
+		})
+		t.Run("stopped instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "stop", f.Provider.StopInstance(f.StoppedID), instances.ErrInvalidState)
+			expectState(t, f, f.StoppedID, instances.InstanceStateStopped)
+		})
+		t.Run("unknown instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "stop", f.Provider.StopInstance(f.UnknownID), instances.ErrNotFound)
+		})
+	})
+
+	t.Run("StartStop", func(t *testing.T) {
+		f := factory(t)
+		expectError(t, "start", f.Provider.StartInstance(f.StoppedID), nil)
+		waitForState(t, f, f.StoppedID, instances.InstanceStateRunning, instances.InstanceStatePending)
+		expectError(t, "stop", f.Provider.StopInstance(f.StoppedID), nil)
+		waitForState(t, f, f.StoppedID, instances.InstanceStateStopped, instances.InstanceStateStopping)
+	})
+
+	t.Run("Reboot", func(t *testing.T) {
+		if _, ok := factory(t).Provider.(instances.Rebooter); !ok {
+			t.Skip("not a Rebooter")
+		}
+
+		t.Run("running instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "reboot", f.Provider.(instances.Rebooter).RebootInstance(f.RunningID), nil)
+			waitForState(t, f, f.RunningID, instances.InstanceStateRunning, instances.InstanceStatePending)
+		})
+		t.Run("stopped instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "reboot", f.Provider.(instances.Rebooter).RebootInstance(f.StoppedID), instances.ErrInvalidState)
+			expectState(t, f, f.StoppedID, instances.InstanceStateStopped)
+		})
+		t.Run("unknown instance", func(t *testing.T) {
+			f := factory(t)
+			expectError(t, "reboot", f.Provider.(instances.Rebooter).RebootInstance(f.UnknownID), instances.ErrNotFound)
+		})
+	})
+
+	t.Run("StateChange", func(t *testing.T) {
+		if _, ok := factory(t).Provider.(instances.StateChanger); !ok {
+			t.Skip("not a StateChanger")
+		}
+
+		t.Run("start", func(t *testing.T) {
+			f := factory(t)
+			change, err := f.Provider.(instances.StateChanger).StartInstanceChange(f.StoppedID)
+			expectError(t, "start", err, nil)
+			expectChange(t, change, instances.InstanceStateStopped, instances.InstanceStatePending, instances.InstanceStateRunning)
+		})
+		t.Run("stop", func(t *testing.T) {
+			f := factory(t)
+			change, err := f.Provider.(instances.StateChanger).StopInstanceChange(f.RunningID)
+			expectError(t, "stop", err, nil)
+			expectChange(t, change, instances.InstanceStateRunning, instances.InstanceStateStopping, instances.InstanceStateStopped)
+		})
+		t.Run("running instance", func(t *testing.T) {
+			f := factory(t)
+			_, err := f.Provider.(instances.StateChanger).StartInstanceChange(f.RunningID)
+			expectError(t, "start", err, instances.ErrInvalidState)
+		})
+	})
+
+	t.Run("Describe", func(t *testing.T) {
+		f := factory(t)
+		describer, ok := f.Provider.(instances.InstanceDescriber)
+		if !ok {
+			t.Skip("not an InstanceDescriber")
+		}
+
+		for _, id := range []string{f.RunningID, f.StoppedID} {
+			_, err := describer.DescribeInstance(id)
+			expectError(t, "describe", err, nil)
+		}
+		_, err := describer.DescribeInstance(f.UnknownID)
+		expectError(t, "describe an unknown instance", err, instances.ErrNotFound)
+	})
+
+	t.Run("CPUUtilization", func(t *testing.T) {
+		f := factory(t)
+		metricsProvider, ok := f.Provider.(instances.MetricsProvider)
+		if !ok {
+			t.Skip("not a MetricsProvider")
+		}
+
+		end := time.Now()
+		start := end.Add(-time.Hour)
+		samples, err := metricsProvider.GetCPUUtilization(f.RunningID, start, end)
+		expectError(t, "get CPU utilization", err, nil)
+		for _, sample := range samples {
+			if sample.Time.Before(start) || sample.Time.After(end) {
+				t.Errorf("sample %+v out of the requested period", sample)
+			}
+			if sample.Value < 0 || sample.Value > 100 {
+				t.Errorf("sample %+v not a percentage", sample)
+			}
+		}
+	})
+
+	t.Run("WithContext", func(t *testing.T) {
+		f := factory(t)
+		binder, ok := f.Provider.(instances.ContextBinder)
+		if !ok {
+			t.Skip("not a ContextBinder")
+		}
+
+		bound := binder.WithContext(context.Background())
+		if bound.GetName() != f.Provider.GetName() {
+			t.Errorf("got name %q once bound, want %q", bound.GetName(), f.Provider.GetName())
+		}
+		state, err := bound.GetInstanceStatus(f.RunningID)
+		if err != nil || state != instances.InstanceStateRunning {
+			t.Errorf("got state %q (error: %v) once bound, want %q", state, err, instances.InstanceStateRunning)
+		}
+	})
+}
+
+// expectError checks that the error of an operation matches want (nil for
+// no error). The test is skipped if the operation is unsupported, as wrappers
+// of cloud providers implement the optional capabilities whether the
+// providers they wrap do or not.
+func expectError(t *testing.T, operation string, err, want error) {
+	t.Helper()
+	if errors.Is(err, instances.ErrUnsupported) {
+		t.Skipf("%s: %v", operation, err)
+	}
+	if want == nil && err != nil {
+		t.Fatalf("%s: unexpected error: %v", operation, err)
+	}
+	if want != nil && !errors.Is(err, want) {
+		t.Fatalf("%s: got error %v, want %v", operation, err, want)
+	}
+}
+
+// expectChange checks that a state change is from the state previous to one
+// of the states current.
+func expectChange(t *testing.T, change instances.StateChange, previous instances.InstanceState, current ...instances.InstanceState) {
+	t.Helper()
+	if change.Previous != previous || !slices.Contains(current, change.Current) {
+		t.Fatalf("got change %+v, want from %q to %q", change, previous, current)
+	}
+}
+
+// expectState checks that an instance is in the given state.
+func expectState(t *testing.T, f Fixture, id string, want instances.InstanceState) {
+	t.Helper()
+	state, err := f.Provider.GetInstanceStatus(id)
+	if err != nil {
+		t.Fatalf("status of %q: %v", id, err)
+	}
+	if state != want {
+		t.Fatalf("got state %q for %q, want %q", state, id, want)
+	}
+}
+
+// waitForState waits for an instance to be in the state want, only going
+// through the given intermediate states.
+func waitForState(t *testing.T, f Fixture, id string, want instances.InstanceState, intermediate ...instances.InstanceState) {
+	t.Helper()
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := f.Provider.GetInstanceStatus(id)
+		if err != nil {
+			t.Fatalf("status of %q: %v", id, err)
+		}
+		if state == want {
+			return
+		}
+		if !slices.Contains(intermediate, state) {
+			t.Fatalf("got state %q for %q, want %q or %q", state, id, want, intermediate)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instance %q still %q after %s, want %q", id, state, timeout, want)
+		}
+
+		if f.Settle != nil {
+			f.Settle()
+		}
+		time.Sleep(pollInterval)
+	}
+}
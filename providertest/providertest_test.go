@@ -0,0 +1,89 @@
+package providertest_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+	"github.com/nonatomiclabs/instances/providertest"
+)
+
+// clock is a fake clock, advanced by the fixtures to make the instances
+// transition.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newFakeCloud returns a fake cloud with a running and a stopped instance,
+// whose transitions take a minute of its clock.
+func newFakeCloud(name string) (*fakecloud.Cloud, *clock) {
+	c := &clock{now: time.Now()}
+	cloud := fakecloud.New(fakecloud.WithName(name), fakecloud.WithClock(c.Now), fakecloud.WithTransitionDelay(time.Minute))
+	cloud.AddInstance("i-running", instances.InstanceStateRunning, instances.InstanceDetails{Type: "t3.micro"})
+	cloud.AddInstance("i-stopped", instances.InstanceStateStopped, instances.InstanceDetails{Type: "t3.micro"})
+	cloud.SetCPUUtilization("i-running", []instances.MetricSample{
+		{Time: c.now.Add(-30 * time.Minute), Value: 12},
+		{Time: c.now.Add(-2 * time.Hour), Value: 80},
+	})
+	return cloud, c
+}
+
+// fixture returns the fixture of provider, over a fake cloud advanced by c.
+func fixture(provider instances.CloudProvider, c *clock) providertest.Fixture {
+	return providertest.Fixture{
+		Provider:  provider,
+		RunningID: "i-running",
+		StoppedID: "i-stopped",
+		UnknownID: "i-unknown",
+		Settle:    func() { c.Advance(20 * time.Second) },
+	}
+}
+
+// newAWSCloud returns an AWSCloud over a fake cloud.
+func newAWSCloud() (instances.AWSCloud, *clock) {
+	cloud, c := newFakeCloud("aws")
+	return instances.AWSCloud{Ec2Client: cloud.EC2(), CloudWatchClient: cloud.CloudWatch(), Region: "eu-west-3"}, c
+}
+
+func TestFakeCloudConformance(t *testing.T) {
+	providertest.RunConformance(t, func(t *testing.T) providertest.Fixture {
+		cloud, c := newFakeCloud("fake")
+		return fixture(cloud, c)
+	})
+}
+
+func TestAWSCloudConformance(t *testing.T) {
+	providertest.RunConformance(t, func(t *testing.T) providertest.Fixture {
+		provider, c := newAWSCloud()
+		return fixture(provider, c)
+	})
+}
+
+func TestRetryingCloudProviderConformance(t *testing.T) {
+	providertest.RunConformance(t, func(t *testing.T) providertest.Fixture {
+		provider, c := newAWSCloud()
+		return fixture(instances.NewRetryingCloudProvider(provider, instances.DefaultRetryPolicy), c)
+	})
+}
+
+func TestCachingCloudProviderConformance(t *testing.T) {
+	providertest.RunConformance(t, func(t *testing.T) providertest.Fixture {
+		provider, c := newAWSCloud()
+		return fixture(instances.NewCachingCloudProvider(provider, instances.NewMemoryStatusCache(), 10*time.Second, c.Now), c)
+	})
+}
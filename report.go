@@ -0,0 +1,139 @@
+package instances
+
+import (
+	"sort"
+	"time"
+)
+
+// RunningTime returns how long an instance ran between from and to,
+// according to its recorded state transitions and successful start and stop
+// actions.
+func (d *Database) RunningTime(name string, from, to time.Time) time.Duration {
+	type event struct {
+		time    time.Time
+		running bool
+	}
+
+	var events []event
+	for _, record := range d.Transitions {
+		if record.Instance == name {
+			events = append(events, event{record.Time, record.State == InstanceStateRunning})
+		}
+	}
+	for _, action := range d.Actions {
+		if action.Instance != name || action.Error != "" || action.Skipped != "" {
+			continue
+		}
+		switch action.Action {
+		case ActionStart:
+			events = append(events, event{action.Time, true})
+		case ActionStop:
+			events = append(events, event{action.Time, false})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time.Before(events[j].time)
+	})
+
+	var total time.Duration
+	var running bool
+	runningSince := from
+	for _, e := range events {
+		if !e.time.After(from) {
+			running = e.running
+			continue
+		}
+		if e.time.After(to) {
+			break
+		}
+		if running && !e.running {
+			total += e.time.Sub(runningSince)
+		} else if !running && e.running {
+			runningSince = e.time
+		}
+		running = e.running
+	}
+	if running {
+		total += to.Sub(runningSince)
+	}
+
+	return total
+}
+
+// ReportLine holds the running time and estimated cost of an instance, or
+// of a set of instances.
+type ReportLine struct {
+	Name    string
+	Running time.Duration
+	Cost    float64
+	// CostKnown is false when the price of at least one of the instances is
+	// unknown, in which case Cost is only a lower bound.
+	CostKnown bool
+}
+
+func (l *ReportLine) add(other ReportLine) {
+	l.Running += other.Running
+	l.Cost += other.Cost
+	l.CostKnown = l.CostKnown && other.CostKnown
+}
+
+// Report holds the running time and estimated cost of instances over a
+// period, by instance, group and cloud provider.
+type Report struct {
+	From, To       time.Time
+	Instances      []ReportLine
+	Groups         []ReportLine
+	CloudProviders []ReportLine
+}
+
+// addToTotal adds a line to the total named key.
+func addToTotal(totals map[string]*ReportLine, key string, line ReportLine) {
+	if totals[key] == nil {
+		totals[key] = &ReportLine{Name: key, CostKnown: true}
+	}
+	totals[key].add(line)
+}
+
+// NewReport computes the report of the instances of the given group (or all
+// of them if group is empty) between from and to. Prices can be nil.
+func NewReport(db *Database, from, to time.Time, prices PriceTable, group string) Report {
+	report := Report{From: from, To: to}
+	groups := map[string]*ReportLine{}
+	cloudProviders := map[string]*ReportLine{}
+
+	for _, name := range sortedKeys(db.Instances) {
+		instance := db.Instances[name]
+		if group != "" && instance.Group != group {
+			continue
+		}
+
+		line := ReportLine{Name: name, Running: db.RunningTime(name, from, to)}
+		if prices != nil {
+			if price, ok := prices.HourlyPrice(instance.Type, instance.Region); ok {
+				line.Cost = price * line.Running.Hours()
+				line.CostKnown = true
+			}
+		}
+		// Instances that didn't run cost nothing, whatever their price.
+		if line.Running == 0 {
+			line.CostKnown = true
+		}
+		report.Instances = append(report.Instances, line)
+
+		groupName := instance.Group
+		if groupName == "" {
+			groupName = "(none)"
+		}
+		addToTotal(groups, groupName, line)
+		addToTotal(cloudProviders, instance.CloudProviderName, line)
+	}
+
+	for _, name := range sortedKeys(groups) {
+		report.Groups = append(report.Groups, *groups[name])
+	}
+	for _, name := range sortedKeys(cloudProviders) {
+		report.CloudProviders = append(report.CloudProviders, *cloudProviders[name])
+	}
+
+	return report
+}
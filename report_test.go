@@ -0,0 +1,185 @@
+package instances_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func TestRunningTime(t *testing.T) {
+	t.Parallel()
+	from := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	at := func(hours int) time.Time {
+		return from.Add(time.Duration(hours) * time.Hour)
+	}
+
+	tests := map[string]struct {
+		transitions []instances.StateRecord
+		actions     []instances.Action
+		want        time.Duration
+	}{
+		"no history": {
+			want: 0,
+		},
+		"running before the period": {
+			transitions: []instances.StateRecord{
+				{Time: at(-5), Instance: "a", State: instances.InstanceStateRunning},
+			},
+			want: 24 * time.Hour,
+		},
+		"observed transitions": {
+			transitions: []instances.StateRecord{
+				{Time: at(2), Instance: "a", State: instances.InstanceStateRunning},
+				{Time: at(5), Instance: "a", State: instances.InstanceStateStopping},
+				{Time: at(6), Instance: "a", State: instances.InstanceStateStopped},
+				{Time: at(10), Instance: "a", State: instances.InstanceStateRunning},
+				{Time: at(2), Instance: "b", State: instances.InstanceStateRunning},
+			},
+			want: 3*time.Hour + 14*time.Hour,
+		},
+		"actions": {
+			actions: []instances.Action{
+				{Time: at(8), Instance: "a", Action: instances.ActionStart},
+				{Time: at(19), Instance: "a", Action: instances.ActionStop},
+				{Time: at(20), Instance: "a", Action: instances.ActionStart, Error: "failed"},
+				{Time: at(21), Instance: "a", Action: instances.ActionStart, Skipped: "instance running"},
+			},
+			want: 11 * time.Hour,
+		},
+		"history after the period": {
+			transitions: []instances.StateRecord{
+				{Time: at(30), Instance: "a", State: instances.InstanceStateRunning},
+			},
+			want: 0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+			db.Transitions = test.transitions
+			db.Actions = test.actions
+
+			if got := db.RunningTime("a", from, to); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	t.Parallel()
+	from := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	db.Instances = map[string]instances.Instance{
+		"a": {Id: "1", CloudProviderName: "aws", Group: "dev", Type: "t3.micro", Region: "us-east-1"},
+		"b": {Id: "2", CloudProviderName: "aws", Group: "dev", Type: "t3.large", Region: "eu-west-3"},
+		"c": {Id: "3", CloudProviderName: "mock", Type: "unknown"},
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		db.ObserveState(instances.StateRecord{Time: from, Instance: name, State: instances.InstanceStateRunning})
+	}
+
+	prices, err := instances.LoadPriceTable(strings.NewReader(`{"us-east-1": {"t3.micro": 0.01}, "*": {"t3.large": 0.1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := instances.NewReport(db, from, to, prices, "")
+
+	want := []instances.ReportLine{
+		{Name: "a", Running: 10 * time.Hour, Cost: 0.1, CostKnown: true},
+		{Name: "b", Running: 10 * time.Hour, Cost: 1, CostKnown: true},
+		{Name: "c", Running: 10 * time.Hour, Cost: 0, CostKnown: false},
+	}
+	assertReportLines(t, report.Instances, want)
+	assertReportLines(t, report.Groups, []instances.ReportLine{
+		{Name: "(none)", Running: 10 * time.Hour, Cost: 0, CostKnown: false},
+		{Name: "dev", Running: 20 * time.Hour, Cost: 1.1, CostKnown: true},
+	})
+	assertReportLines(t, report.CloudProviders, []instances.ReportLine{
+		{Name: "aws", Running: 20 * time.Hour, Cost: 1.1, CostKnown: true},
+		{Name: "mock", Running: 10 * time.Hour, Cost: 0, CostKnown: false},
+	})
+
+	report = instances.NewReport(db, from, to, prices, "dev")
+	assertReportLines(t, report.Instances, want[:2])
+}
+
+func TestNewReportGroupNamedAsProvider(t *testing.T) {
+	t.Parallel()
+	from := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	db.Instances = map[string]instances.Instance{
+		"a": {Id: "1", CloudProviderName: "aws", Group: "aws"},
+	}
+	db.ObserveState(instances.StateRecord{Time: from, Instance: "a", State: instances.InstanceStateRunning})
+
+	report := instances.NewReport(db, from, to, nil, "")
+
+	want := []instances.ReportLine{{Name: "aws", Running: 10 * time.Hour, CostKnown: false}}
+	assertReportLines(t, report.Groups, want)
+	assertReportLines(t, report.CloudProviders, want)
+}
+
+func assertReportLines(t *testing.T, got, want []instances.ReportLine) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range got {
+		costDiff := got[i].Cost - want[i].Cost
+		if got[i].Name != want[i].Name || got[i].Running != want[i].Running ||
+			got[i].CostKnown != want[i].CostKnown || costDiff > 1e-9 || costDiff < -1e-9 {
+			t.Fatalf("line %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPoller(t *testing.T) {
+	t.Parallel()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+
+	provider := fakecloud.New(fakecloud.WithName("mock"))
+	provider.AddInstance("id1", instances.InstanceStateStopped, instances.InstanceDetails{})
+	if err := db.AddInstance("id1", "a", provider); err != nil {
+		t.Fatal(err)
+	}
+	poller := instances.NewPoller(db, map[string]instances.CloudProvider{"mock": provider})
+
+	now := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	if transitions := poller.Run(now); len(transitions) != 1 {
+		t.Fatalf("unexpected transitions on first poll: %v", transitions)
+	}
+	if transitions := poller.Run(now.Add(time.Minute)); len(transitions) != 0 {
+		t.Fatalf("unexpected transitions without state change: %v", transitions)
+	}
+
+	if err := provider.SetState("id1", instances.InstanceStateRunning); err != nil {
+		t.Fatal(err)
+	}
+	transitions := poller.Run(now.Add(2 * time.Minute))
+	if len(transitions) != 1 || transitions[0].State != instances.InstanceStateRunning {
+		t.Fatalf("unexpected transitions after state change: %v", transitions)
+	}
+}
@@ -0,0 +1,238 @@
+package instances
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy is how the failed calls to a cloud provider are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a call, 1 not to
+	// retry them.
+	MaxAttempts int
+	// BaseDelay is the maximum delay before the first retry, which doubles
+	// with each retry up to MaxDelay. The actual delay is picked at random
+	// below it, so that clients throttled together don't retry together.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of the cloud providers not
+// configured otherwise.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, BaseDelay: 250 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+// delay returns the delay before the retry following the given attempt,
+// counted from 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if attempt < 32 {
+		if d := p.BaseDelay << (attempt - 1); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// RetryClassifier is implemented by cloud providers able to tell the errors
+// worth retrying, like throttling errors, from the others.
+type RetryClassifier interface {
+	IsRetryable(err error) bool
+}
+
+// RetryingCloudProvider is a cloud provider retrying the failed calls of
+// another one, when they are retryable according to its classifier.
+type RetryingCloudProvider struct {
+	provider    CloudProvider
+	policy      RetryPolicy
+	isRetryable func(error) bool
+	logger      *slog.Logger
+	ctx         context.Context
+}
+
+// RetryOption configures optional behavior of a RetryingCloudProvider.
+type RetryOption func(*RetryingCloudProvider)
+
+// WithRetryClassifier sets the function telling whether an error is worth
+// retrying. By default, the cloud provider classifies its errors if it is a
+// RetryClassifier, else only the network errors are retried.
+func WithRetryClassifier(isRetryable func(error) bool) RetryOption {
+	return func(r *RetryingCloudProvider) {
+		r.isRetryable = isRetryable
+	}
+}
+
+// WithRetryLogger sets the logger of the retries. By default, they aren't
+// logged.
+func WithRetryLogger(logger *slog.Logger) RetryOption {
+	return func(r *RetryingCloudProvider) {
+		r.logger = logger
+	}
+}
+
+// NewRetryingCloudProvider returns provider with its failed calls retried
+// according to policy.
+func NewRetryingCloudProvider(provider CloudProvider, policy RetryPolicy, opts ...RetryOption) *RetryingCloudProvider {
+	r := &RetryingCloudProvider{provider: provider, policy: policy, logger: discardLogger}
+	if classifier, ok := provider.(RetryClassifier); ok {
+		r.isRetryable = classifier.IsRetryable
+	} else {
+		r.isRetryable = isNetworkError
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// isNetworkError tells whether err is a network timeout or a dropped
+// connection.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Unwrap returns the cloud provider whose calls are retried.
+func (r *RetryingCloudProvider) Unwrap() CloudProvider {
+	return r.provider
+}
+
+// retry calls call until it succeeds, fails with an error not worth retrying
+// or the attempts are exhausted, and returns its last error.
+func (r *RetryingCloudProvider) retry(operation, id string, call func() error) error {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= r.policy.MaxAttempts || !r.isRetryable(err) {
+			return err
+		}
+
+		delay := r.policy.delay(attempt)
+		r.logger.Info("retrying call", "provider", r.provider.GetName(), "operation", operation, "id", id,
+			"attempt", attempt, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (r *RetryingCloudProvider) StartInstance(id string) error {
+	return r.retry("StartInstance", id, func() error {
+		return r.provider.StartInstance(id)
+	})
+}
+
+func (r *RetryingCloudProvider) StopInstance(id string) error {
+	return r.retry("StopInstance", id, func() error {
+		return r.provider.StopInstance(id)
+	})
+}
+
+func (r *RetryingCloudProvider) StartInstanceChange(id string) (StateChange, error) {
+	changer, ok := r.provider.(StateChanger)
+	if !ok {
+		return StateChange{}, Errorf(ErrUnsupported, "cloud provider %q doesn't return state changes", r.provider.GetName())
+	}
+	var change StateChange
+	err := r.retry("StartInstance", id, func() error {
+		var err error
+		change, err = changer.StartInstanceChange(id)
+		return err
+	})
+	return change, err
+}
+
+func (r *RetryingCloudProvider) StopInstanceChange(id string) (StateChange, error) {
+	changer, ok := r.provider.(StateChanger)
+	if !ok {
+		return StateChange{}, Errorf(ErrUnsupported, "cloud provider %q doesn't return state changes", r.provider.GetName())
+	}
+	var change StateChange
+	err := r.retry("StopInstance", id, func() error {
+		var err error
+		change, err = changer.StopInstanceChange(id)
+		return err
+	})
+	return change, err
+}
+
+func (r *RetryingCloudProvider) GetInstanceStatus(id string) (InstanceState, error) {
+	var state InstanceState
+	err := r.retry("GetInstanceStatus", id, func() error {
+		var err error
+		state, err = r.provider.GetInstanceStatus(id)
+		return err
+	})
+	return state, err
+}
+
+func (r *RetryingCloudProvider) GetName() string {
+	return r.provider.GetName()
+}
+
+func (r *RetryingCloudProvider) RebootInstance(id string) error {
+	rebooter, ok := r.provider.(Rebooter)
+	if !ok {
+		return Errorf(ErrUnsupported, "cloud provider %q can't reboot instances", r.provider.GetName())
+	}
+	return r.retry("RebootInstance", id, func() error {
+		return rebooter.RebootInstance(id)
+	})
+}
+
+func (r *RetryingCloudProvider) GetCPUUtilization(id string, start, end time.Time) ([]MetricSample, error) {
+	metricsProvider, ok := r.provider.(MetricsProvider)
+	if !ok {
+		return nil, Errorf(ErrUnsupported, "cloud provider %q doesn't report utilization", r.provider.GetName())
+	}
+	var samples []MetricSample
+	err := r.retry("GetCPUUtilization", id, func() error {
+		var err error
+		samples, err = metricsProvider.GetCPUUtilization(id, start, end)
+		return err
+	})
+	return samples, err
+}
+
+func (r *RetryingCloudProvider) DescribeInstance(id string) (InstanceDetails, error) {
+	describer, ok := r.provider.(InstanceDescriber)
+	if !ok {
+		return InstanceDetails{}, Errorf(ErrUnsupported, "cloud provider %q can't describe instances", r.provider.GetName())
+	}
+	var details InstanceDetails
+	err := r.retry("DescribeInstance", id, func() error {
+		var err error
+		details, err = describer.DescribeInstance(id)
+		return err
+	})
+	return details, err
+}
+
+// WithContext returns a copy of the provider making its calls, and waiting
+// before retrying them, in ctx.
+func (r *RetryingCloudProvider) WithContext(ctx context.Context) CloudProvider {
+	bound := *r
+	bound.ctx = ctx
+	if binder, ok := r.provider.(ContextBinder); ok {
+		bound.provider = binder.WithContext(ctx)
+	}
+	return &bound
+}
@@ -0,0 +1,195 @@
+package instances_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+var (
+	errThrottled = errors.New("throttled")
+	errDenied    = errors.New("access denied")
+)
+
+// flakyCloudProvider is a fake cloud classifying errThrottled as retryable,
+// which fakecloud doesn't do as it doesn't classify its errors.
+type flakyCloudProvider struct {
+	*fakecloud.Cloud
+}
+
+// newFlakyCloudProvider returns a flaky cloud provider whose first calls to
+// start its stopped instance i-1234 fail with err.
+func newFlakyCloudProvider(failures int, err error) flakyCloudProvider {
+	cloud := fakecloud.New()
+	cloud.AddInstance("i-1234", instances.InstanceStateStopped, instances.InstanceDetails{})
+	if failures > 0 {
+		cloud.InjectFailure(fakecloud.Failure{Method: "StartInstance", Err: err, Times: failures})
+	}
+	return flakyCloudProvider{cloud}
+}
+
+func (f flakyCloudProvider) IsRetryable(err error) bool {
+	return errors.Is(err, errThrottled)
+}
+
+// unclassifiedCloudProvider is a flaky cloud provider which doesn't classify
+// its errors.
+type unclassifiedCloudProvider struct {
+	instances.CloudProvider
+}
+
+var retryTestPolicy = instances.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+func TestRetryingCloudProvider(t *testing.T) {
+	tests := map[string]struct {
+		failures     int
+		err          error
+		unclassified bool
+		opts         []instances.RetryOption
+		wantCalls    int
+		wantErr      string
+	}{
+		"success": {
+			wantCalls: 1,
+		},
+		"retryable error": {
+			failures:  2,
+			err:       errThrottled,
+			wantCalls: 3,
+		},
+		"attempts exhausted": {
+			failures:  3,
+			err:       errThrottled,
+			wantCalls: 3,
+			wantErr:   "throttled",
+		},
+		"error not retryable": {
+			failures:  1,
+			err:       errDenied,
+			wantCalls: 1,
+			wantErr:   "access denied",
+		},
+		"custom classifier": {
+			failures:  1,
+			err:       errDenied,
+			opts:      []instances.RetryOption{instances.WithRetryClassifier(func(err error) bool { return true })},
+			wantCalls: 2,
+		},
+		"network error of a provider without classifier": {
+			failures:     1,
+			err:          &net.OpError{Op: "dial", Err: timeoutError{}},
+			unclassified: true,
+			wantCalls:    2,
+		},
+		"other error of a provider without classifier": {
+			failures:     1,
+			err:          errThrottled,
+			unclassified: true,
+			wantCalls:    1,
+			wantErr:      "throttled",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			flaky := newFlakyCloudProvider(tc.failures, tc.err)
+			var provider instances.CloudProvider = flaky
+			if tc.unclassified {
+				provider = unclassifiedCloudProvider{flaky}
+			}
+
+			err := instances.NewRetryingCloudProvider(provider, retryTestPolicy, tc.opts...).StartInstance("i-1234")
+			if !errorContains(err, tc.wantErr) {
+				t.Errorf("got error %v, want %q", err, tc.wantErr)
+			}
+			if calls := flaky.CallCount("StartInstance"); calls != tc.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryingCloudProviderContext(t *testing.T) {
+	t.Parallel()
+
+	flaky := newFlakyCloudProvider(10, errThrottled)
+	policy := instances.RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	provider := instances.NewRetryingCloudProvider(flaky, policy).WithContext(ctx)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := provider.StartInstance("i-1234"); !errors.Is(err, errThrottled) {
+		t.Errorf("got error %v, want %v", err, errThrottled)
+	}
+	if calls := flaky.CallCount("StartInstance"); calls > 2 {
+		t.Errorf("got %d calls after the context was canceled", calls)
+	}
+}
+
+func TestRetryingCloudProviderCapabilities(t *testing.T) {
+	t.Parallel()
+
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+	cloudProviders := map[string]instances.CloudProvider{
+		"mock": instances.NewRetryingCloudProvider(legacyCloudProvider{newTestCloud()}, retryTestPolicy),
+	}
+	manager := instances.NewManager(db, cloudProviders, time.Now)
+
+	_, err = manager.RebootInstance(existingInstanceName, "test")
+	if !errors.Is(err, instances.ErrUnsupported) {
+		t.Errorf("got error %v, want %v", err, instances.ErrUnsupported)
+	}
+	if actions := db.Actions; len(actions) != 0 {
+		t.Errorf("unsupported reboot recorded as %+v", actions)
+	}
+}
+
+func TestAWSIsRetryable(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want bool
+	}{
+		"throttled": {
+			err:  &smithy.GenericAPIError{Code: "RequestLimitExceeded"},
+			want: true,
+		},
+		"internal error": {
+			err:  &smithy.GenericAPIError{Code: "InternalError"},
+			want: true,
+		},
+		"not found": {
+			err:  &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound"},
+			want: false,
+		},
+		"invalid state": {
+			err:  errors.New("instance not running"),
+			want: false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if got := (instances.AWSCloud{}).IsRetryable(tc.err); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
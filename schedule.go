@@ -0,0 +1,151 @@
+package instances
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Schedule starts and stops an instance, or every instance of a group, at
+// the times described by cron expressions evaluated in a time zone.
+type Schedule struct {
+	Instance string `json:"instance,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Start    string `json:"start,omitempty"`
+	Stop     string `json:"stop,omitempty"`
+	TimeZone string `json:"time-zone,omitempty"`
+	// AllowProtected makes the schedule apply to the protected instances,
+	// which are skipped otherwise.
+	AllowProtected bool `json:"allow-protected,omitempty"`
+}
+
+// Validate checks that the schedule has exactly one target, at least one
+// valid cron expression and a known time zone.
+func (s Schedule) Validate() error {
+	if (s.Instance == "") == (s.Group == "") {
+		return errors.New("schedule must target either an instance or a group")
+	}
+	if s.Start == "" && s.Stop == "" {
+		return errors.New("schedule must have a start or a stop expression")
+	}
+	if s.Start != "" {
+		if _, err := ParseCron(s.Start); err != nil {
+			return err
+		}
+	}
+	if s.Stop != "" {
+		if _, err := ParseCron(s.Stop); err != nil {
+			return err
+		}
+	}
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone %q: %v", s.TimeZone, err)
+	}
+	return nil
+}
+
+// Targets returns the names of the instances targeted by the schedule.
+func (s Schedule) Targets(instances map[string]Instance) []string {
+	if s.Instance != "" {
+		if _, exists := instances[s.Instance]; exists {
+			return []string{s.Instance}
+		}
+		return nil
+	}
+
+	var names []string
+	for name, instance := range instances {
+		if instance.Group == s.Group {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Due returns the action the schedule requests in the window (from, to], if
+// any. When both the start and stop expressions fire in the window, the
+// latest one wins.
+func (s Schedule) Due(from, to time.Time) (ActionType, bool) {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return "", false
+	}
+
+	var start, stop CronExpr
+	hasStart, hasStop := s.Start != "", s.Stop != ""
+	if hasStart {
+		if start, err = ParseCron(s.Start); err != nil {
+			return "", false
+		}
+	}
+	if hasStop {
+		if stop, err = ParseCron(s.Stop); err != nil {
+			return "", false
+		}
+	}
+
+	var action ActionType
+	minute := from.Truncate(time.Minute).Add(time.Minute)
+	for ; !minute.After(to); minute = minute.Add(time.Minute) {
+		local := minute.In(loc)
+		if hasStart && start.Matches(local) {
+			action = ActionStart
+		}
+		if hasStop && stop.Matches(local) {
+			action = ActionStop
+		}
+	}
+
+	return action, action != ""
+}
+
+// Override suspends automated actions on an instance until a given time, or
+// until it is cleared when Until is zero.
+type Override struct {
+	Until time.Time `json:"until,omitempty"`
+}
+
+// Active reports whether the override is in effect at the given time.
+func (o *Override) Active(now time.Time) bool {
+	if o == nil {
+		return false
+	}
+	return o.Until.IsZero() || now.Before(o.Until)
+}
+
+type ActionType string
+
+const (
+	ActionStart  ActionType = "start"
+	ActionStop   ActionType = "stop"
+	ActionReboot ActionType = "reboot"
+	ActionWarn   ActionType = "warn"
+	// ActionCheck is a failed check of an instance, like of its CPU
+	// utilization, after which nothing was done.
+	ActionCheck ActionType = "check"
+)
+
+// Action records an action performed on an instance by an automated source.
+type Action struct {
+	Time     time.Time  `json:"time"`
+	Instance string     `json:"instance"`
+	Action   ActionType `json:"action"`
+	Source   string     `json:"source"`
+	Message  string     `json:"message,omitempty"`
+	Skipped  string     `json:"skipped,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+func (a Action) String() string {
+	s := fmt.Sprintf("%s %s %s (%s)", a.Time.Format(time.RFC3339), a.Action, a.Instance, a.Source)
+	if a.Message != "" {
+		s += ": " + a.Message
+	}
+	if a.Skipped != "" {
+		s += ": skipped, " + a.Skipped
+	}
+	if a.Error != "" {
+		s += ": " + a.Error
+	}
+	return s
+}
@@ -0,0 +1,111 @@
+package instances
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Scheduler evaluates the schedules stored in a Database and starts or stops
+// the instances they target.
+type Scheduler struct {
+	db             *Database
+	cloudProviders map[string]CloudProvider
+	lastRun        time.Time
+}
+
+func NewScheduler(db *Database, cloudProviders map[string]CloudProvider) *Scheduler {
+	return &Scheduler{db: db, cloudProviders: cloudProviders}
+}
+
+// Run evaluates the schedules for the window elapsed since the previous run
+// (or the last minute on the first run), performs the due actions, records
+// them in the database and returns them.
+func (s *Scheduler) Run(now time.Time) []Action {
+	from := s.lastRun
+	if from.IsZero() {
+		from = now.Add(-time.Minute)
+	}
+	s.lastRun = now
+
+	// Resolve every schedule first so that an instance targeted by several
+	// schedules only gets the action of the last one, in name order.
+	due := map[string]ActionType{}
+	sources := map[string]string{}
+	allowProtected := map[string]bool{}
+	for _, scheduleName := range sortedKeys(s.db.Schedules) {
+		schedule := s.db.Schedules[scheduleName]
+		action, ok := schedule.Due(from, now)
+		if !ok {
+			continue
+		}
+		for _, instanceName := range schedule.Targets(s.db.Instances) {
+			due[instanceName] = action
+			sources[instanceName] = "schedule " + scheduleName
+			allowProtected[instanceName] = schedule.AllowProtected
+		}
+	}
+
+	var actions []Action
+	for _, instanceName := range sortedKeys(due) {
+		action := s.apply(instanceName, due[instanceName], sources[instanceName], allowProtected[instanceName], now)
+		s.db.RecordAction(action)
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+func (s *Scheduler) apply(name string, action ActionType, source string, allowProtected bool, now time.Time) Action {
+	record := Action{Time: now, Instance: name, Action: action, Source: source}
+
+	instance := s.db.Instances[name]
+	if instance.Override.Active(now) {
+		record.Skipped = "manual override"
+		return record
+	}
+	if !allowProtected && s.db.IsProtected(name) {
+		record.Skipped = "instance protected"
+		return record
+	}
+
+	cloudProvider, err := instance.GetCloudProvider(s.cloudProviders)
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+
+	state, err := cloudProvider.GetInstanceStatus(instance.Id)
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+
+	switch action {
+	case ActionStart:
+		if state == InstanceStateRunning || state == InstanceStatePending {
+			record.Skipped = fmt.Sprintf("instance %s", state)
+			return record
+		}
+		err = cloudProvider.StartInstance(instance.Id)
+	case ActionStop:
+		if state != InstanceStateRunning {
+			record.Skipped = fmt.Sprintf("instance %s", state)
+			return record
+		}
+		err = cloudProvider.StopInstance(instance.Id)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	return record
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
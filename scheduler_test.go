@@ -0,0 +1,200 @@
+package instances_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+// stateCalls returns the calls changing the state of the instances made to
+// cloud, like "stop id1".
+func stateCalls(cloud *fakecloud.Cloud) []string {
+	verbs := map[string]string{"StartInstance": "start", "StopInstance": "stop", "RebootInstance": "reboot"}
+	var calls []string
+	for _, call := range cloud.Calls() {
+		if verb, changes := verbs[call.Method]; changes {
+			calls = append(calls, verb+" "+call.ID)
+		}
+	}
+	return calls
+}
+
+func TestScheduler(t *testing.T) {
+	t.Parallel()
+	// 2023-04-10 is a Monday.
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2023, 4, 10, hour, minute, 0, 0, paris)
+	}
+
+	tests := map[string]struct {
+		now      time.Time
+		override *instances.Override
+		// protected protects the instance a, which the schedule applies to
+		// if allowProtected is set.
+		protected      bool
+		allowProtected bool
+		initial        instances.InstanceState
+		wantCalls      []string
+		wantSkip       string
+	}{
+		"start due": {
+			now:       monday(8, 0),
+			initial:   instances.InstanceStateStopped,
+			wantCalls: []string{"start id1", "start id2"},
+		},
+		"stop due": {
+			now:       monday(19, 0),
+			initial:   instances.InstanceStateRunning,
+			wantCalls: []string{"stop id1", "stop id2"},
+		},
+		"nothing due": {
+			now:     monday(12, 0),
+			initial: instances.InstanceStateStopped,
+		},
+		"already running": {
+			now:      monday(8, 0),
+			initial:  instances.InstanceStateRunning,
+			wantSkip: "instance running",
+		},
+		"manual override": {
+			now:       monday(8, 0),
+			initial:   instances.InstanceStateStopped,
+			override:  &instances.Override{},
+			wantCalls: []string{"start id2"},
+			wantSkip:  "manual override",
+		},
+		"expired override": {
+			now:       monday(8, 0),
+			initial:   instances.InstanceStateStopped,
+			override:  &instances.Override{Until: monday(7, 0)},
+			wantCalls: []string{"start id1", "start id2"},
+		},
+		"protected instance": {
+			now:       monday(19, 0),
+			initial:   instances.InstanceStateRunning,
+			protected: true,
+			wantCalls: []string{"stop id2"},
+			wantSkip:  "instance protected",
+		},
+		"protected instance allowed": {
+			now:            monday(19, 0),
+			initial:        instances.InstanceStateRunning,
+			protected:      true,
+			allowProtected: true,
+			wantCalls:      []string{"stop id1", "stop id2"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+
+			provider := fakecloud.New(fakecloud.WithName("mock"))
+			provider.AddInstance("id1", test.initial, instances.InstanceDetails{})
+			provider.AddInstance("id2", test.initial, instances.InstanceDetails{})
+			for name, id := range map[string]string{"a": "id1", "b": "id2"} {
+				if err := db.AddInstance(id, name, provider); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.UpdateInstance(name, func(i *instances.Instance) { i.Group = "dev" }); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SetOverride("a", test.override); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetProtected("a", test.protected); err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.AddSchedule("office-hours", instances.Schedule{
+				Group:          "dev",
+				Start:          "0 8 * * 1-5",
+				Stop:           "0 19 * * 1-5",
+				TimeZone:       "Europe/Paris",
+				AllowProtected: test.allowProtected,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			scheduler := instances.NewScheduler(db, map[string]instances.CloudProvider{"mock": provider})
+			actions := scheduler.Run(test.now)
+
+			if calls := stateCalls(provider); fmt.Sprint(calls) != fmt.Sprint(test.wantCalls) {
+				t.Fatalf("unexpected calls: got %v, want %v", calls, test.wantCalls)
+			}
+
+			if len(db.Actions) != len(actions) {
+				t.Fatalf("actions not recorded: got %d, want %d", len(db.Actions), len(actions))
+			}
+
+			if test.wantSkip != "" && (len(actions) == 0 || actions[0].Skipped != test.wantSkip) {
+				t.Fatalf("unexpected actions: %v", actions)
+			}
+		})
+	}
+}
+
+func TestAddSchedule(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		schedule instances.Schedule
+		wantErr  string
+	}{
+		"valid instance schedule": {
+			schedule: instances.Schedule{Instance: existingInstanceName, Stop: "0 19 * * *"},
+		},
+		"valid group schedule": {
+			schedule: instances.Schedule{Group: "dev", Start: "0 8 * * 1-5", TimeZone: "UTC"},
+		},
+		"no target": {
+			schedule: instances.Schedule{Start: "0 8 * * *"},
+			wantErr:  "either an instance or a group",
+		},
+		"two targets": {
+			schedule: instances.Schedule{Instance: existingInstanceName, Group: "dev", Start: "0 8 * * *"},
+			wantErr:  "either an instance or a group",
+		},
+		"no expression": {
+			schedule: instances.Schedule{Instance: existingInstanceName},
+			wantErr:  "start or a stop",
+		},
+		"invalid expression": {
+			schedule: instances.Schedule{Instance: existingInstanceName, Start: "8am"},
+			wantErr:  "expected 5 fields",
+		},
+		"invalid time zone": {
+			schedule: instances.Schedule{Instance: existingInstanceName, Start: "0 8 * * *", TimeZone: "Mars/Olympus"},
+			wantErr:  "invalid time zone",
+		},
+		"nonexisting instance": {
+			schedule: instances.Schedule{Instance: "iDontExist", Start: "0 8 * * *"},
+			wantErr:  "no instance named",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := getInitializedDatabase()
+			if err != nil {
+				t.Fatalf("test setup failed: %v", err)
+			}
+
+			err = db.AddSchedule("aSchedule", test.schedule)
+			if !errorContains(err, test.wantErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
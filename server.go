@@ -0,0 +1,530 @@
+package instances
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// eventsKeepAliveInterval is how often a comment is sent on idle event
+// streams, to keep proxies from closing them.
+const eventsKeepAliveInterval = 30 * time.Second
+
+// Server exposes the operations of a Manager over a versioned JSON REST API,
+// described by the OpenAPI document served at /v1/openapi.json, and a web
+// dashboard served at /.
+type Server struct {
+	manager         *Manager
+	auditLog        AuditLog
+	auth            *AuthConfig
+	refreshInterval time.Duration
+	metrics         *Metrics
+	logger          *slog.Logger
+	mux             *http.ServeMux
+}
+
+// ServerOption configures optional behavior of a Server.
+type ServerOption func(*Server)
+
+// WithServerAuditLog sets the log in which mutating requests are recorded.
+// By default, they aren't recorded.
+func WithServerAuditLog(auditLog AuditLog) ServerOption {
+	return func(s *Server) {
+		s.auditLog = auditLog
+	}
+}
+
+// WithAuthConfig requires the requests to be authenticated as one of the
+// principals of config, and restricts them to the permissions of its grants.
+// By default, requests are anonymous and allowed everything.
+func WithAuthConfig(config *AuthConfig) ServerOption {
+	return func(s *Server) {
+		s.auth = config
+	}
+}
+
+// WithRefreshInterval sets how often the dashboard picks up the changes of
+// the instances (every 5 seconds by default).
+func WithRefreshInterval(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.refreshInterval = interval
+	}
+}
+
+// WithServerMetrics exports the metrics at /metrics, restricted to the instances
+// the principal of the request can read. By default, metrics aren't
+// exported.
+func WithServerMetrics(metrics *Metrics) ServerOption {
+	return func(s *Server) {
+		s.metrics = metrics
+	}
+}
+
+// WithServerLogger sets the logger of the requests. By default, they aren't
+// logged.
+func WithServerLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+func NewServer(manager *Manager, opts ...ServerOption) *Server {
+	s := &Server{
+		manager:         manager,
+		refreshInterval: defaultRefreshInterval,
+		logger:          discardLogger,
+		mux:             http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mux.HandleFunc("GET /v1/openapi.json", s.getOpenAPISpec)
+	s.mux.HandleFunc("GET /v1/instances", s.listInstances)
+	s.mux.HandleFunc("POST /v1/instances", s.addInstance)
+	s.mux.HandleFunc("GET /v1/instances/{name}", s.getInstance)
+	s.mux.HandleFunc("DELETE /v1/instances/{name}", s.removeInstance)
+	s.mux.HandleFunc("GET /v1/instances/{name}/status", s.getInstanceStatus)
+	s.mux.HandleFunc("POST /v1/instances/{name}/start", s.startInstance)
+	s.mux.HandleFunc("POST /v1/instances/{name}/stop", s.stopInstance)
+	s.mux.HandleFunc("POST /v1/instances/{name}/reboot", s.rebootInstance)
+	s.mux.HandleFunc("GET /v1/events", s.streamEvents)
+	s.mux.HandleFunc("GET /{$}", s.getDashboard)
+	s.mux.HandleFunc("GET /dashboard/events", s.streamDashboardEvents)
+	if s.metrics != nil {
+		s.mux.HandleFunc("GET /metrics", s.getMetrics)
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.serve(recorder, r)
+
+	level := slog.LevelDebug
+	if recorder.status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	s.logger.Log(r.Context(), level, "request",
+		"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr,
+		"status", recorder.status, "duration", time.Since(start))
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	// The API description and the dashboard page are public.
+	if r.URL.Path == "/v1/openapi.json" || r.URL.Path == "/" {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	principal := anonymousAdmin
+	if s.auth != nil {
+		var err error
+		principal, err = s.auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="instances"`)
+			writeError(w, err)
+			return
+		}
+	}
+
+	s.mux.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+}
+
+type addInstanceRequest struct {
+	Id          string            `json:"id"`
+	Name        string            `json:"name"`
+	Cloud       string            `json:"cloud"`
+	Group       string            `json:"group,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Notes       string            `json:"notes,omitempty"`
+	Expiry      *time.Time        `json:"expires-at,omitempty"`
+	Protected   bool              `json:"protected,omitempty"`
+}
+
+type startInstanceRequest struct {
+	// For is the duration of the lease of the instance, like "2h".
+	For string `json:"for,omitempty"`
+}
+
+type actionResponse struct {
+	Name     string `json:"name"`
+	Response string `json:"response"`
+}
+
+type statusResponse struct {
+	Name  string        `json:"name"`
+	State InstanceState `json:"state"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (s *Server) listInstances(w http.ResponseWriter, r *http.Request) {
+	principal := principalFrom(r.Context())
+	instances := []NamedInstance{}
+	for _, instance := range s.manager.Instances() {
+		if principal.Can(PermissionRead, instance.Instance) {
+			instances = append(instances, instance)
+		}
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+func (s *Server) getInstance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	instance, err := s.authorize(r, PermissionRead, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NamedInstance{Name: name, Instance: instance})
+}
+
+func (s *Server) addInstance(w http.ResponseWriter, r *http.Request) {
+	var request addInstanceRequest
+	if err := decodeJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response, err := s.audited(r, "add", request.Name, func() (string, error) {
+		principal := principalFrom(r.Context())
+		if !principal.Can(PermissionManage, Instance{Group: request.Group, Tags: request.Tags}) {
+			return "", permissionDenied(principal, PermissionManage, request.Name)
+		}
+		owner := request.Owner
+		if owner == "" && principal != anonymousAdmin {
+			owner = principal.Name
+		}
+		return s.manager.AddInstance(request.Id, request.Name, request.Cloud, InstanceOptions{
+			Group:       request.Group,
+			Tags:        request.Tags,
+			Owner:       owner,
+			Description: request.Description,
+			Notes:       request.Notes,
+			Expiry:      request.Expiry,
+			Protected:   request.Protected,
+		})
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	instance, err := s.manager.Instance(request.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/v1/instances/"+request.Name)
+	writeJSON(w, http.StatusCreated, struct {
+		NamedInstance
+		Response string `json:"response"`
+	}{NamedInstance{Name: request.Name, Instance: instance}, response})
+}
+
+func (s *Server) removeInstance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	_, err := s.audited(r, "rm", name, func() (string, error) {
+		if _, err := s.authorize(r, PermissionManage, name); err != nil {
+			return "", err
+		}
+		return "", s.manager.RemoveInstance(name)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getInstanceStatus(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, err := s.authorize(r, PermissionRead, name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	state, err := s.manager.InstanceStatus(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Name: name, State: state})
+}
+
+func (s *Server) startInstance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var request startInstanceRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &request); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	var lease time.Duration
+	if request.For != "" {
+		var err error
+		lease, err = ParseDuration(request.For)
+		if err != nil {
+			writeError(w, Errorf(ErrInvalidArgument, "%v", err))
+			return
+		}
+	}
+
+	response, err := s.audited(r, "start", name, func() (string, error) {
+		if _, err := s.authorize(r, PermissionOperate, name); err != nil {
+			return "", err
+		}
+		return s.manager.StartInstance(name, lease, "api")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, actionResponse{Name: name, Response: response})
+}
+
+func (s *Server) stopInstance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	response, err := s.audited(r, "stop", name, func() (string, error) {
+		if _, err := s.authorize(r, PermissionOperate, name); err != nil {
+			return "", err
+		}
+		return s.manager.StopInstance(name, "api")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, actionResponse{Name: name, Response: response})
+}
+
+func (s *Server) rebootInstance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	response, err := s.audited(r, "reboot", name, func() (string, error) {
+		if _, err := s.authorize(r, PermissionOperate, name); err != nil {
+			return "", err
+		}
+		return s.manager.RebootInstance(name, "api")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, actionResponse{Name: name, Response: response})
+}
+
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	principal := principalFrom(r.Context())
+	w.Header().Set("Content-Type", metricsContentType)
+	s.metrics.Write(w, func(instance Instance) bool {
+		return principal.Can(PermissionRead, instance)
+	})
+}
+
+// streamEvents sends the events of the instances the principal of the
+// request can read as server-sent events, from the one following the cursor
+// given by the Last-Event-ID header or the after parameter, if any. A "reset"
+// event is sent first when events following the cursor were dropped.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming unsupported"))
+		return
+	}
+
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("after")
+	}
+	var after uint64
+	if cursor != "" {
+		var err error
+		after, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			writeError(w, Errorf(ErrInvalidArgument, "invalid event cursor %q", cursor))
+			return
+		}
+	}
+
+	backlog, missed, events, cancel := s.manager.Events().Subscribe(after, cursor != "")
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if missed {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	principal := principalFrom(r.Context())
+	send := func(event Event) error {
+		if !principal.Can(PermissionRead, Instance{Group: event.Group, Tags: event.Tags}) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// Too slow, the client can resume from its last event.
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// authorize returns the instance name if the principal of the request has
+// the permission on it.
+func (s *Server) authorize(r *http.Request, permission Permission, name string) (Instance, error) {
+	instance, err := s.manager.Instance(name)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	principal := principalFrom(r.Context())
+	if !principal.Can(permission, instance) {
+		return Instance{}, permissionDenied(principal, permission, name)
+	}
+
+	// Without confirmation prompts, only the principals allowed to are
+	// trusted to change the protected instances.
+	if permission != PermissionRead && s.manager.IsProtected(name) && !principal.Can(PermissionChangeProtected, instance) {
+		return Instance{}, permissionDenied(principal, PermissionChangeProtected, name)
+	}
+
+	return instance, nil
+}
+
+// audited runs a mutating operation on target, on the database as saved by
+// the other processes, saves the database and records the operation in the
+// audit log.
+func (s *Server) audited(r *http.Request, command, target string, operation func() (string, error)) (string, error) {
+	var response string
+	err := s.manager.Update(r.Context(), func() (err error) {
+		response, err = operation()
+		return err
+	})
+
+	if s.auditLog != nil {
+		entry := AuditEntry{
+			Time:     s.manager.now(),
+			User:     principalFrom(r.Context()).Name,
+			Host:     r.RemoteAddr,
+			Command:  command,
+			Args:     []string{r.Method + " " + r.URL.Path},
+			Target:   target,
+			Response: response,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if auditErr := s.auditLog.Append(entry); auditErr != nil && err == nil {
+			err = fmt.Errorf("record audit entry: %v", auditErr)
+		}
+	}
+
+	return response, err
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return Errorf(ErrInvalidArgument, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+// statusRecorder records the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrInvalidState):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidArgument):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrUnauthenticated):
+		status = http.StatusUnauthorized
+	case errors.Is(err, ErrPermissionDenied):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrUnsupported):
+		status = http.StatusNotImplemented
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,374 @@
+package instances_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+func newTestServer(t *testing.T, opts ...instances.ServerOption) (*httptest.Server, *fakecloud.Cloud) {
+	t.Helper()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+
+	provider := newTestCloud()
+	provider.AddInstance("id1", instances.InstanceStateStopped, instances.InstanceDetails{})
+	provider.AddInstance("id2", instances.InstanceStateRunning, instances.InstanceDetails{})
+	if err := db.AddInstance("id1", "a", provider); err != nil {
+		t.Fatal(err)
+	}
+	legacyCloud := fakecloud.New(fakecloud.WithName("legacy"))
+	legacyCloud.AddInstance(existingInstanceIds[1], instances.InstanceStateRunning, instances.InstanceDetails{})
+	legacy := legacyCloudProvider{legacyCloud}
+	if err := db.AddInstance(existingInstanceIds[1], "legacy", legacy); err != nil {
+		t.Fatal(err)
+	}
+	cloudProviders := map[string]instances.CloudProvider{
+		"mock":   provider,
+		"legacy": legacy,
+	}
+
+	manager := instances.NewManager(db, cloudProviders, time.Now)
+	server := httptest.NewServer(instances.NewServer(manager, opts...))
+	t.Cleanup(server.Close)
+	return server, provider
+}
+
+// legacyCloudProvider is a cloud provider without optional capabilities,
+// hiding those of the fake cloud it wraps, which implements them all.
+type legacyCloudProvider struct {
+	instances.CloudProvider
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		"list instances": {
+			method:     http.MethodGet,
+			path:       "/v1/instances",
+			wantStatus: http.StatusOK,
+			wantBody:   `"name":"a"`,
+		},
+		"get instance": {
+			method:     http.MethodGet,
+			path:       "/v1/instances/a",
+			wantStatus: http.StatusOK,
+			wantBody:   `"id":"id1"`,
+		},
+		"get nonexisting instance": {
+			method:     http.MethodGet,
+			path:       "/v1/instances/iDontExist",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "no instance named",
+		},
+		"add instance": {
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"id": "id2", "name": "b", "cloud": "mock", "group": "dev"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `"group":"dev"`,
+		},
+		"add instance with metadata": {
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"id": "id2", "name": "b", "cloud": "mock", "owner": "alice", "expires-at": "2030-01-01T00:00:00Z"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `"owner":"alice","created-at":`,
+		},
+		"add existing instance": {
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"id": "id2", "name": "a", "cloud": "mock"}`,
+			wantStatus: http.StatusConflict,
+			wantBody:   "exists already",
+		},
+		"add instance with unsupported cloud provider": {
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"id": "id2", "name": "b", "cloud": "myGreatCloud"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "unsupported cloud provider",
+		},
+		"add instance without ID": {
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"name": "b", "cloud": "mock"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "missing instance ID",
+		},
+		"add instance with unknown field": {
+			method:     http.MethodPost,
+			path:       "/v1/instances",
+			body:       `{"id": "id2", "name": "b", "cloud-provider": "mock"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "unknown field",
+		},
+		"remove instance": {
+			method:     http.MethodDelete,
+			path:       "/v1/instances/a",
+			wantStatus: http.StatusNoContent,
+		},
+		"remove nonexisting instance": {
+			method:     http.MethodDelete,
+			path:       "/v1/instances/iDontExist",
+			wantStatus: http.StatusNotFound,
+		},
+		"instance status": {
+			method:     http.MethodGet,
+			path:       "/v1/instances/a/status",
+			wantStatus: http.StatusOK,
+			wantBody:   `"state":"stopped"`,
+		},
+		"start instance": {
+			method:     http.MethodPost,
+			path:       "/v1/instances/a/start",
+			wantStatus: http.StatusAccepted,
+			wantBody:   "instance running, was stopped",
+		},
+		"start instance with lease": {
+			method:     http.MethodPost,
+			path:       "/v1/instances/a/start",
+			body:       `{"for": "2h"}`,
+			wantStatus: http.StatusAccepted,
+		},
+		"start instance with invalid lease": {
+			method:     http.MethodPost,
+			path:       "/v1/instances/a/start",
+			body:       `{"for": "soon"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "invalid duration",
+		},
+		"stop instance": {
+			method:     http.MethodPost,
+			path:       "/v1/instances/" + existingInstanceName + "/stop",
+			wantStatus: http.StatusAccepted,
+			wantBody:   "instance stopped, was running",
+		},
+		"stop stopped instance": {
+			method:     http.MethodPost,
+			path:       "/v1/instances/a/stop",
+			wantStatus: http.StatusConflict,
+			wantBody:   "not running",
+		},
+		"reboot instance": {
+			method:     http.MethodPost,
+			path:       "/v1/instances/" + existingInstanceName + "/reboot",
+			wantStatus: http.StatusAccepted,
+			wantBody:   `"name":"` + existingInstanceName + `"`,
+		},
+		"reboot instance of provider without reboot": {
+			method:     http.MethodPost,
+			path:       "/v1/instances/legacy/reboot",
+			wantStatus: http.StatusNotImplemented,
+			wantBody:   "can't reboot instances",
+		},
+		"dashboard": {
+			method:     http.MethodGet,
+			path:       "/",
+			wantStatus: http.StatusOK,
+			wantBody:   "<title>Instances</title>",
+		},
+		"wrong method": {
+			method:     http.MethodPut,
+			path:       "/v1/instances/a",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		"unversioned path": {
+			method:     http.MethodGet,
+			path:       "/instances",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, _ := newTestServer(t)
+
+			req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("unexpected status %d, want %d: %s", resp.StatusCode, test.wantStatus, body)
+			}
+			if !strings.Contains(string(body), test.wantBody) {
+				t.Fatalf("unexpected body %s, want it to contain %s", body, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	t.Parallel()
+	auditLog := &instances.MemoryAuditLog{}
+	server, provider := newTestServer(t, instances.WithServerAuditLog(auditLog))
+
+	resp, err := server.Client().Post(server.URL+"/v1/instances/a/start", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var started []string
+	for _, call := range provider.Calls() {
+		if call.Method == "StartInstance" {
+			started = append(started, call.ID)
+		}
+	}
+	if len(started) != 1 || started[0] != "id1" {
+		t.Fatalf("unexpected instances started: %v", started)
+	}
+
+	entries, err := auditLog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Command != "start" || entries[0].Target != "a" {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+}
+
+func TestServerOpenAPISpec(t *testing.T) {
+	t.Parallel()
+	server, _ := newTestServer(t)
+
+	resp, err := server.Client().Get(server.URL + "/v1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+
+	for _, path := range []string{"/instances", "/instances/{name}", "/instances/{name}/status", "/instances/{name}/start", "/instances/{name}/stop"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("path %s not documented", path)
+		}
+	}
+}
+
+func TestServerDashboardEvents(t *testing.T) {
+	t.Parallel()
+	server, provider := newTestServer(t, instances.WithRefreshInterval(time.Millisecond))
+
+	// The streams show the states observed by the server, like by this
+	// request, rather than polling the cloud providers.
+	status, err := server.Client().Get(server.URL + "/v1/instances/a/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status.Body.Close()
+	polls := provider.CallCount("GetInstanceStatus")
+
+	resp, err := server.Client().Get(server.URL + "/dashboard/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	nextEvent := func() string {
+		t.Helper()
+		for events.Scan() {
+			if data, found := strings.CutPrefix(events.Text(), "data: "); found {
+				return data
+			}
+		}
+		t.Fatalf("event stream ended: %v", events.Err())
+		return ""
+	}
+
+	if event := nextEvent(); !strings.Contains(event, `"name":"a","cloud":"mock","state":"stopped"`) {
+		t.Fatalf("unexpected first event %s", event)
+	}
+
+	// Operations through the server are streamed without waiting for the
+	// next refresh.
+	started, err := server.Client().Post(server.URL+"/v1/instances/a/start", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started.Body.Close()
+
+	if event := nextEvent(); !strings.Contains(event, `"name":"a","cloud":"mock","state":"running"`) {
+		t.Fatalf("unexpected event after start %s", event)
+	}
+	if calls := provider.CallCount("GetInstanceStatus"); calls != polls {
+		t.Errorf("the streams polled the cloud provider %d times", calls-polls)
+	}
+}
+
+func TestServerKeepsOtherChanges(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(path, []byte(`{"instances": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cloud := newTestCloud()
+	db := openDatabaseFile(t, path)
+	manager := instances.NewManager(db, map[string]instances.CloudProvider{"mock": cloud}, time.Now)
+	server := httptest.NewServer(instances.NewServer(manager))
+	t.Cleanup(server.Close)
+
+	// Another invocation adds an instance while the server runs.
+	other := openDatabaseFile(t, path)
+	err := other.Update(context.Background(), func() error {
+		return other.AddInstance(existingInstanceIds[0], "a", cloud)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := server.Client().Post(server.URL+"/v1/instances", "application/json",
+		strings.NewReader(`{"id": "`+existingInstanceIds[1]+`", "name": "b", "cloud": "mock"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	if got := sortedNames(openDatabaseFile(t, path)); got != "a, b" {
+		t.Fatalf("got saved instances %s, want a, b", got)
+	}
+}
@@ -0,0 +1,99 @@
+package instances
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer of the package.
+const tracerName = "github.com/nonatomiclabs/instances"
+
+// tracer returns the tracer of the package, from the global tracer provider
+// (which doesn't record anything unless one is set with
+// otel.SetTracerProvider).
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// endSpan records err, if any, in span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Attributes of the spans of the calls to the cloud providers.
+var (
+	attributeInstanceID = attribute.Key("instance.id")
+	attributeProvider   = attribute.Key("cloud.provider")
+	attributeRegion     = attribute.Key("cloud.region")
+)
+
+// NewTracerProvider returns a tracer provider exporting the spans to
+// destination: "otlp" to export them with OTLP over HTTP, to the endpoint
+// configured by the standard OTEL_EXPORTER_OTLP_* environment variables
+// (http://localhost:4318 by default), or else the path of a file to which
+// they are appended as JSON. The provider must be shut down to flush the
+// spans.
+func NewTracerProvider(ctx context.Context, destination string) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	if destination == "otlp" {
+		otlpExporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("create OTLP exporter: %s", err)
+		}
+		exporter = otlpExporter
+	} else {
+		f, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open trace file: %s", err)
+		}
+		stdoutExporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("create trace file exporter: %s", err)
+		}
+		exporter = fileExporter{SpanExporter: stdoutExporter, file: f}
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("instances"),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("create trace resource: %s", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// fileExporter is a span exporter writing to a file, which it closes when
+// shut down.
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e fileExporter) Shutdown(ctx context.Context) error {
+	if err := e.SpanExporter.Shutdown(ctx); err != nil {
+		e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
@@ -0,0 +1,134 @@
+package instances_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nonatomiclabs/instances"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordSpans sets a global tracer provider recording the spans for the
+// duration of the test, which thus can't run in parallel.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return exporter
+}
+
+func TestCLITracing(t *testing.T) {
+	tests := map[string]struct {
+		ec2Client instances.EC2InstanceManager
+		// wantSpans are the spans expected under the span of the command, with
+		// whether they failed.
+		wantSpans map[string]bool
+	}{
+		"success": {
+			ec2Client: newFakeCloud().EC2(),
+			wantSpans: map[string]bool{"EC2.StartInstances": false},
+		},
+		"failure": {
+			ec2Client: newFailingEC2(),
+			wantSpans: map[string]bool{"EC2.StartInstances": true},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			exporter := recordSpans(t)
+
+			cloud := instances.AWSCloud{Ec2Client: tc.ec2Client, Region: "eu-west-1"}
+			db, err := instances.NewDatabase(bytes.NewBufferString(`{"instances": {}}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.AddInstance(nonRunningInstanceId, "web", cloud); err != nil {
+				t.Fatal(err)
+			}
+			cli := instances.NewCLI(db, map[string]instances.CloudProvider{"aws": cloud}, instances.WithOutput(&bytes.Buffer{}))
+			exporter.Reset()
+
+			runErr := cli.RunContext(context.Background(), []string{"start", "web"})
+
+			spans := map[string]tracetest.SpanStub{}
+			for _, span := range exporter.GetSpans() {
+				spans[span.Name] = span
+			}
+
+			command, ok := spans["instances start"]
+			if !ok {
+				t.Fatalf("no span of the command in %v", spans)
+			}
+			if failed := command.Status.Code == codes.Error; failed != (runErr != nil) {
+				t.Errorf("got command span status %v, want it to be an error only if the command failed (%v)", command.Status, runErr)
+			}
+			if _, ok := spans["database.save"]; !ok {
+				t.Errorf("no span of the database save in %v", spans)
+			}
+
+			for name, wantFailed := range tc.wantSpans {
+				span, ok := spans[name]
+				if !ok {
+					t.Errorf("no span %q", name)
+					continue
+				}
+				if span.Parent.SpanID() != command.SpanContext.SpanID() {
+					t.Errorf("span %q isn't a child of the command span", name)
+				}
+				if failed := span.Status.Code == codes.Error; failed != wantFailed {
+					t.Errorf("span %q: got status %v, want failed %v", name, span.Status, wantFailed)
+				}
+				for _, want := range []attribute.KeyValue{
+					attribute.String("instance.id", nonRunningInstanceId),
+					attribute.String("cloud.provider", "aws"),
+					attribute.String("cloud.region", "eu-west-1"),
+				} {
+					if !hasAttribute(span.Attributes, want) {
+						t.Errorf("span %q: attributes %v don't contain %v", name, span.Attributes, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func hasAttribute(attributes []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attributes {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewTracerProviderFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "traces.json")
+	tracerProvider, err := instances.NewTracerProvider(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := tracerProvider.Tracer("test").Start(context.Background(), "operation")
+	span.End()
+	if err := tracerProvider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"Name":"operation"`)) {
+		t.Errorf("span not exported to the file:\n%s", b)
+	}
+}
@@ -0,0 +1,107 @@
+package instances_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nonatomiclabs/instances"
+	"github.com/nonatomiclabs/instances/fakecloud"
+)
+
+// newWatchCLI returns a CLI whose instance web was just started, and is
+// pending for the given number of status requests before running.
+func newWatchCLI(t *testing.T, pendingPolls int) (*instances.CLI, *bytes.Buffer) {
+	t.Helper()
+	db, err := getInitializedDatabase()
+	if err != nil {
+		t.Fatalf("test setup failed: %v", err)
+	}
+
+	// The clock advances by a minute whenever the cloud reads it, which it
+	// does once when starting the instance, then once per status request
+	// while the instance is pending.
+	minutes := 0
+	now := func() time.Time {
+		minutes++
+		return time.Date(2023, 4, 10, 12, minutes, 0, 0, time.UTC)
+	}
+	provider := fakecloud.New(fakecloud.WithName("mock"), fakecloud.WithClock(now), fakecloud.WithTransitionDelay(time.Duration(pendingPolls+1)*time.Minute))
+	provider.AddInstance("id1", instances.InstanceStateStopped, instances.InstanceDetails{})
+	if err := db.AddInstance("id1", "web", provider); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.StartInstance("id1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cli := instances.NewCLI(db, map[string]instances.CloudProvider{"mock": provider}, instances.WithOutput(&out))
+	return cli, &out
+}
+
+func TestWatchJSON(t *testing.T) {
+	t.Parallel()
+	cli, out := newWatchCLI(t, 2)
+
+	err := cli.Run([]string{"watch", "--interval", "1ms", "--until", "running", "--json", "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		var event struct {
+			Time     time.Time
+			Instance string
+			State    string
+			Previous string
+		}
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Time.IsZero() {
+			t.Fatalf("event without time: %+v", event)
+		}
+		got = append(got, event.Instance+" "+event.Previous+"->"+event.State)
+	}
+
+	want := []string{"web ->pending", "web pending->running"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("got transitions %v, want %v", got, want)
+	}
+}
+
+func TestWatchTable(t *testing.T) {
+	t.Parallel()
+	cli, out := newWatchCLI(t, 1)
+
+	err := cli.Run([]string{"watch", "--interval", "1ms", "--until", "running", "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := strings.Split(strings.TrimSpace(out.String()), "\n\n")
+	if len(tables) != 2 {
+		t.Fatalf("got %d tables, want 2:\n%s", len(tables), out)
+	}
+	if !strings.HasPrefix(tables[0], "INSTANCE  STATE    SINCE\nweb       pending") {
+		t.Fatalf("unexpected first table:\n%s", tables[0])
+	}
+	if !strings.HasPrefix(tables[1], "INSTANCE  STATE    SINCE\nweb       running") {
+		t.Fatalf("unexpected second table:\n%s", tables[1])
+	}
+}
+
+func TestWatchTimeout(t *testing.T) {
+	t.Parallel()
+	cli, _ := newWatchCLI(t, 1000)
+
+	err := cli.Run([]string{"watch", "--interval", "1ms", "--until", "running", "--timeout", "20ms", "web"})
+	if !errorContains(err, "timed out waiting for the instances to be running") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}